@@ -1,16 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/rpc"
+	"github.com/harveynw/blokechain/internal/script"
 	"github.com/harveynw/blokechain/internal/wallet"
+	"golang.org/x/term"
 )
 
 // ErrTooManyArguments when overspecified
 var ErrTooManyArguments = errors.New("Too many arguments")
+// ErrWrongArguments when a command is given the wrong number of arguments
+var ErrWrongArguments = errors.New("Wrong number of arguments")
+// ErrPassphraseMismatch when the repeated passphrase differs
+var ErrPassphraseMismatch = errors.New("Passphrases do not match")
+
+// How long a command keeps an encrypted wallet unlocked
+const unlockTimeout = time.Minute
 
 // Option defines a wallet CLI command
 type Option struct {
@@ -24,15 +45,61 @@ func newOption(command string, handler func(), description string) Option {
 	return Option{handler: handler, triggered: f, description: description}
 }
 
+var network = flag.String("network", chainparams.MainNet().Name, "Network to use: mainnet, testnet, signet or regtest")
+
+var dataDir = flag.String("datadir", "", "Data directory, defaults to $" + wallet.DataDirEnv + " or the XDG data directory")
+var walletName = flag.String("wallet", wallet.DefaultName, "Name of the wallet to use")
+
+var feeRate = flag.Float64("feerate", 1, "Feerate of -send in sat/vB")
+var dryRun = flag.Bool("dryrun", false, "Show what -send would do without signing anything into the wallet")
+var broadcast = flag.Bool("broadcast", false, "Submit the transaction made by -send to a local node instead of printing it")
+var rpcConnect = flag.String("rpcconnect", "", "Node RPC URL, defaults to the local node of the network")
+var rpcUser = flag.String("rpcuser", "", "Node RPC user, the node's cookie file is used if empty")
+var rpcPassword = flag.String("rpcpassword", "", "Node RPC password")
+var rpcCookieFile = flag.String("rpccookiefile", "", "Node RPC cookie file, defaults to the one in ~/.bitcoin")
+
+// A node serves the blocks balances are scanned from
+var _ wallet.BlockSource = (*rpc.Client)(nil)
+
+// params of the selected network and location of the selected wallet, set once flags are parsed
+var params *chainparams.Params
+var location wallet.Location
+
 var options = []Option {
 	newOption("g", newAddress, "Generate a new address"),
 	newOption("ls", listAddresses, "List addresses"),
-	newOption("b", listBalances, "List balances of addresses"),
+	newOption("b", listBalances, "Scan blocks and the mempool of the local node and list balances of addresses"),
+	newOption("send", send, "Pay an amount in BTC to an address, printing the raw transaction or with -broadcast submitting it: -send <address> <amount>"),
+	newOption("abandon", abandonPayment, "Release the coins reserved by a payment that will not be mined, such as one never broadcast: -abandon <txid>"),
+	newOption("validate", validateAddress, "Validate a destination address: -validate <address>"),
+	newOption("create", createWallet, "Create a new wallet with a 12 or 24 word mnemonic: -create [words]"),
+	newOption("listwallets", listWallets, "List the wallets on the network"),
+	newOption("restore", restoreWallet, "Restore a wallet from its mnemonic, entered at the prompt so it stays out of shell history: -restore"),
+	newOption("mnemonic", showMnemonic, "Show the mnemonic backup phrase of the wallet"),
+	newOption("import-wif", importWIF, "Import a private key in Wallet Import Format, entered at the prompt so it stays out of shell history: -import-wif"),
+	newOption("export-wif", exportWIF, "Export the private key of an address in Wallet Import Format: -export-wif <address>"),
+	newOption("signmessage", signMessage, "Sign a message, legacy addresses give a signmessage signature and others a BIP322 proof: -signmessage <address> <message>"),
+	newOption("signmessage-multisig", signMessageMultisig, "Sign a message for a P2SH or P2WSH multisig address: -signmessage-multisig <address> <redeem script hex> <message>"),
+	newOption("verifymessage", verifyMessage, "Verify a signed message or BIP322 proof: -verifymessage <address> <signature> <message>"),
+	newOption("encrypt", encryptWallet, "Encrypt the wallet's keys with a passphrase"),
+	newOption("change-passphrase", changePassphrase, "Change the passphrase of an encrypted wallet"),
 }
 
 func main() {
 	flag.Parse()
-	assertSingleArgument()
+	assertSingleCommand()
+
+	var err error
+	params, err = chainparams.Lookup(*network)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	location, err = wallet.NewLocation(*dataDir, *walletName, params)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	for _, option := range options {
 		if *option.triggered {
@@ -42,40 +109,513 @@ func main() {
 	}
 }
 
-func assertSingleArgument() {
-	if flag.NArg() + flag.NFlag() != 1 {
+func assertSingleCommand() {
+	triggered := 0
+	for _, option := range options {
+		if *option.triggered {
+			triggered++
+		}
+	}
+	if triggered != 1 {
 		fmt.Println(ErrTooManyArguments)
 		os.Exit(0)
 	}
 }
 
+func assertArguments(n int) {
+	if flag.NArg() != n {
+		fmt.Println(ErrWrongArguments)
+		os.Exit(0)
+	}
+}
+
 func newAddress() {
-	assertSingleArgument()
+	assertArguments(0)
 
-	addr := wallet.Load().GenerateNew()
+	addr, err := unlockWallet(loadWallet()).GenerateNew()
+	if err != nil {
+		fmt.Println("Failed to generate address:", err)
+		os.Exit(1)
+	}
 	fmt.Println(addr)
 }
 
 func listAddresses() {
-	assertSingleArgument()
+	assertArguments(0)
 
-	addresses := wallet.Load().Addresses
+	addresses := loadWallet().Addresses
 	for _, addr := range addresses {
-		fmt.Println(addr.PublicKey.ToAddress())
+		fmt.Println(addr.PublicKey.ToSegwitAddress(params), addr.PublicKey.ToTaprootAddress(params), addr.PublicKey.ToAddress(params))
 	}
 }
 
 func listBalances() {
-	assertSingleArgument()
+	assertArguments(0)
 
-	fmt.Printf("Gathering UXTOs from nodes...\n\n")
-	fmt.Println("Total Balance : 0 BTC")
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.Debug)
-	fmt.Fprintln(w, "\t\033[1mAddress\033[0m\t\033[1mBalance\033[0m\t")
+	w := loadWallet()
+	fmt.Printf("Scanning blocks from node...\n\n")
+	client, err := rpcClient()
+	if err == nil {
+		_, err = w.Scan(client)
+	}
+	if err != nil {
+		fmt.Printf("Could not scan (%v), balances as of block %v\n\n", err, w.ScanHeight)
+	}
 
-	addresses := wallet.Load().Addresses
-	for _, addr := range addresses {
-		fmt.Fprintln(w, "\t\033[0m" + addr.PublicKey.ToAddress() + "\033[0m\t\033[0m0\033[0m\t")
+	total := w.TotalBalance()
+	fmt.Printf("Total Balance : %v BTC (unconfirmed %v, immature %v)\n", wallet.FormatAmount(total.Confirmed), wallet.FormatAmount(total.Unconfirmed), wallet.FormatAmount(total.Immature))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(tw, "\t\033[1mAddress\033[0m\t\033[1mConfirmed\033[0m\t\033[1mUnconfirmed\033[0m\t\033[1mImmature\033[0m\t")
+
+	// Receiving addresses always, any other address only while it holds coins
+	balances := w.Balances()
+	rows := make([]string, 0)
+	for _, addr := range w.Addresses {
+		if !addr.Change {
+			rows = append(rows, addr.PublicKey.ToSegwitAddress(params))
+		}
+	}
+	others := make([]string, 0)
+	for address := range balances {
+		if !contains(rows, address) {
+			others = append(others, address)
+		}
+	}
+	sort.Strings(others)
+	rows = append(rows, others...)
+	for _, address := range rows {
+		b := balances[address]
+		fmt.Fprintf(tw, "\t%v\t%v\t%v\t%v\t\n", address, wallet.FormatAmount(b.Confirmed), wallet.FormatAmount(b.Unconfirmed), wallet.FormatAmount(b.Immature))
+	}
+	tw.Flush()
+}
+
+func send() {
+	assertArguments(2)
+
+	amount, err := wallet.ParseAmount(flag.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *feeRate < 1 {
+		fmt.Println(wallet.ErrFeeRateTooLow)
+		os.Exit(1)
+	}
+	w := unlockWallet(loadWallet())
+	p, err := w.CreatePayment(flag.Arg(0), amount, wallet.FeeRate(*feeRate * 1000))
+	if err != nil {
+		fmt.Println("Failed to create payment:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Send %v BTC to %v\n", wallet.FormatAmount(p.Amount), p.Address)
+	fmt.Printf("Fee %v BTC (%.1f sat/vB, %v vbytes)\n", wallet.FormatAmount(p.Fee), float64(p.FeeRate()) / 1000, p.VSize)
+	if p.ChangeAddress != "" {
+		fmt.Printf("Change %v BTC to %v\n", wallet.FormatAmount(p.Change), p.ChangeAddress)
+	}
+	fmt.Printf("Spending %v inputs, txid %v\n", len(p.Inputs), p.TxID)
+
+	if *dryRun {
+		fmt.Printf("\nDry run, the wallet is unchanged:\n%x\n", p.Raw)
+		return
+	}
+	if !confirm("Send this transaction?") {
+		return
+	}
+
+	if *broadcast {
+		client, err := rpcClient()
+		if err != nil {
+			fmt.Println("Failed to connect to node:", err)
+			os.Exit(1)
+		}
+		if _, err := client.SendRawTransaction(p.Raw); err != nil {
+			fmt.Println("Node rejected the transaction:", err)
+			os.Exit(1)
+		}
+	}
+	if err := w.CommitPayment(p); err != nil {
+		fmt.Println("Failed to record payment in the wallet:", err)
+		os.Exit(1)
+	}
+
+	if *broadcast {
+		fmt.Println("Broadcast", p.TxID)
+	} else {
+		fmt.Printf("%x\n", p.Raw)
+	}
+}
+
+func abandonPayment() {
+	assertArguments(1)
+
+	if err := loadWallet().AbandonPayment(flag.Arg(0)); err != nil {
+		fmt.Println("Failed to abandon payment:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Abandoned", flag.Arg(0))
+}
+
+// rpcClient connects to the node given by the rpc flags, falling back to its cookie file
+func rpcClient() (*rpc.Client, error) {
+	url := *rpcConnect
+	if url == "" {
+		url = rpc.DefaultURL(params)
+	}
+	if *rpcUser != "" {
+		return rpc.NewClient(url, *rpcUser, *rpcPassword), nil
+	}
+	cookie := *rpcCookieFile
+	if cookie == "" {
+		cookie = rpc.DefaultCookiePath(params)
+	}
+	return rpc.NewCookieClient(url, cookie)
+}
+
+func validateAddress() {
+	assertArguments(1)
+
+	lock, err := script.PayToAddress(flag.Arg(0), params)
+	if err != nil {
+		fmt.Println("Invalid address:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Valid %v address (locking script %x)\n", params.Name, lock.Encode())
+}
+
+// loadWallet loads the selected wallet, which must have been created or restored
+func loadWallet() *wallet.Wallet {
+	if !wallet.Exists(location) {
+		fmt.Printf("No wallet named %q at %v, make one with -create or -restore\n", location.Name, location.Folder())
+		warnLegacyWallet()
+		os.Exit(1)
+	}
+	w, err := wallet.Load(location)
+	if err != nil {
+		fmt.Println("Failed to load wallet:", err)
+		os.Exit(1)
+	}
+	return w
+}
+
+// warnLegacyWallet points at a wallet left in ./configs by versions that stored it relative to the working directory
+func warnLegacyWallet() {
+	legacy := filepath.Join("configs", "wallet.json")
+	if params.Name != chainparams.MainNet().Name {
+		legacy = filepath.Join("configs", params.Name, "wallet.json")
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		fmt.Printf("Found a wallet from an older version at %v, move it to %v to use it\n", legacy, location.File())
+	}
+}
+
+func createWallet() {
+	if flag.NArg() > 1 {
+		fmt.Println(ErrWrongArguments)
+		os.Exit(0)
+	}
+	words := 12
+	if flag.NArg() == 1 {
+		n, err := strconv.Atoi(flag.Arg(0))
+		if err != nil || (n != 12 && n != 24) {
+			fmt.Println("Mnemonic must have 12 or 24 words")
+			os.Exit(1)
+		}
+		words = n
+	}
+
+	w, err := wallet.Create(location, words)
+	if err != nil {
+		fmt.Println("Failed to create wallet:", err)
+		warnLegacyWallet()
+		os.Exit(1)
+	}
+	fmt.Printf("Created wallet %q at %v, write down this backup phrase and keep it safe:\n", w.Name(), w.Path())
+	fmt.Printf("\n    %v\n\n", w.Mnemonic)
+}
+
+func listWallets() {
+	assertArguments(0)
+
+	names, err := wallet.List(location.DataDir, params)
+	if err != nil {
+		fmt.Println("Failed to list wallets:", err)
+		os.Exit(1)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+func restoreWallet() {
+	assertArguments(0)
+
+	if wallet.Exists(location) {
+		fmt.Println(wallet.ErrWalletExists)
+		os.Exit(1)
+	}
+
+	// Only at the prompt, shell history and the process list would keep a seed given as an argument
+	mnemonic := promptSecret("Mnemonic: ")
+	passphrase := promptSecret("BIP39 passphrase (leave empty if none): ")
+
+	birthHeight := int64(0)
+	if answer := prompt("Block height of the wallet's first use, scans start there (leave empty to scan from genesis): "); answer != "" {
+		h, err := strconv.ParseInt(answer, 10, 32)
+		if err != nil || h < 0 {
+			fmt.Println("Invalid block height")
+			os.Exit(1)
+		}
+		birthHeight = h
+	}
+
+	w, err := wallet.Restore(location, mnemonic, passphrase)
+	if err != nil {
+		fmt.Println("Failed to restore wallet:", err)
+		os.Exit(1)
+	}
+	if err := w.SetBirthHeight(int32(birthHeight)); err != nil {
+		fmt.Println("Failed to set birth height:", err)
+		os.Exit(1)
+	}
+	addr, err := w.GenerateNew()
+	if err != nil {
+		fmt.Println("Failed to generate address:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Restored wallet, first address", addr)
+}
+
+func showMnemonic() {
+	assertArguments(0)
+
+	w := unlockWallet(loadWallet())
+	if w.Mnemonic == "" {
+		fmt.Println("Wallet holds random keys and has no backup phrase")
+		return
+	}
+	fmt.Println(w.Mnemonic)
+}
+
+func importWIF() {
+	assertArguments(0)
+
+	// Only at the prompt, shell history and the process list would keep a key given as an argument
+	wif := promptSecret("WIF private key: ")
+
+	secretKey, _, err := cryptography.DecodeWIF(wif, params)
+	if err != nil {
+		fmt.Println("Failed to import key:", err) // Errors never contain the key
+		os.Exit(1)
+	}
+	pubKey := cryptography.PublicKeyFromSecretKey(secretKey)
+	if !confirm("Import the key for " + pubKey.ToSegwitAddress(params) + " into the " + params.Name + " wallet?") {
+		return
+	}
+
+	addr, err := unlockWallet(loadWallet()).ImportWIF(wif)
+	if err != nil {
+		fmt.Println("Failed to import key:", err) // Errors never contain the key
+		os.Exit(1)
 	}
-	w.Flush()
-}
\ No newline at end of file
+	fmt.Println("Imported key for", addr)
+	fmt.Println("The next balance scan starts again from genesis to find the key's coins")
+}
+
+func exportWIF() {
+	assertArguments(1)
+
+	w := loadWallet()
+	if _, err := w.Find(flag.Arg(0)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Anyone who sees the exported key can spend every coin sent to this address.")
+	if prompt("Type 'yes' to print the private key: ") != "yes" {
+		fmt.Println("Aborted")
+		return
+	}
+
+	wif, err := unlockWallet(w).ExportWIF(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(wif)
+}
+
+func signMessage() {
+	if flag.NArg() < 2 {
+		fmt.Println(ErrWrongArguments)
+		os.Exit(0)
+	}
+
+	address, message := flag.Arg(0), strings.Join(flag.Args()[1:], " ")
+
+	// Legacy addresses keep the signmessage format so older wallets can check them
+	var sig string
+	var err error
+	w := unlockWallet(loadWallet())
+	if isPubKeyHashAddress(address) {
+		sig, err = w.SignMessage(address, message)
+	} else {
+		sig, err = w.SignMessageBIP322(address, message)
+	}
+	if err != nil {
+		fmt.Println("Failed to sign message:", err)
+		os.Exit(1)
+	}
+	fmt.Println(sig)
+}
+
+func verifyMessage() {
+	if flag.NArg() < 3 {
+		fmt.Println(ErrWrongArguments)
+		os.Exit(0)
+	}
+
+	address, sig, message := flag.Arg(0), flag.Arg(1), strings.Join(flag.Args()[2:], " ")
+
+	var valid bool
+	var err error
+	if compact, _ := base64.StdEncoding.DecodeString(sig); isPubKeyHashAddress(address) && len(compact) == 65 {
+		valid, err = cryptography.VerifyBitcoinMessage(address, sig, message, params)
+	} else {
+		valid, err = chain.VerifyBIP322(address, message, sig, params)
+	}
+	if err != nil {
+		fmt.Println("Failed to verify message:", err)
+		os.Exit(1)
+	}
+	if !valid {
+		fmt.Println("Signature is NOT valid for this address and message")
+		os.Exit(1)
+	}
+	fmt.Println("Signature is valid")
+}
+
+func signMessageMultisig() {
+	if flag.NArg() < 3 {
+		fmt.Println(ErrWrongArguments)
+		os.Exit(0)
+	}
+
+	redeemScript, err := hex.DecodeString(flag.Arg(1))
+	if err != nil {
+		fmt.Println("Invalid redeem script:", err)
+		os.Exit(1)
+	}
+	proof, err := unlockWallet(loadWallet()).SignMessageMultisig(flag.Arg(0), strings.Join(flag.Args()[2:], " "), redeemScript)
+	if err != nil {
+		fmt.Println("Failed to sign message:", err)
+		os.Exit(1)
+	}
+	fmt.Println(proof)
+}
+
+func encryptWallet() {
+	assertArguments(0)
+
+	w := loadWallet()
+	if w.IsEncrypted() {
+		fmt.Println(wallet.ErrAlreadyEncrypted)
+		os.Exit(1)
+	}
+	fmt.Println("If you forget the passphrase the wallet can only be recovered from its backup phrase.")
+
+	if err := w.Encrypt(newPassphrase()); err != nil {
+		fmt.Println("Failed to encrypt wallet:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Wallet encrypted")
+}
+
+func changePassphrase() {
+	assertArguments(0)
+
+	w := loadWallet()
+	if !w.IsEncrypted() {
+		fmt.Println(wallet.ErrNotEncrypted)
+		os.Exit(1)
+	}
+
+	old := promptSecret("Current passphrase: ")
+	if err := w.ChangePassphrase(old, newPassphrase()); err != nil {
+		fmt.Println("Failed to change passphrase:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Passphrase changed")
+}
+
+// unlockWallet asks for the passphrase of an encrypted wallet
+func unlockWallet(w *wallet.Wallet) *wallet.Wallet {
+	if !w.IsLocked() {
+		return w
+	}
+	if err := w.Unlock(promptSecret("Wallet passphrase: "), unlockTimeout); err != nil {
+		fmt.Println("Failed to unlock wallet:", err)
+		os.Exit(1)
+	}
+	return w
+}
+
+// newPassphrase asks for a passphrase twice
+func newPassphrase() string {
+	passphrase := promptSecret("New passphrase: ")
+	if promptSecret("Repeat passphrase: ") != passphrase {
+		fmt.Println(ErrPassphraseMismatch)
+		os.Exit(1)
+	}
+	return passphrase
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isPubKeyHashAddress(address string) bool {
+	version, _, err := cryptography.DecodeAddress(address)
+	return err == nil && version == params.PubKeyHashAddrID
+}
+
+// confirm asks a yes/no question, defaulting to no
+func confirm(question string) bool {
+	answer := strings.ToLower(prompt(question + " [y/N]: "))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("Aborted")
+		return false
+	}
+	return true
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt reads a line from stdin
+func prompt(question string) string {
+	fmt.Print(question)
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// promptSecret reads a line from stdin without echoing it when stdin is a terminal
+func promptSecret(question string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(question)
+	}
+	fmt.Print(question)
+	secret, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		fmt.Println("Failed to read from terminal:", err)
+		os.Exit(1)
+	}
+	return strings.TrimSpace(string(secret))
+}
@@ -2,4 +2,7 @@ module github.com/harveynw/blokechain
 
 go 1.15
 
-require golang.org/x/crypto v0.1.0
+require (
+	golang.org/x/crypto v0.1.0
+	golang.org/x/term v0.10.0
+)
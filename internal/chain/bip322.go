@@ -0,0 +1,189 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// ErrInvalidProof when a BIP322 proof cannot be decoded or does not spend the message challenge
+var ErrInvalidProof = errors.New("Invalid BIP322 proof")
+// ErrUnsupportedAddress when a BIP322 proof cannot be produced for the address type
+var ErrUnsupportedAddress = errors.New("Address type not supported for BIP322 signing")
+// ErrWrongKey when the keys given do not unlock the address
+var ErrWrongKey = errors.New("Keys do not match the address")
+
+// BIP322MessageHash is the tagged hash committing to a message
+func BIP322MessageHash(message string) []byte {
+	return cryptography.TaggedHash("BIP0322-signed-message", []byte(message))
+}
+
+// BIP322ToSpend builds the virtual transaction whose only output is locked by the challenge (the address' locking script)
+func BIP322ToSpend(message string, challenge []byte) Transaction {
+	scriptSig := script.NewScript()
+	scriptSig.AppendOpCode(0x00)
+	scriptSig.AppendData(BIP322MessageHash(message))
+
+	return Transaction{
+		txIn: []TransactionInput{{
+			prevTransaction: make([]byte, 32),
+			prevIndex: 0xFFFFFFFF,
+			scriptSig: scriptSig.Encode(),
+		}},
+		txOut: []TransactionOutput{{scriptPubKey: challenge}},
+	}
+}
+
+// BIP322ToSign builds the unsigned virtual transaction spending to_spend to a single OP_RETURN output
+func BIP322ToSign(toSpend Transaction) Transaction {
+	return Transaction{
+		txIn: []TransactionInput{{
+			prevTransaction: toSpend.ID(),
+			prevIndex: 0,
+			prevTransactionPubKey: toSpend.txOut[0].scriptPubKey,
+			scriptSig: []byte{},
+		}},
+		txOut: []TransactionOutput{{scriptPubKey: []byte{0x6a}}},
+	}
+}
+
+// SignBIP322 proves control of a single key address, a simple proof for P2WPKH and P2TR and a full proof for P2PKH and P2SH-P2WPKH
+func SignBIP322(address, message string, secretKey *big.Int, params *chainparams.Params) (string, error) {
+	challenge, err := script.PayToAddress(address, params)
+	if err != nil {
+		return "", err
+	}
+	toSign := BIP322ToSign(BIP322ToSpend(message, challenge.Encode()))
+	if err := signInput(&toSign, 0, secretKey); err == ErrUnsupportedScript {
+		return "", ErrUnsupportedAddress
+	} else if err != nil {
+		return "", err
+	}
+
+	return finishBIP322(toSign)
+}
+
+// SignBIP322Multisig proves control of a P2SH or P2WSH multisig address, secretKeys must hold at least m of its keys
+func SignBIP322Multisig(address, message string, redeemScript []byte, secretKeys []*big.Int, params *chainparams.Params) (string, error) {
+	challenge, err := script.PayToAddress(address, params)
+	if err != nil {
+		return "", err
+	}
+	m, pubKeys, ok := script.ParseMultisig(redeemScript)
+	if !ok {
+		return "", ErrUnsupportedAddress
+	}
+	toSign := BIP322ToSign(BIP322ToSpend(message, challenge.Encode()))
+	in := &toSign.txIn[0]
+
+	version, program, isWitness := script.ParseWitnessProgram(challenge.Encode())
+	var preimage []byte
+	switch {
+	case isWitness && version == 0 && len(program) == 32:
+		preimage = toSign.WitnessV0SigHashPreimage(0, redeemScript)
+	case script.IsP2SH(challenge.Encode()):
+		preimage = toSign.LegacySigHashPreimage(0, redeemScript)
+	default:
+		return "", ErrUnsupportedAddress
+	}
+
+	// Signatures in the order of the redeem script's public keys, after the dummy item
+	stack := [][]byte{{}}
+	for _, pubKey := range pubKeys {
+		for _, secretKey := range secretKeys {
+			if len(stack) <= m && bytes.Equal(cryptography.PublicKeyFromSecretKey(secretKey).EncodeCompressed(), pubKey) {
+				stack = append(stack, append(cryptography.SignMessage(secretKey, preimage).Encode(), SigHashAll))
+				break
+			}
+		}
+	}
+	if len(stack) <= m {
+		return "", ErrWrongKey
+	}
+	stack = append(stack, redeemScript)
+
+	if isWitness {
+		in.witness = stack
+	} else {
+		scriptSig := script.NewScript()
+		for _, item := range stack {
+			if len(item) == 0 {
+				scriptSig.AppendOpCode(0x00)
+			} else {
+				scriptSig.AppendData(item)
+			}
+		}
+		in.scriptSig = scriptSig.Encode()
+	}
+
+	return finishBIP322(toSign)
+}
+
+// VerifyBIP322 checks a base64 simple or full proof that the holder of address signed message
+func VerifyBIP322(address, message, proof string, params *chainparams.Params) (bool, error) {
+	challenge, err := script.PayToAddress(address, params)
+	if err != nil {
+		return false, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return false, ErrInvalidProof
+	}
+
+	toSpend := BIP322ToSpend(message, challenge.Encode())
+	toSign := BIP322ToSign(toSpend)
+
+	_, _, isWitness := script.ParseWitnessProgram(challenge.Encode())
+	if witness, rest, err := decodeNextWitness(raw); isWitness && err == nil && len(rest) == 0 {
+		// Simple, just the witness of to_sign
+		toSign.txIn[0].witness = witness
+	} else {
+		// Full, to_sign itself which may differ in version, sequence and locktime
+		full, err := decodeProofTransaction(raw)
+		if err != nil {
+			return false, err
+		}
+		if len(full.txIn) != 1 || len(full.txOut) != 1 ||
+			!bytes.Equal(full.txIn[0].prevTransaction, toSpend.ID()) || full.txIn[0].prevIndex != 0 ||
+			full.txOut[0].amount != 0 || !bytes.Equal(full.txOut[0].scriptPubKey, []byte{0x6a}) {
+			return false, ErrInvalidProof
+		}
+		full.txIn[0].prevTransactionPubKey = challenge.Encode()
+		toSign = full
+	}
+
+	switch err := toSign.VerifyInput(0); err {
+	case nil:
+		return true, nil
+	case ErrScriptSigInvalid, ErrWitnessInvalid:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// finishBIP322 checks the signed to_sign and encodes it, as a simple proof if a witness is enough
+func finishBIP322(toSign Transaction) (string, error) {
+	if err := toSign.VerifyInput(0); err != nil {
+		return "", ErrWrongKey
+	}
+
+	in := toSign.txIn[0]
+	if len(in.scriptSig) == 0 && len(in.witness) > 0 {
+		return base64.StdEncoding.EncodeToString(encodeWitness(in.witness)), nil
+	}
+	return base64.StdEncoding.EncodeToString(toSign.Encode(-1)), nil
+}
+
+// decodeProofTransaction decodes a full proof, which must be exactly one transaction
+func decodeProofTransaction(b []byte) (Transaction, error) {
+	tx, rest, err := DecodeNextTransaction(b)
+	if err != nil || len(rest) != 0 {
+		return Transaction{}, ErrInvalidProof
+	}
+	return tx, nil
+}
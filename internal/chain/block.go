@@ -2,21 +2,42 @@ package chain
 
 import (
 	"bytes"
+	"errors"
+	"github.com/harveynw/blokechain/internal/chainparams"
 )
 
+// minTransactionSize is the smallest serialized transaction, with one input and one output
+const minTransactionSize = 4 + 1 + minInputSize + 1 + minOutputSize + 4
+
+// ErrInvalidMagic when a block is not prefixed with the network's magic no
+var ErrInvalidMagic = errors.New("Block magic does not match the network")
+// ErrBlockSize when a block's size field does not match its contents
+var ErrBlockSize = errors.New("Block size does not match its contents")
+
 // Block data structure for forming blockchain
 type Block struct {
 	Header *BlockHeader
 	txs []Transaction
 }
 
-func (block Block) Encode() []byte {
+// NewBlock assembles a block from its header and transactions, coinbase first
+func NewBlock(header *BlockHeader, txs []Transaction) Block {
+	return Block{Header: header, txs: txs}
+}
+
+// Transactions in block order
+func (block Block) Transactions() []Transaction {
+	return block.txs
+}
+
+// Encode serialises the block, prefixed with the network magic no and blocksize
+func (block Block) Encode(params *chainparams.Params) []byte {
 	b := make([]byte, 0)
-	b = append(b, []byte{0xD9, 0xB4, 0xBE, 0xF9}...) // Magic no
+	b = append(b, params.MagicBytes()...) // Magic no
 	b = append(b, []byte{0x00, 0x00, 0x00, 0x00}...) // Blocksize to be amended
 	b = append(b, block.Header.Encode()...) // Block header
 
-	n_txs := VarInt{int64(len(block.txs))}
+	n_txs := VarInt{uint64(len(block.txs))}
 	b = append(b, n_txs.EncodeVarInt()...)
 
 	for _, tx := range(block.txs) {
@@ -24,7 +45,7 @@ func (block Block) Encode() []byte {
 	}
 
 	// Amend Blocksize
-	blocksize := EncodeInt(int64(len(b) - 8), 4)
+	blocksize := encodeUint32(uint32(len(b) - 8))
 	for i, v := range blocksize {
 		b[i+4] = v
 	}
@@ -32,24 +53,48 @@ func (block Block) Encode() []byte {
 	return b
 }
 
-func DecodeBlock(b []byte) Block {
-	if bytes.Compare(b[0:4], []byte{0xD9, 0xB4, 0xBE, 0xF9}) != 0 {
-		panic("Block malformed")
+// DecodeBlock recovers a block serialised for the given network, returning the data after it
+func DecodeBlock(b []byte, params *chainparams.Params) (Block, []byte, error) {
+	if len(b) < 8 {
+		return Block{}, b, ErrUnexpectedEnd
+	}
+	if !bytes.Equal(b[0:4], params.MagicBytes()) {
+		return Block{}, b, ErrInvalidMagic
+	}
+	size := decodeUint32(b[4:8])
+	if uint64(size) > uint64(len(b) - 8) {
+		return Block{}, b, ErrUnexpectedEnd
 	}
 
 	// Discard magic no, blocksize
-	b = b[8:]
+	block, rest, err := DecodeBlockData(b[8:8+size])
+	if err != nil {
+		return Block{}, b, err
+	}
+	if len(rest) != 0 {
+		return Block{}, b, ErrBlockSize
+	}
+	return block, b[8+size:], nil
+}
 
-	bh, b := DecodeNextBlockHeader(b)
+// DecodeBlockData recovers a block serialised without the magic no and blocksize, as nodes return it, and returns rest of data
+func DecodeBlockData(b []byte) (Block, []byte, error) {
+	bh, rest, err := DecodeNextBlockHeader(b)
+	if err != nil {
+		return Block{}, b, err
+	}
 
-	n_txs, b := DecodeNextVarInt(b)
+	n_txs, rest, err := decodeNextCount(rest, minTransactionSize)
+	if err != nil {
+		return Block{}, b, err
+	}
 
-	txs := make([]Transaction, 0)
-	for i := int64(0); i < n_txs.val; i++ {
-		var tx Transaction
-		tx, b = DecodeNextTransaction(b)
-		txs = append(txs, tx)
+	txs := make([]Transaction, n_txs)
+	for i := range txs {
+		if txs[i], rest, err = DecodeNextTransaction(rest); err != nil {
+			return Block{}, b, err
+		}
 	}
 
-	return Block{Header: &bh, txs: txs}
-}
\ No newline at end of file
+	return Block{Header: &bh, txs: txs}, rest, nil
+}
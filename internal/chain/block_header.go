@@ -1,54 +1,173 @@
 package chain
 
+import (
+	"errors"
+	"github.com/harveynw/blokechain/internal/cryptography"
+)
+
+// BlockHeaderSize is the fixed length of a serialized header
+const BlockHeaderSize = 80
+
+// VersionBitsTop marks a BIP9 version, whose low 29 bits each signal readiness for a soft fork
+const VersionBitsTop int32 = 0x20000000
+// VersionBitsTopMask selects the top three bits, which must equal VersionBitsTop for the rest to be signals
+const VersionBitsTopMask int32 = -0x20000000 // 0xE0000000
+// VersionBitsMax is the number of signalling bits
+const VersionBitsMax = 29
+
+// ErrInvalidHeaderHash when a previous block hash or merkle root is not 32 bytes
+var ErrInvalidHeaderHash = errors.New("Block header hashes must be 32 bytes")
+// ErrInvalidVersionBit when a BIP9 bit is outside 0-28
+var ErrInvalidVersionBit = errors.New("Version bit out of range")
+
+// BlockHeader commits to the previous block and the block's transactions, hashes are in internal byte order
 type BlockHeader struct {
-	hashPrevBlock []byte
-	hashMerkleRoot []byte
+	Version int32
+	PrevBlock []byte
+	MerkleRoot []byte
 	Time uint32
 	DifficultyTarget Difficulty
 	Nonce uint32
 }
 
+// NewBlockHeader assembles a header from its fields, bits being the compact difficulty as written in chain parameters
+func NewBlockHeader(version int32, prevBlock, merkleRoot []byte, time, bits, nonce uint32) (*BlockHeader, error) {
+	if len(prevBlock) != 32 || len(merkleRoot) != 32 {
+		return nil, ErrInvalidHeaderHash
+	}
+	difficulty, err := DifficultyFromBits(bits)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHeader{
+		Version: version,
+		PrevBlock: append([]byte{}, prevBlock...),
+		MerkleRoot: append([]byte{}, merkleRoot...),
+		Time: time,
+		DifficultyTarget: difficulty,
+		Nonce: nonce,
+	}, nil
+}
+
+// NewBlockHeaderHex assembles a header from hashes in display order, as block explorers and RPC show them
+func NewBlockHeaderHex(version int32, prevBlock, merkleRoot string, time, bits, nonce uint32) (*BlockHeader, error) {
+	prev, err := ParseHash(prevBlock)
+	if err != nil {
+		return nil, err
+	}
+	root, err := ParseHash(merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockHeader(version, prev, root, time, bits, nonce)
+}
+
+// VersionWithBits is a BIP9 version signalling each of bits
+func VersionWithBits(bits ...uint) (int32, error) {
+	version := VersionBitsTop
+	for _, bit := range bits {
+		if bit >= VersionBitsMax {
+			return 0, ErrInvalidVersionBit
+		}
+		version |= 1 << bit
+	}
+	return version, nil
+}
+
 func (bh BlockHeader) Encode() []byte {
-	enc := make([]byte, 0)
+	enc := make([]byte, 0, BlockHeaderSize)
+
+	// Version
+	enc = append(enc, encodeUint32(uint32(bh.Version))...)
 
-	// Version (arbitrary)
-	enc = append(enc, 0x02, 0x00, 0x00, 0x01)
-	
-	// Previous Block Hash + Merkle Root (32 Bytes)
-	enc = append(enc, bh.hashPrevBlock[0:32]...)
-	enc = append(enc, bh.hashMerkleRoot[0:32]...)
+	// Previous Block Hash + Merkle Root (32 Bytes, written as given so a hand built header's wrong length shows, Serialize rejects it)
+	enc = append(enc, bh.PrevBlock...)
+	enc = append(enc, bh.MerkleRoot...)
 
 	// Timestamp (seconds from Unix Epoch, 4 Bytes)
-	enc = append(enc, EncodeInt(int64(bh.Time), 4)...)
+	enc = append(enc, encodeUint32(bh.Time)...)
 
-	// Difficulty Target + Nonce
-	enc = append(enc, bh.DifficultyTarget.Encode()...)
-	enc = append(enc, EncodeInt(int64(bh.Nonce), 4)...)
+	// Difficulty Target (compact bits, little-endian) + Nonce
+	enc = append(enc, reverseBytes(bh.DifficultyTarget.Encode())...)
+	enc = append(enc, encodeUint32(bh.Nonce)...)
 
 	return enc
 }
 
-func DecodeNextBlockHeader(b []byte) (BlockHeader, []byte) {
-	b = b[4:] // Discard Version
+// BlockHash is the double SHA256 of the header, in internal byte order, meaningless unless both hashes are 32 bytes
+func (bh BlockHeader) BlockHash() []byte {
+	return cryptography.Hash256(bh.Encode())
+}
+
+// HashString is the block hash in display order, as block explorers and RPC show it
+func (bh BlockHeader) HashString() string {
+	return HashString(bh.BlockHash())
+}
+
+// PrevBlockString is the previous block hash in display order
+func (bh BlockHeader) PrevBlockString() string {
+	return HashString(bh.PrevBlock)
+}
+
+// MerkleRootString is the merkle root in display order
+func (bh BlockHeader) MerkleRootString() string {
+	return HashString(bh.MerkleRoot)
+}
+
+// Bits is the compact difficulty as a number, as in chain parameters and RPC
+func (bh BlockHeader) Bits() uint32 {
+	return bh.DifficultyTarget.Bits()
+}
+
+// UsesVersionBits reports whether the version follows BIP9, so its low bits are soft fork signals
+func (bh BlockHeader) UsesVersionBits() bool {
+	return bh.Version & VersionBitsTopMask == VersionBitsTop
+}
+
+// SignalsBit reports whether a BIP9 version sets bit
+func (bh BlockHeader) SignalsBit(bit uint) bool {
+	return bit < VersionBitsMax && bh.UsesVersionBits() && bh.Version & (1 << bit) != 0
+}
+
+// IncrementNonce returns the header with the next nonce to try
+func (bh BlockHeader) IncrementNonce() BlockHeader {
+	bh.Nonce++
+	return bh
+}
+
+// DecodeNextBlockHeader recovers a BlockHeader and returns rest of data
+func DecodeNextBlockHeader(b []byte) (BlockHeader, []byte, error) {
+	if len(b) < BlockHeaderSize {
+		return BlockHeader{}, b, ErrUnexpectedEnd
+	}
+	version, rest := int32(decodeUint32(b[0:4])), b[4:]
 
 	// Block headers are fixed length
-	hashPrevBlock, b := b[0:32], b[32:]
-	hashMerkleRoot, b := b[0:32], b[32:]
-	timestampBytes, b := b[0:4], b[4:]
-	difficultyBytes, b := b[0:4], b[4:]
-	nonceBytes, b := b[0:4], b[4:]
+	prevBlock, rest := rest[0:32], rest[32:]
+	merkleRoot, rest := rest[0:32], rest[32:]
+	timestampBytes, rest := rest[0:4], rest[4:]
+	difficultyBytes, rest := rest[0:4], rest[4:]
+	nonceBytes, rest := rest[0:4], rest[4:]
 
-	difficulty, err := DecodeDifficulty(difficultyBytes)
+	difficulty, err := DecodeDifficulty(reverseBytes(append([]byte{}, difficultyBytes...)))
 	if err != nil {
-		panic("Malformed difficulty in block header")
+		return BlockHeader{}, b, err
 	}
 
 	return BlockHeader{
-		hashPrevBlock: hashPrevBlock,
-		hashMerkleRoot: hashMerkleRoot,
-		Time: uint32(DecodeInt(timestampBytes)),
+		Version: version,
+		PrevBlock: prevBlock,
+		MerkleRoot: merkleRoot,
+		Time: decodeUint32(timestampBytes),
 		DifficultyTarget: difficulty,
-		Nonce: uint32(DecodeInt(nonceBytes)),
-	}, b
+		Nonce: decodeUint32(nonceBytes),
+	}, rest, nil
 }
 
+// checkHashes rejects the previous block hash or merkle root of a hand built header that is not 32 bytes
+func (bh BlockHeader) checkHashes() error {
+	if len(bh.PrevBlock) != 32 || len(bh.MerkleRoot) != 32 {
+		return ErrInvalidHeaderHash
+	}
+	return nil
+}
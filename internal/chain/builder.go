@@ -0,0 +1,179 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// SequenceFinal disables locktime and replace-by-fee for an input
+const SequenceFinal uint32 = 0xFFFFFFFF
+// SequenceRBF enables locktime and signals the transaction may be replaced (BIP125), the default for new inputs
+const SequenceRBF uint32 = 0xFFFFFFFD
+
+// ErrInputIndex when an input index is out of range
+var ErrInputIndex = errors.New("Input index out of range")
+// ErrInvalidOutpoint when a previous transaction id is not 32 bytes
+var ErrInvalidOutpoint = errors.New("Previous transaction id must be 32 bytes")
+// ErrUnsigned when building a transaction with inputs that do not verify
+var ErrUnsigned = errors.New("Transaction has unsigned or invalid inputs")
+// ErrEmptyTransaction when building a transaction without inputs or outputs
+var ErrEmptyTransaction = errors.New("Transaction needs at least one input and one output")
+
+// Builder assembles a transaction from outpoints and destinations, then signs its inputs
+type Builder struct {
+	tx Transaction
+	params *chainparams.Params
+}
+
+// NewBuilder starts an empty version 2 transaction on the given network
+func NewBuilder(params *chainparams.Params) *Builder {
+	return &Builder{
+		tx: Transaction{version: 2, txIn: make([]TransactionInput, 0), txOut: make([]TransactionOutput, 0)},
+		params: params,
+	}
+}
+
+// AddInput spends output index of prevTxID (internal byte order, as returned by ID), locked by prevScript and holding amount satoshis
+func (b *Builder) AddInput(prevTxID []byte, index uint32, prevScript []byte, amount uint64) (int, error) {
+	if len(prevTxID) != 32 {
+		return 0, ErrInvalidOutpoint
+	}
+	b.tx.txIn = append(b.tx.txIn, TransactionInput{
+		prevTransaction: append([]byte{}, prevTxID...),
+		prevIndex: int64(index),
+		prevTransactionPubKey: append([]byte{}, prevScript...),
+		prevAmount: amount,
+		scriptSig: []byte{},
+		sequence: SequenceRBF,
+	})
+	return len(b.tx.txIn) - 1, nil
+}
+
+// AddOutput pays amount satoshis to an address on the builder's network
+func (b *Builder) AddOutput(address string, amount uint64) error {
+	lock, err := script.PayToAddress(address, b.params)
+	if err != nil {
+		return err
+	}
+	b.AddOutputScript(lock.Encode(), amount)
+	return nil
+}
+
+// AddOutputScript pays amount satoshis to a locking script
+func (b *Builder) AddOutputScript(scriptPubKey []byte, amount uint64) {
+	b.tx.txOut = append(b.tx.txOut, TransactionOutput{amount: amount, scriptPubKey: append([]byte{}, scriptPubKey...)})
+}
+
+// SetLocktime sets the block height or timestamp before which the transaction cannot be mined
+func (b *Builder) SetLocktime(locktime int) {
+	b.tx.lock_time = NewLocktime(locktime)
+}
+
+// SetSequence sets the sequence number of input i
+func (b *Builder) SetSequence(i int, sequence uint32) error {
+	if i < 0 || i >= len(b.tx.txIn) {
+		return ErrInputIndex
+	}
+	b.tx.txIn[i].sequence = sequence
+	return nil
+}
+
+// NumInputs is the number of inputs added so far
+func (b *Builder) NumInputs() int {
+	return len(b.tx.txIn)
+}
+
+// PrevScript is the locking script spent by input i, nil if there is no such input
+func (b *Builder) PrevScript(i int) []byte {
+	if i < 0 || i >= len(b.tx.txIn) {
+		return nil
+	}
+	return b.tx.txIn[i].prevTransactionPubKey
+}
+
+// SignInput signs input i with the key behind its P2PKH, P2WPKH, P2SH-P2WPKH or taproot (key path) output, sign once every input and output is added
+func (b *Builder) SignInput(i int, secretKey *big.Int) error {
+	if i < 0 || i >= len(b.tx.txIn) {
+		return ErrInputIndex
+	}
+	return signInput(&b.tx, i, secretKey)
+}
+
+// Transaction returns the transaction as built so far
+func (b *Builder) Transaction() Transaction {
+	return b.tx
+}
+
+// Build checks every input is signed and serializes the transaction
+func (b *Builder) Build() ([]byte, error) {
+	if len(b.tx.txIn) == 0 || len(b.tx.txOut) == 0 {
+		return nil, ErrEmptyTransaction
+	}
+	for i := range b.tx.txIn {
+		if err := b.tx.VerifyInput(i); err != nil {
+			return nil, ErrUnsigned
+		}
+	}
+	return b.tx.Encode(-1), nil
+}
+
+// signInput fills in the scriptSig or witness of input i for the single key output it spends
+func signInput(tx *Transaction, i int, secretKey *big.Int) error {
+	in := &tx.txIn[i]
+	lock := in.prevTransactionPubKey
+	pk := cryptography.PublicKeyFromSecretKey(secretKey)
+	keyHash := pk.HashEncode()
+
+	version, program, isWitness := script.ParseWitnessProgram(lock)
+	switch {
+	case isWitness && version == 0 && len(program) == 20:
+		scriptCode := script.P2PKH(program).Encode()
+		sig := cryptography.SignMessage(secretKey, tx.WitnessV0SigHashPreimage(i, scriptCode))
+		in.scriptSig, in.witness = []byte{}, [][]byte{append(sig.Encode(), SigHashAll), pk.EncodeCompressed()}
+
+	case isWitness && version == 1 && len(program) == 32:
+		tweaked, err := cryptography.TaprootTweakSecretKey(secretKey, nil)
+		if err != nil {
+			return err
+		}
+		sig, err := cryptography.SchnorrSign(tweaked, tx.TaprootSigHash(i, SigHashDefault), nil)
+		if err != nil {
+			return err
+		}
+		in.scriptSig, in.witness = []byte{}, [][]byte{sig}
+
+	case script.IsP2SH(lock):
+		// Only P2SH wrapped P2WPKH, other redeem scripts need more than one key
+		redeem := script.WitnessProgram(0, keyHash).Encode()
+		if !bytes.Equal(lock, script.P2SH(cryptography.Hash160(redeem)).Encode()) {
+			return ErrWrongKey
+		}
+		sig := cryptography.SignMessage(secretKey, tx.WitnessV0SigHashPreimage(i, script.P2PKH(keyHash).Encode()))
+		scriptSig := script.NewScript()
+		scriptSig.AppendData(redeem)
+		in.scriptSig, in.witness = scriptSig.Encode(), [][]byte{append(sig.Encode(), SigHashAll), pk.EncodeCompressed()}
+
+	case !isWitness:
+		sig := cryptography.SignMessage(secretKey, tx.LegacySigHashPreimage(i, lock))
+		scriptSig := script.NewScript()
+		scriptSig.AppendData(append(sig.Encode(), SigHashAll))
+		scriptSig.AppendData(pk.EncodeCompressed())
+		in.scriptSig, in.witness = scriptSig.Encode(), nil
+
+	default:
+		return ErrUnsupportedScript
+	}
+
+	if err := tx.VerifyInput(i); err != nil {
+		in.scriptSig, in.witness = []byte{}, nil
+		if err == ErrUnsupportedScript {
+			return err
+		}
+		return ErrWrongKey
+	}
+	return nil
+}
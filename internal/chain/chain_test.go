@@ -4,19 +4,870 @@ import (
 	"fmt"
 	"testing"
 	"bytes"
+	"math"
 	"math/big"
 	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"time"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
 )
 
+// Coinbase of the mainnet genesis block
+// 4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b
+const genesisCoinbase = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+// BIP143 native P2WPKH example, a legacy input and a segwit input
+const segwitExample = "01000000000102fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f00000000494830450221008b9d1dc26ba6a9cb62127b02742fa9d754cd3bebf337f7a55d114c8e5cdd30be022040529b194ba3f9281a99f2b1c0a19c0489bc22ede944ccf4ecbab4cc618ef3ed01eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac000247304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e8f3358f51928d43c212a8caed02de67eebee0121025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee635711000000"
+
 func TestDecodeGenesis(t *testing.T) {
-	// Random tx
-	// ee475443f1fbfff84ffba43ba092a70d291df233bd1428f3d09f7bd1a6054a1f
+	tx := checkRoundTrip(genesisCoinbase, "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b", t)
+
+	if !tx.IsCoinbase() {
+		t.Errorf("Expected genesis transaction to be a coinbase")
+	}
+	if amount := tx.Outputs()[0].Amount(); amount != 5000000000 {
+		t.Errorf("Genesis coinbase pays %d, expected 5000000000", amount)
+	}
+}
+
+// TestTransactionRoundTrip checks real transactions decode and re-encode byte for byte
+func TestTransactionRoundTrip(t *testing.T) {
+	// Random tx, one input spending output 1, two outputs
 	txraw := "010000000110ee96aa946338cfd0b2ed0603259cfe2f5458c32ee4bd7b88b583769c6b046e010000006b483045022100e5e4749d539a163039769f52e1ebc8e6f62e39387d61e1a305bd722116cded6c022014924b745dd02194fe6b5cb8ac88ee8e9a2aede89e680dcea6169ea696e24d52012102b4b754609b46b5d09644c2161f1767b72b93847ce8154d795f95d31031a08aa2ffffffff028098f34c010000001976a914a134408afa258a50ed7a1d9817f26b63cc9002cc88ac8028bb13010000001976a914fec5b1145596b35f59f8be1daf169f375942143388ac00000000"
-	transactionBytes, _ := hex.DecodeString(txraw)
+	tx := checkRoundTrip(txraw, "ee475443f1fbfff84ffba43ba092a70d291df233bd1428f3d09f7bd1a6054a1f", t)
+
+	prevTxID, prevIndex := tx.Inputs()[0].PrevOutpoint()
+	if HashString(prevTxID) != "6e046b9c7683b5887bbde42ec358542ffe9c250306edb2d0cf386394aa96ee10" || prevIndex != 1 {
+		t.Errorf("Decoded outpoint %s:%d", HashString(prevTxID), prevIndex)
+	}
+	if len(tx.Outputs()) != 2 || tx.Outputs()[0].Amount() != 5586000000 || tx.Outputs()[1].Amount() != 4626000000 {
+		t.Errorf("Decoded outputs %v", tx.Outputs())
+	}
+
+	tx = checkRoundTrip(segwitExample, "", t)
+	if !tx.HasWitness() || len(tx.Inputs()[0].witness) != 0 || len(tx.Inputs()[1].witness) != 2 {
+		t.Errorf("Witness not decoded")
+	}
+	if tx.lock_time.t != 17 || tx.Inputs()[0].sequence != 0xffffffee {
+		t.Errorf("Decoded locktime %d and sequence %x", tx.lock_time.t, tx.Inputs()[0].sequence)
+	}
+}
+
+func checkRoundTrip(txraw string, txid string, t *testing.T) Transaction {
+	raw, _ := hex.DecodeString(txraw)
+	tx, rest, err := DecodeNextTransaction(raw)
+	if err != nil {
+		t.Fatalf("Failed to decode (%v)", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left after decoding", len(rest))
+	}
+	if enc := hex.EncodeToString(tx.Encode(-1)); enc != txraw {
+		t.Errorf("Re-encoded transaction differs\n%s\n%s", txraw, enc)
+	}
+	if txid != "" && HashString(tx.ID()) != txid {
+		t.Errorf("Transaction id %s, expected %s", HashString(tx.ID()), txid)
+	}
+	return tx
+}
+
+// TestSerialize checks streaming serialization matches Encode and its decoders
+func TestSerialize(t *testing.T) {
+	block := testBlock(t, 3)
+	for _, tx := range block.Transactions() {
+		var buf bytes.Buffer
+		if err := tx.Serialize(&buf); err != nil || !bytes.Equal(buf.Bytes(), tx.Encode(-1)) {
+			t.Errorf("Serialize differs from Encode (%v)", err)
+		}
+		if tx.SerializeSize() != buf.Len() {
+			t.Errorf("SerializeSize %d, serialized %d bytes", tx.SerializeSize(), buf.Len())
+		}
+
+		var decoded Transaction
+		if err := decoded.Deserialize(&buf); err != nil || !bytes.Equal(decoded.Encode(-1), tx.Encode(-1)) || !bytes.Equal(decoded.ID(), tx.ID()) {
+			t.Errorf("Transaction did not round trip (%v)", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := block.Serialize(&buf); err != nil || !bytes.Equal(buf.Bytes(), block.Encode(chainparams.MainNet())[8:]) {
+		t.Fatalf("Block serialization differs from Encode (%v)", err)
+	}
+	if block.SerializeSize() != buf.Len() {
+		t.Errorf("Block SerializeSize %d, serialized %d bytes", block.SerializeSize(), buf.Len())
+	}
+	raw := buf.Bytes()
+	var decoded Block
+	if err := decoded.Deserialize(bytes.NewReader(raw)); err != nil || len(decoded.Transactions()) != 4 {
+		t.Fatalf("Block did not deserialize (%v)", err)
+	}
+	var again bytes.Buffer
+	decoded.Serialize(&again)
+	if !bytes.Equal(again.Bytes(), raw) {
+		t.Errorf("Block did not round trip")
+	}
+
+	// A stream of headers ends cleanly, a cut off one does not
+	var header BlockHeader
+	r := bytes.NewReader(append(block.Header.Encode(), block.Header.Encode()...))
+	for i := 0; i < 2; i++ {
+		if err := header.Deserialize(r); err != nil || header.Nonce != block.Header.Nonce {
+			t.Errorf("Header %d did not deserialize (%v)", i, err)
+		}
+	}
+	if err := header.Deserialize(r); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+	for _, cut := range []int{1, 50, len(raw) - 1} {
+		if err := decoded.Deserialize(bytes.NewReader(raw[:cut])); err != ErrUnexpectedEnd {
+			t.Errorf("Expected block cut to %d bytes to be rejected, got %v", cut, err)
+		}
+	}
+}
+
+// testBlock is the genesis header with its coinbase followed by copies of the BIP143 segwit transaction
+func testBlock(t testing.TB, copies int) Block {
+	header, _ := hex.DecodeString("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c")
+	bh, _, err := DecodeNextBlockHeader(header)
+	if err != nil {
+		t.Fatalf("Failed to decode header (%v)", err)
+	}
+	raw, _ := hex.DecodeString(genesisCoinbase)
+	coinbase, _, _ := DecodeNextTransaction(raw)
+	raw, _ = hex.DecodeString(segwitExample)
+	segwit, _, _ := DecodeNextTransaction(raw)
+
+	txs := []Transaction{coinbase}
+	for i := 0; i < copies; i++ {
+		txs = append(txs, segwit)
+	}
+	return NewBlock(&bh, txs)
+}
+
+func BenchmarkTransactionEncode(b *testing.B) {
+	tx := testBlock(b, 1).Transactions()[1]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tx.Encode(-1)
+	}
+}
+
+func BenchmarkTransactionSerialize(b *testing.B) {
+	tx := testBlock(b, 1).Transactions()[1]
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		tx.Serialize(&buf)
+	}
+}
+
+func BenchmarkBlockEncode(b *testing.B) {
+	block := testBlock(b, 2000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block.Encode(chainparams.MainNet())
+	}
+}
+
+func BenchmarkBlockSerialize(b *testing.B) {
+	block := testBlock(b, 2000)
+	var buf bytes.Buffer
+	buf.Grow(block.SerializeSize())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		block.Serialize(&buf)
+	}
+}
+
+func BenchmarkBlockDeserialize(b *testing.B) {
+	block := testBlock(b, 2000)
+	var buf bytes.Buffer
+	block.Serialize(&buf)
+	raw := buf.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var decoded Block
+		decoded.Deserialize(bytes.NewReader(raw))
+	}
+}
+
+// TestMerkleRoot checks roots against mainnet blocks and detects duplicated transactions
+func TestMerkleRoot(t *testing.T) {
+	// Block 100000
+	ids := make([][]byte, 0)
+	for _, id := range []string{
+		"8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87",
+		"fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4",
+		"6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4",
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	} {
+		b, _ := ParseHash(id)
+		ids = append(ids, b)
+	}
+	root, mutated := MerkleRoot(ids)
+	if HashString(root) != "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766" || mutated {
+		t.Errorf("Merkle root %s (mutated %v)", HashString(root), mutated)
+	}
+
+	// Repeating the odd last transaction gives the same root, but is detected
+	odd, _ := MerkleRoot(ids[:3])
+	repeated, mutated := MerkleRoot(append(ids[:3:3], ids[2]))
+	if !bytes.Equal(odd, repeated) || !mutated {
+		t.Errorf("Expected duplicated transaction to give the same root and be flagged")
+	}
+	if single, _ := MerkleRoot(ids[:1]); !bytes.Equal(single, ids[0]) {
+		t.Errorf("Root of one transaction should be its id")
+	}
+
+	genesis := testBlock(t, 0)
+	if err := genesis.Validate(); err != nil {
+		t.Errorf("Genesis block failed validation (%v)", err)
+	}
+	duplicated := NewBlock(genesis.Header, append(genesis.Transactions(), genesis.Transactions()[0]))
+	if err := duplicated.CheckMerkleRoot(); err != ErrBadMerkleRoot {
+		t.Errorf("Expected extra transaction to change the root, got %v", err)
+	}
+}
+
+// TestWitnessCommitment checks a coinbase commitment to the witness merkle root
+func TestWitnessCommitment(t *testing.T) {
+	block := testBlock(t, 1)
+	coinbase := block.txs[0]
+	if err := block.CheckWitnessCommitment(); err != ErrBadWitnessCommitment {
+		t.Errorf("Expected missing commitment to be rejected, got %v", err)
+	}
+
+	reserved := make([]byte, 32)
+	commitment := cryptography.Hash256(append(block.WitnessMerkleRoot(), reserved...))
+	coinbase.txIn = []TransactionInput{coinbase.txIn[0]}
+	coinbase.txIn[0].witness = [][]byte{reserved}
+	coinbase.txOut = append(append([]TransactionOutput{}, coinbase.txOut...), TransactionOutput{scriptPubKey: append(append([]byte{}, witnessCommitmentHeader...), commitment...)})
+
+	txs := []Transaction{coinbase, block.txs[1]}
+	root, _ := MerkleRoot([][]byte{coinbase.ID(), block.txs[1].ID()})
+	header := *block.Header
+	header.MerkleRoot = root
+	committed := NewBlock(&header, txs)
+	if err := committed.Validate(); err != nil {
+		t.Errorf("Committed block failed validation (%v)", err)
+	}
+	if !bytes.Equal(committed.WitnessCommitment(), commitment) {
+		t.Errorf("Commitment not found in coinbase")
+	}
+
+	// Changing a witness leaves the txids, and so the header, valid but breaks the commitment
+	spend := block.txs[1]
+	spend.txIn = append([]TransactionInput{}, spend.txIn...)
+	spend.txIn[1].witness = [][]byte{{0x01}}
+	tampered := NewBlock(&header, []Transaction{coinbase, spend})
+	if err := tampered.CheckMerkleRoot(); err != nil {
+		t.Errorf("Witness change should not affect the merkle root (%v)", err)
+	}
+	if err := tampered.CheckWitnessCommitment(); err != ErrBadWitnessCommitment {
+		t.Errorf("Expected tampered witness to be rejected, got %v", err)
+	}
+
+	// A commitment outside a coinbase is an error, even with no inputs to hold the reserved value
+	noInputs := coinbase
+	noInputs.txIn = nil
+	if err := NewBlock(&header, []Transaction{noInputs, block.txs[1]}).CheckWitnessCommitment(); err != ErrNoCoinbase {
+		t.Errorf("Expected missing coinbase to be rejected, got %v", err)
+	}
+}
+
+// TestMerkleProof checks partial merkle trees and branches for every selection of transactions in small blocks
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		block := distinctBlock(t, n)
+		ids := make([][]byte, n)
+		for i, tx := range block.Transactions() {
+			ids[i] = tx.ID()
+		}
+
+		for mask := 0; mask < 1 << uint(n); mask++ {
+			txids := make([][]byte, 0)
+			for i := range ids {
+				if mask & (1 << uint(i)) != 0 {
+					txids = append(txids, ids[i])
+				}
+			}
+			proof, err := BuildMerkleProof(block, txids)
+			if err != nil {
+				t.Fatalf("Failed to build proof (%v)", err)
+			}
+			decoded, rest, err := DecodeNextMerkleProof(proof.Encode())
+			if err != nil || len(rest) != 0 {
+				t.Fatalf("Proof did not decode (%v)", err)
+			}
+			matched, err := VerifyMerkleProof(block.Header, decoded)
+			if err != nil || len(matched) != len(txids) {
+				t.Fatalf("Proof of %d of %d transactions did not verify (%v)", len(txids), n, err)
+			}
+			for i := range matched {
+				if !bytes.Equal(matched[i], txids[i]) {
+					t.Errorf("Matched %s, expected %s", HashString(matched[i]), HashString(txids[i]))
+				}
+			}
+		}
+
+		for i, id := range ids {
+			branch, err := BuildMerkleBranch(block, id)
+			if err != nil || branch.Index != uint32(i) || branch.Transactions != uint32(n) {
+				t.Fatalf("Failed to build branch (%v)", err)
+			}
+			decoded, _, err := DecodeNextMerkleBranch(branch.Encode())
+			if err != nil || VerifyMerkleBranch(block.Header, decoded) != nil {
+				t.Errorf("Branch for transaction %d of %d did not verify (%v)", i, n, err)
+			}
+			// The last of an odd count pairs with itself, but the duplicate's position is past the count
+			decoded.Index ^= 1
+			if VerifyMerkleBranch(block.Header, decoded) == nil {
+				t.Errorf("Branch verified at the wrong position")
+			}
+		}
+	}
+
+	block := distinctBlock(t, 5)
+	target := block.Transactions()[3].ID()
+	proof, _ := BuildMerkleProof(block, [][]byte{target})
+	if _, err := BuildMerkleProof(block, [][]byte{make([]byte, 32)}); err != ErrTransactionNotFound {
+		t.Errorf("Expected unknown transaction to be rejected, got %v", err)
+	}
+
+	tampered := proof
+	tampered.Hashes = append([][]byte{}, proof.Hashes...)
+	tampered.Hashes[1] = make([]byte, 32)
+	if _, err := VerifyMerkleProof(block.Header, tampered); err != ErrInvalidMerkleProof {
+		t.Errorf("Expected tampered hash to be rejected, got %v", err)
+	}
+	extra := proof
+	extra.Flags = append(append([]byte{}, proof.Flags...), 0x00)
+	if _, err := VerifyMerkleProof(block.Header, extra); err != ErrInvalidMerkleProof {
+		t.Errorf("Expected unused flag bytes to be rejected, got %v", err)
+	}
+	other := distinctBlock(t, 6)
+	if _, err := VerifyMerkleProof(other.Header, proof); err != ErrInvalidMerkleProof {
+		t.Errorf("Expected proof against another block to be rejected, got %v", err)
+	}
+
+	// Duplicating the last transaction of an odd level proves the same root, which must be rejected
+	three := distinctBlock(t, 3)
+	mutated := NewBlock(three.Header, append(three.Transactions(), three.Transactions()[2]))
+	all := make([][]byte, 0)
+	for _, tx := range mutated.Transactions() {
+		all = append(all, tx.ID())
+	}
+	proof, _ = BuildMerkleProof(mutated, all)
+	if _, err := VerifyMerkleProof(three.Header, proof); err != ErrInvalidMerkleProof {
+		t.Errorf("Expected duplicated transaction proof to be rejected, got %v", err)
+	}
+
+	// A branch one level short passes an inner node off as a txid, though it leads to the root
+	four := distinctBlock(t, 4)
+	branch, _ := BuildMerkleBranch(four, four.Transactions()[0].ID())
+	short := MerkleBranch{TxID: hashPair(branch.TxID, branch.Branch[0]), Index: 0, Transactions: 4, Branch: branch.Branch[1:]}
+	if !bytes.Equal(short.Root(), four.Header.MerkleRoot) || VerifyMerkleBranch(four.Header, short) != ErrInvalidMerkleProof {
+		t.Errorf("Expected a branch from an inner node to be rejected")
+	}
+}
+
+// distinctBlock has a coinbase and n-1 copies of the segwit example with different locktimes, under a header committing to them
+func distinctBlock(t *testing.T, n int) Block {
+	block := testBlock(t, n-1)
+	txs := block.Transactions()
+	for i := 1; i < n; i++ {
+		txs[i].lock_time = NewLocktime(i)
+	}
+	header := *block.Header
+	block = NewBlock(&header, txs)
+	header.MerkleRoot, _ = block.MerkleRoot()
+	return block
+}
+
+// TestGenesis checks the genesis block of each network hashes to its known value
+func TestGenesis(t *testing.T) {
+	for _, params := range []*chainparams.Params{chainparams.MainNet(), chainparams.TestNet(), chainparams.SigNet(), chainparams.RegTest()} {
+		block := Genesis(params)
+		if hash := HashString(block.Header.BlockHash()); hash != params.GenesisHash {
+			t.Errorf("%s genesis hash %s, expected %s", params.Name, hash, params.GenesisHash)
+		}
+		if root := HashString(block.Header.MerkleRoot); root != params.GenesisMerkleRoot {
+			t.Errorf("%s genesis merkle root %s", params.Name, root)
+		}
+		if err := block.Validate(); err != nil {
+			t.Errorf("%s genesis failed validation (%v)", params.Name, err)
+		}
+		if !block.Header.DifficultyTarget.IsSolution(block.Header.BlockHash()) {
+			t.Errorf("%s genesis does not meet its difficulty", params.Name)
+		}
+	}
+
+	// Byte for byte the mainnet genesis block
+	var buf bytes.Buffer
+	Genesis(chainparams.MainNet()).Serialize(&buf)
+	expected := "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c01" + genesisCoinbase
+	if hex.EncodeToString(buf.Bytes()) != expected {
+		t.Errorf("Mainnet genesis serialized as %x", buf.Bytes())
+	}
+}
+
+// TestNewGenesisBlock mines a private network genesis block
+func TestNewGenesisBlock(t *testing.T) {
+	lock := script.P2PKH(make([]byte, 20)).Encode()
+	block, err := NewGenesisBlock("Private network", 1700000000, 0x207fffff, 1000, lock)
+	if err != nil {
+		t.Fatalf("Failed to create genesis block (%v)", err)
+	}
+	if !block.Header.DifficultyTarget.IsSolution(block.Header.BlockHash()) || block.Validate() != nil {
+		t.Errorf("Genesis block not mined or invalid")
+	}
+	coinbase := block.Transactions()[0]
+	if !bytes.Contains(coinbase.Inputs()[0].scriptSig, []byte("Private network")) || coinbase.Outputs()[0].Amount() != 1000 || !bytes.Equal(coinbase.Outputs()[0].ScriptPubKey(), lock) {
+		t.Errorf("Genesis coinbase does not carry the message and payout")
+	}
+	if block.Header.Time != 1700000000 || !bytes.Equal(block.Header.DifficultyTarget.Encode(), []byte{0x20, 0x7f, 0xff, 0xff}) {
+		t.Errorf("Genesis header time %d and bits %x", block.Header.Time, block.Header.DifficultyTarget.Encode())
+	}
+
+	// The original message and key reproduce the regtest genesis, bar the nonce Core happened to pick
+	params := chainparams.RegTest()
+	regtest, err := NewGenesisBlock(GenesisMessage, params.GenesisTime, params.GenesisBits, GenesisReward, nil)
+	if err != nil || HashString(regtest.Header.MerkleRoot) != params.GenesisMerkleRoot {
+		t.Fatalf("Expected the regtest genesis coinbase (%v)", err)
+	}
+	if header := regtest.Header.IncrementNonce().IncrementNonce(); regtest.Header.Nonce != 0 || HashString(header.BlockHash()) != params.GenesisHash {
+		t.Errorf("Expected the regtest genesis header at nonce 2")
+	}
+	if _, err := NewGenesisBlock("", 0, 0x04000000, 0, nil); err != ErrZeroTarget {
+		t.Errorf("Expected an impossible difficulty to fail")
+	}
+}
+
+// TestBlockHeader builds mainnet block 100000's header from its displayed fields
+func TestBlockHeader(t *testing.T) {
+	bh, err := NewBlockHeaderHex(1,
+		"000000000002d01c1fccc21636b607dfd930d31d01c3a62104612a1719011250",
+		"f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766",
+		1293623863, 0x1b04864c, 274148111)
+	if err != nil {
+		t.Fatalf("Failed to create header (%v)", err)
+	}
+	if hash := bh.HashString(); hash != "000000000003ba27aa200b1cecaad478d2b00432346c3f1f3986da1afd33e506" {
+		t.Errorf("Block hash %s", hash)
+	}
+	if !bh.DifficultyTarget.IsSolution(bh.BlockHash()) || bh.Bits() != 0x1b04864c {
+		t.Errorf("Header does not meet its difficulty %x", bh.Bits())
+	}
+
+	decoded, rest, err := DecodeNextBlockHeader(bh.Encode())
+	if err != nil || len(rest) != 0 || decoded.Version != 1 || decoded.PrevBlockString() != "000000000002d01c1fccc21636b607dfd930d31d01c3a62104612a1719011250" || decoded.MerkleRootString() != "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766" {
+		t.Errorf("Header did not round trip (%v)", err)
+	}
+	if _, err := NewBlockHeader(1, make([]byte, 31), make([]byte, 32), 0, 0x1d00ffff, 0); err != ErrInvalidHeaderHash {
+		t.Errorf("Expected short previous hash to be rejected, got %v", err)
+	}
+
+	// BIP9 signalling, segwit used bit 1
+	version, err := VersionWithBits(1, 28)
+	if err != nil || version != 0x30000002 {
+		t.Errorf("Version %x (%v)", version, err)
+	}
+	bh.Version = version
+	if !bh.UsesVersionBits() || !bh.SignalsBit(1) || !bh.SignalsBit(28) || bh.SignalsBit(0) {
+		t.Errorf("Version bits of %x misread", version)
+	}
+	bh.Version = 0x00000002
+	if bh.UsesVersionBits() || bh.SignalsBit(1) {
+		t.Errorf("Version 2 is not a BIP9 version")
+	}
+	if _, err := VersionWithBits(29); err != ErrInvalidVersionBit {
+		t.Errorf("Expected bit 29 to be rejected, got %v", err)
+	}
+
+	// Hand built headers with hashes of the wrong length are not padded into a plausible header
+	short := BlockHeader{Version: 1, PrevBlock: []byte{0x01}, MerkleRoot: make([]byte, 32), DifficultyTarget: bh.DifficultyTarget}
+	if enc := short.Encode(); len(enc) == BlockHeaderSize {
+		t.Errorf("Short hash padded to %x", enc)
+	}
+	for _, header := range []BlockHeader{{}, short} {
+		if err := header.Serialize(ioutil.Discard); err != ErrInvalidHeaderHash {
+			t.Errorf("Expected hashes %x and %x to be rejected, got %v", header.PrevBlock, header.MerkleRoot, err)
+		}
+	}
+	if err := NewBlock(&short, nil).Serialize(ioutil.Discard); err != ErrInvalidHeaderHash {
+		t.Errorf("Expected block with a short hash to be rejected, got %v", err)
+	}
+	if (BlockHeader{}).DifficultyTarget.IsSolution(make([]byte, 32)) {
+		t.Errorf("Zero value difficulty accepted a hash")
+	}
+}
+
+// TestRetarget checks the retarget arithmetic against Bitcoin Core's test vectors
+func TestRetarget(t *testing.T) {
+	params := chainparams.MainNet()
+	cases := []struct {
+		firstTime, lastTime, bits, expected uint32
+	}{
+		{1261130161, 1262152739, 0x1d00ffff, 0x1d00d86a}, // Block 32256, the first change
+		{1231006505, 1233061996, 0x1d00ffff, 0x1d00ffff}, // Clamped to the proof of work limit
+		{1279008237, 1279297671, 0x1c05a3f4, 0x1c0168fd}, // Period 4 times too fast
+		{1263163443, 1269211443, 0x1c387f6f, 0x1d00e1fd}, // Period 4 times too slow
+	}
+	for _, c := range cases {
+		last, _ := DifficultyFromBits(c.bits)
+		if bits := retarget(last, c.firstTime, c.lastTime, params).Bits(); bits != c.expected {
+			t.Errorf("Retarget from %x gave %x, expected %x", c.bits, bits, c.expected)
+		}
+	}
+}
+
+// TestNextWorkRequired checks when each network retargets, and testnet's minimum difficulty blocks
+func TestNextWorkRequired(t *testing.T) {
+	chainOf := func(params *chainparams.Params, n int, bits uint32, spacing uint32) []*BlockHeader {
+		headers := make([]*BlockHeader, n)
+		for i := range headers {
+			headers[i], _ = NewBlockHeader(1, make([]byte, 32), make([]byte, 32), params.GenesisTime + uint32(i) * spacing, bits, 0)
+		}
+		return headers
+	}
+	bitsOf := func(headers []*BlockHeader, blockTime uint32, params *chainparams.Params) uint32 {
+		diff, err := NextWorkRequired(headers, blockTime, params)
+		if err != nil {
+			t.Fatalf("Failed to compute next work (%v)", err)
+		}
+		return diff.Bits()
+	}
+
+	// Mainnet keeps the difficulty within a period and retargets at its end, here twice as fast as intended
+	mainnet := chainparams.MainNet()
+	headers := chainOf(mainnet, 2016, 0x1c05a3f4, 300)
+	if bits := bitsOf(headers[:2000], 0, mainnet); bits != 0x1c05a3f4 {
+		t.Errorf("Difficulty changed mid period to %x", bits)
+	}
+	if bits := bitsOf(headers, 0, mainnet); bits != retarget(headers[0].DifficultyTarget, headers[0].Time, headers[2015].Time, mainnet).Bits() || bits == 0x1c05a3f4 {
+		t.Errorf("Retarget gave %x", bits)
+	}
+	if bits := bitsOf(nil, 0, mainnet); bits != mainnet.PowLimitBits {
+		t.Errorf("Genesis difficulty %x", bits)
+	}
+
+	// Testnet allows a minimum difficulty block 20 minutes after the tip, then returns to the last real difficulty
+	testnet := chainparams.TestNet()
+	headers = chainOf(testnet, 100, 0x1c05a3f4, 600)
+	tip := headers[99].Time
+	if bits := bitsOf(headers, tip + 20 * 60 + 1, testnet); bits != testnet.PowLimitBits {
+		t.Errorf("Expected minimum difficulty after 20 minutes, got %x", bits)
+	}
+	if bits := bitsOf(headers, tip + 20 * 60, testnet); bits != 0x1c05a3f4 {
+		t.Errorf("Expected normal difficulty within 20 minutes, got %x", bits)
+	}
+	minimum, _ := NewBlockHeader(1, make([]byte, 32), make([]byte, 32), tip + 1300, testnet.PowLimitBits, 0)
+	headers = append(headers, minimum, minimum)
+	if bits := bitsOf(headers, minimum.Time + 60, testnet); bits != 0x1c05a3f4 {
+		t.Errorf("Expected the difficulty before the minimum difficulty blocks, got %x", bits)
+	}
+
+	// Regtest never retargets
+	regtest := chainparams.RegTest()
+	headers = chainOf(regtest, 2016, regtest.PowLimitBits, 1)
+	if bits := bitsOf(headers, headers[2015].Time + 1, regtest); bits != regtest.PowLimitBits {
+		t.Errorf("Regtest retargeted to %x", bits)
+	}
+
+	if _, err := nextWorkRequired(2015, func(int32) *BlockHeader { return nil }, 0, mainnet); err != ErrMissingHeader {
+		t.Errorf("Expected missing headers to be reported, got %v", err)
+	}
+}
+
+// TestDifficultyImmutable checks arithmetic returns new difficulties
+func TestDifficultyImmutable(t *testing.T) {
+	diff, _ := DifficultyFromBits(0x1d00ffff)
+	halved, _ := diff.Div(big.NewInt(2))
+	doubled, _ := diff.Mul(big.NewInt(2))
+	if diff.Bits() != 0x1d00ffff || halved.Bits() != 0x1c7fff80 || doubled.Bits() != 0x1d01fffe {
+		t.Errorf("Difficulty arithmetic gave %x, %x from %x", halved.Bits(), doubled.Bits(), diff.Bits())
+	}
+	target := diff.Target()
+	target.SetInt64(1)
+	if diff.Bits() != 0x1d00ffff {
+		t.Errorf("Target exposed the difficulty's internal state")
+	}
+
+	// Encoding rounds to three significant bytes and keeps the sign bit clear
+	for target, bits := range map[int64]uint32{0x80: 0x02008000, 0x12345678: 0x04123456, 0x123456: 0x03123456, 0x1234: 0x02123400} {
+		if diff, _ := NewDifficulty(big.NewInt(target)); diff.Bits() != bits {
+			t.Errorf("Target %x encoded as %x, expected %x", target, diff.Bits(), bits)
+		}
+	}
+
+	// Targets outside 1 to 2^256-1 are rejected rather than truncated
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	if _, err := NewDifficulty(max); err != nil {
+		t.Errorf("Largest target rejected (%v)", err)
+	}
+	for _, c := range []struct {
+		target *big.Int
+		expected error
+	}{{new(big.Int).Add(max, big.NewInt(1)), ErrDifficultyOverflow}, {big.NewInt(-1), ErrDifficultyNegative}, {big.NewInt(0), ErrZeroTarget}} {
+		if _, err := NewDifficulty(c.target); err != c.expected {
+			t.Errorf("Target %x gave %v, expected %v", c.target, err, c.expected)
+		}
+	}
+	if _, err := diff.Mul(max); err != ErrDifficultyOverflow {
+		t.Errorf("Expected an overflowing product to be rejected, got %v", err)
+	}
+	if _, err := diff.Div(max); err != ErrZeroTarget {
+		t.Errorf("Expected a zero quotient to be rejected, got %v", err)
+	}
+	if _, err := diff.Div(big.NewInt(0)); err != ErrDivideByZero {
+		t.Errorf("Expected division by zero to be rejected, got %v", err)
+	}
+}
+
+// TestDecodeCompact checks compact difficulties decode like Bitcoin Core's SetCompact and encode like GetCompact
+func TestDecodeCompact(t *testing.T) {
+	cases := []struct {
+		bits uint32
+		target int64
+		encoded uint32
+	}{
+		{0x00000000, 0, 0x00000000},
+		{0x00123456, 0, 0x00000000},
+		{0x01003456, 0, 0x00000000},
+		{0x02000056, 0, 0x00000000},
+		{0x04000000, 0, 0x00000000},
+		{0x00923456, 0, 0x00000000}, // Sign bit shifted out with the mantissa
+		{0x01803456, 0, 0x00000000},
+		{0x04800000, 0, 0x00000000},
+		{0x01123456, 0x12, 0x01120000},
+		{0x02123456, 0x1234, 0x02123400},
+		{0x03123456, 0x123456, 0x03123456},
+		{0x04123456, 0x12345600, 0x04123456},
+		{0x05009234, 0x92340000, 0x05009234},
+	}
+	for _, c := range cases {
+		diff, err := DifficultyFromBits(c.bits)
+		if err != nil || diff.Target().Int64() != c.target || diff.Bits() != c.encoded {
+			t.Errorf("Compact %08x gave %x encoded %08x (%v)", c.bits, diff.target, diff.Bits(), err)
+		}
+	}
+
+	large, err := DifficultyFromBits(0x20123456)
+	if err != nil || large.Bits() != 0x20123456 || large.Target().BitLen() != 253 {
+		t.Errorf("Compact 20123456 decoded wrong (%v)", err)
+	}
+	for bits, expected := range map[uint32]error{0x01fedcba: ErrDifficultyNegative, 0x04923456: ErrDifficultyNegative, 0xff123456: ErrDifficultyOverflow, 0x22010000: ErrDifficultyOverflow, 0x21010000: ErrDifficultyOverflow, 0x21000100: nil} {
+		if _, err := DifficultyFromBits(bits); err != expected {
+			t.Errorf("Compact %08x gave %v, expected %v", bits, err, expected)
+		}
+	}
+}
+
+// TestChainWork checks work and the getdifficulty figure against known blocks
+func TestChainWork(t *testing.T) {
+	genesis, _ := DifficultyFromBits(0x1d00ffff)
+	if work := genesis.Work(); work.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Errorf("Genesis work %x", work)
+	}
+	headers := []*BlockHeader{Genesis(chainparams.MainNet()).Header, Genesis(chainparams.MainNet()).Header}
+	if work := ChainWork(headers); work.Cmp(big.NewInt(0x200020002)) != 0 {
+		t.Errorf("Chain work %x", work)
+	}
+
+	// Figures match getdifficulty, which measures against mainnet's limit on every network
+	cases := []struct {
+		bits uint32
+		expected float64
+	}{
+		{0x1d00ffff, 1},
+		{0x1b04864c, 14484.1623612254},
+		{0x1c05a3f4, 45.38582234101263},
+		{chainparams.SigNet().PowLimitBits, 0.001126515290698186},
+		{chainparams.RegTest().PowLimitBits, 4.6565423739069247e-10},
+	}
+	for _, c := range cases {
+		diff, _ := DifficultyFromBits(c.bits)
+		if f := diff.Float(); math.Abs(f - c.expected) > c.expected * 1e-12 {
+			t.Errorf("Difficulty of %08x was %v, expected %v", c.bits, f, c.expected)
+		}
+	}
+}
+
+// TestHeaderTree builds forks on regtest and checks the best chain follows the most work
+func TestHeaderTree(t *testing.T) {
+	params := chainparams.RegTest()
+	tree := NewHeaderTree(params)
+	now := time.Unix(int64(params.GenesisTime), 0).Add(24 * time.Hour)
+	mine := func(parent *HeaderNode, bits uint32, spacing uint32) *BlockHeader {
+		root := cryptography.Hash256([]byte{byte(tree.Len()), byte(spacing)})
+		header, _ := NewBlockHeader(1, parent.Hash, root, parent.Header.Time + spacing, bits, 0)
+		for !header.DifficultyTarget.IsSolution(header.BlockHash()) {
+			header.Nonce++
+		}
+		return header
+	}
+	extend := func(parent *HeaderNode, n int) *HeaderNode {
+		for i := 0; i < n; i++ {
+			node, err := tree.addHeader(mine(parent, params.PowLimitBits, 600), now)
+			if err != nil {
+				t.Fatalf("Failed to add header (%v)", err)
+			}
+			parent = node
+		}
+		return parent
+	}
+
+	first := extend(tree.Genesis(), 12)
+	if tree.Best() != first || first.Height != 12 || first.ChainWork.Cmp(new(big.Int).Mul(tree.Genesis().ChainWork, big.NewInt(13))) != 0 {
+		t.Errorf("Best tip at height %d with work %x", tree.Best().Height, tree.Best().ChainWork)
+	}
+	if tree.Lookup(first.Hash) != first || first.Ancestor(5).Height != 5 || first.Ancestor(13) != nil {
+		t.Errorf("Lookup or ancestor failed")
+	}
 
-	tx, _ := DecodeNextTransaction(transactionBytes)
+	// An equal fork keeps the first tip, a longer one takes over
+	fork := first.Ancestor(5)
+	second := extend(fork, 7)
+	if tree.Best() != first || len(tree.Tips()) != 2 {
+		t.Errorf("Equal work fork became the best tip")
+	}
+	second = extend(second, 1)
+	if tree.Best() != second || CommonAncestor(first, second) != fork || CommonAncestor(second, fork) != fork {
+		t.Errorf("Longer fork did not become the best tip")
+	}
+	disconnect, connect := ReorgPath(first, second)
+	if len(disconnect) != 7 || disconnect[0] != first || len(connect) != 8 || connect[0].Parent() != fork || connect[7] != second {
+		t.Errorf("Reorg disconnects %d and connects %d", len(disconnect), len(connect))
+	}
+	if tips := tree.Tips(); len(tips) != 2 || tips[0] != second || tips[1] != first {
+		t.Errorf("Tips not the ends of both forks")
+	}
 
-	fmt.Println(tx)
+	// Headers breaking the rules are rejected and leave the tree as it was
+	size := tree.Len()
+	if _, err := tree.addHeader(second.Header, now); err != ErrDuplicateHeader {
+		t.Errorf("Expected duplicate, got %v", err)
+	}
+	truncated := *mine(second, params.PowLimitBits, 600)
+	truncated.MerkleRoot = truncated.MerkleRoot[:31]
+	if _, err := tree.AddHeader(&truncated); err != ErrInvalidHeaderHash {
+		t.Errorf("Expected short merkle root, got %v", err)
+	}
+	orphan := mine(second, params.PowLimitBits, 600)
+	orphan.PrevBlock = make([]byte, 32)
+	if _, err := tree.addHeader(orphan, now); err != ErrOrphanHeader {
+		t.Errorf("Expected orphan, got %v", err)
+	}
+	if _, err := tree.addHeader(mine(second, 0x2000ffff, 600), now); err != ErrBadDifficulty {
+		t.Errorf("Expected bad difficulty, got %v", err)
+	}
+	unsolved := mine(second, params.PowLimitBits, 600)
+	for unsolved.DifficultyTarget.IsSolution(unsolved.BlockHash()) {
+		unsolved.Nonce++
+	}
+	if _, err := tree.addHeader(unsolved, now); err != ErrHighHash {
+		t.Errorf("Expected high hash, got %v", err)
+	}
+	old := mine(second, params.PowLimitBits, second.MedianTimePast() - second.Header.Time)
+	if _, err := tree.addHeader(old, now); err != ErrTimeTooOld {
+		t.Errorf("Expected time too old, got %v", err)
+	}
+	if _, err := tree.addHeader(mine(second, params.PowLimitBits, 600), time.Unix(int64(second.Header.Time), 0).Add(-MaxFutureBlockTime)); err != ErrTimeTooNew {
+		t.Errorf("Expected time too new, got %v", err)
+	}
+	if tree.Len() != size || tree.Best() != second {
+		t.Errorf("Rejected headers changed the tree")
+	}
+
+	// Mainnet block 1 connects to genesis
+	mainnet := NewHeaderTree(chainparams.MainNet())
+	block1, _ := NewBlockHeaderHex(1, chainparams.MainNet().GenesisHash, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098", 1231469665, 0x1d00ffff, 2573394689)
+	node, err := mainnet.AddHeader(block1)
+	if err != nil || node.Header.HashString() != "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048" || mainnet.Best() != node {
+		t.Errorf("Failed to add mainnet block 1 (%v)", err)
+	}
+}
+
+// TestVarInt checks each size of VarInt encodes little-endian
+func TestVarInt(t *testing.T) {
+	cases := map[int]string{
+		0: "00",
+		0xfc: "fc",
+		0xfd: "fdfd00",
+		0x1234: "fd3412",
+		0x12345678: "fe78563412",
+		0x123456789a: "ff9a78563412000000",
+	}
+	for val, expected := range cases {
+		enc := NewVarInt(val).EncodeVarInt()
+		if hex.EncodeToString(enc) != expected {
+			t.Errorf("VarInt %x encoded as %x, expected %s", val, enc, expected)
+		}
+		decoded, rest, err := DecodeNextVarInt(append(enc, 0xaa))
+		if err != nil || decoded.Value() != uint64(val) || !bytes.Equal(rest, []byte{0xaa}) {
+			t.Errorf("VarInt %x decoded as %v (%v)", val, decoded, err)
+		}
+	}
+
+	if vi, _, _ := DecodeNextVarInt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}); vi == nil || vi.Value() != 0xffffffffffffffff {
+		t.Errorf("Expected largest 64-bit VarInt to decode")
+	}
+	for _, enc := range []string{"fdfc00", "feffff0000", "ffffffffff00000000"} {
+		b, _ := hex.DecodeString(enc)
+		if _, _, err := DecodeNextVarInt(b); err != ErrNonCanonicalVarInt {
+			t.Errorf("Expected non-canonical %s to be rejected, got %v", enc, err)
+		}
+	}
+	for _, enc := range []string{"", "fd00", "fe000001", "ff0000000001"} {
+		b, _ := hex.DecodeString(enc)
+		if _, _, err := DecodeNextVarInt(b); err != ErrUnexpectedEnd {
+			t.Errorf("Expected truncated %q to be rejected, got %v", enc, err)
+		}
+	}
+}
+
+// TestDecodeMalformed checks truncated and oversized data is rejected with an error
+func TestDecodeMalformed(t *testing.T) {
+	raw, _ := hex.DecodeString(genesisCoinbase)
+	for i := 0; i < len(raw); i++ {
+		if _, _, err := DecodeNextTransaction(raw[:i]); err == nil {
+			t.Fatalf("Decoded transaction truncated to %d bytes", i)
+		}
+	}
+
+	// A huge input count must fail before allocating
+	huge := append([]byte{0x01, 0x00, 0x00, 0x00, 0xff}, bytes.Repeat([]byte{0xff}, 8)...)
+	if _, _, err := DecodeNextTransaction(huge); err != ErrCountTooLarge {
+		t.Errorf("Expected huge input count to be rejected, got %v", err)
+	}
+
+	// Segwit marker with only empty witnesses
+	segwit := append(append([]byte{}, raw[:4]...), 0x00, 0x01)
+	segwit = append(append(segwit, raw[4:len(raw)-4]...), 0x00)
+	segwit = append(segwit, raw[len(raw)-4:]...)
+	if _, _, err := DecodeNextTransaction(segwit); err != ErrSuperfluousWitness {
+		t.Errorf("Expected superfluous witness to be rejected, got %v", err)
+	}
+
+	if _, _, err := DecodeBlock([]byte{0x00, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00, 0x00}, chainparams.MainNet()); err != ErrInvalidMagic {
+		t.Errorf("Expected wrong magic to be rejected, got %v", err)
+	}
+	if _, err := DecodeDifficulty([]byte{0xff, 0x7f, 0xff, 0xff}); err != ErrDifficultyOverflow {
+		t.Errorf("Expected overflowing difficulty to be rejected, got %v", err)
+	}
+	if diff, err := DecodeDifficulty([]byte{0x01, 0x12, 0x34, 0x56}); err != nil || diff.target.Int64() != 0x12 {
+		t.Errorf("Small exponent difficulty decoded as %v (%v)", diff.target, err)
+	}
 }
 
 // TestDifficultyExamples checks that a selection of difficulties are encoded and decoded correctly
@@ -59,3 +910,283 @@ func TestKarpathy(t *testing.T) {
     private_key, _ = private_key.SetString("29595381593786747354608258168471648998894101022644411052850960746671046944116", 10)
 	
 }
+
+func TestBIP322MessageHash(t *testing.T) {
+	cases := map[string]string{
+		"": "c90c269c4f8fcbe6880f72a721ddfbf1914268a794cbb21cfafee13770ae19f1",
+		"Hello World": "f0eb03b1a75ac6d9847f55c624a99169b5dccba2a31f5b23bea77ba270de0a7a",
+	}
+	for message, expected := range cases {
+		if h := hex.EncodeToString(BIP322MessageHash(message)); h != expected {
+			t.Errorf("Message hash of %q is %s, expected %s", message, h, expected)
+		}
+	}
+}
+
+func TestBIP322(t *testing.T) {
+	params := chainparams.RegTest()
+	secretKey, pk := cryptography.RandomKeyPair()
+
+	for _, address := range []string{pk.ToAddress(params), pk.ToSegwitAddress(params), pk.ToTaprootAddress(params)} {
+		proof, err := SignBIP322(address, ownershipMessage(address), secretKey, params)
+		if err != nil {
+			t.Fatalf("Failed to sign for %s (%v)", address, err)
+		}
+		if valid, err := VerifyBIP322(address, ownershipMessage(address), proof, params); !valid || err != nil {
+			t.Errorf("Proof for %s did not verify (%v)", address, err)
+		}
+		if valid, _ := VerifyBIP322(address, "Something else", proof, params); valid {
+			t.Errorf("Proof for %s verified a different message", address)
+		}
+	}
+
+	otherKey, _ := cryptography.RandomKeyPair()
+	if _, err := SignBIP322(pk.ToSegwitAddress(params), "Hello", otherKey, params); err != ErrWrongKey {
+		t.Errorf("Expected signing with the wrong key to fail, got %v", err)
+	}
+	if _, err := VerifyBIP322(pk.ToAddress(params), "Hello", "AAAA", params); err != ErrInvalidProof {
+		t.Errorf("Expected malformed proof to be rejected, got %v", err)
+	}
+}
+
+// TestBIP322Vectors checks the test vectors from BIP322, with a full P2PKH proof for the same key
+func TestBIP322Vectors(t *testing.T) {
+	params := chainparams.MainNet()
+	p2wpkh := "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l"
+
+	// Virtual transactions of the P2WPKH address
+	challenge, _ := script.PayToAddress(p2wpkh, params)
+	txids := map[string][2]string{
+		"": {"c5680aa69bb8d860bf82d4e9cd3504b55dde018de765a91bb566283c545a99a7", "1e9654e951a5ba44c8604c4de6c67fd78a27e81dcadcfe1edf638ba3aaebaed6"},
+		"Hello World": {"b79d196740ad5217771c1098fc4a4b51e0535c32236c71f1ea4d61a2d603352b", "88737ae86f2077145f93cc4b153ae9a1cb8d56afa511988c149c5c8c9d93bddf"},
+	}
+	for message, expected := range txids {
+		toSpend := BIP322ToSpend(message, challenge.Encode())
+		toSign := BIP322ToSign(toSpend)
+		// Txids display in reverse byte order
+		spendID, signID := hex.EncodeToString(reverseBytes(toSpend.ID())), hex.EncodeToString(reverseBytes(toSign.ID()))
+		if spendID != expected[0] || signID != expected[1] {
+			t.Errorf("Virtual transactions of %q are %s and %s", message, spendID, signID)
+		}
+	}
+
+	cases := []struct {
+		address, message, proof string
+	}{
+		{p2wpkh, "", "AkcwRAIgM2gBAQqvZX15ZiysmKmQpDrG83avLIT492QBzLnQIxYCIBaTpOaD20qRlEylyxFSeEA2ba9YOixpX8z46TSDtS40ASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="},
+		{p2wpkh, "Hello World", "AkcwRAIgZRfIY3p7/DoVTty6YZbWS71bc5Vct9p9Fia83eRmw2QCICK/ENGfwLtptFluMGs2KsqoNSk89pO7F29zJLUx9a/sASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="},
+		{"bc1ppv609nr0vr25u07u95waq5lucwfm6tde4nydujnu8npg4q75mr5sxq8lt3", "Hello World", "AUHd69PrJQEv+oKTfZ8l+WROBHuy9HKrbFCJu7U1iK2iiEy1vMU5EfMtjc+VSHM7aU0SDbak5IUZRVno2P5mjSafAQ=="},
+		{"14vV3aCHBeStb5bkenkNHbe2YAFinYdXgc", "Hello World", "AAAAAAHZIvdvR4fompS+lLTvaKJgjitVabp8CizknOvglZs2XgAAAABqRzBEAiB3hjKYQcm/KGTsalB3I4kixH3+uDyHQzt1PN5cBGJsvQIgJnRxSVWIbijmMST7VnxGpI8OOCU/tky8Pg7UH5HgSt4BIQLH8SADGWRClD2FiOAa7oQEI8xU/BUhUmo7hcKwy9WIcgAAAAABAAAAAAAAAAABagAAAAA="},
+	}
+	for _, c := range cases {
+		if valid, err := VerifyBIP322(c.address, c.message, c.proof, params); !valid || err != nil {
+			t.Errorf("Proof for %s of %q did not verify (%v)", c.address, c.message, err)
+		}
+		if valid, _ := VerifyBIP322(c.address, c.message + ".", c.proof, params); valid {
+			t.Errorf("Proof for %s verified a different message", c.address)
+		}
+	}
+}
+
+func TestBIP322Multisig(t *testing.T) {
+	params := chainparams.RegTest()
+	secretKeys, pubKeys := make([]*big.Int, 3), make([][]byte, 3)
+	for i := range secretKeys {
+		var pk cryptography.PublicKey
+		secretKeys[i], pk = cryptography.RandomKeyPair()
+		pubKeys[i] = pk.EncodeCompressed()
+	}
+	redeemScript := script.Multisig(2, pubKeys).Encode()
+
+	p2sh := cryptography.Base58CheckEncode(params.ScriptHashAddrID, cryptography.Hash160(redeemScript))
+	p2wsh, _ := cryptography.EncodeSegwitAddress(params.Bech32HRPSegwit, 0, cryptography.SHA256(redeemScript))
+
+	for _, address := range []string{p2sh, p2wsh} {
+		// Any two of the keys, given in any order
+		proof, err := SignBIP322Multisig(address, "2 of 3", redeemScript, []*big.Int{secretKeys[2], secretKeys[0]}, params)
+		if err != nil {
+			t.Fatalf("Failed to sign for %s (%v)", address, err)
+		}
+		if valid, err := VerifyBIP322(address, "2 of 3", proof, params); !valid || err != nil {
+			t.Errorf("Proof for %s did not verify (%v)", address, err)
+		}
+
+		if _, err := SignBIP322Multisig(address, "2 of 3", redeemScript, secretKeys[1:2], params); err != ErrWrongKey {
+			t.Errorf("Expected a single key to be rejected, got %v", err)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	params := chainparams.RegTest()
+	secretKey, pk := cryptography.RandomKeyPair()
+	outputKey, _ := cryptography.TaprootOutputKey(pk, nil)
+	nested := script.P2SH(cryptography.Hash160(script.WitnessProgram(0, pk.HashEncode()).Encode())).Encode()
+	locks := [][]byte{
+		script.P2PKH(pk.HashEncode()).Encode(),
+		script.WitnessProgram(0, pk.HashEncode()).Encode(),
+		nested,
+		script.WitnessProgram(1, outputKey).Encode(),
+	}
+
+	b := NewBuilder(params)
+	if _, err := b.Build(); err != ErrEmptyTransaction {
+		t.Errorf("Expected empty transaction to be rejected, got %v", err)
+	}
+	for i, lock := range locks {
+		if _, err := b.AddInput(cryptography.Hash256([]byte{byte(i)}), uint32(i), lock, 10000); err != nil {
+			t.Fatalf("Failed to add input %v", err)
+		}
+	}
+	_, recipient := cryptography.RandomKeyPair()
+	if err := b.AddOutput(recipient.ToTaprootAddress(params), 25000); err != nil {
+		t.Fatalf("Failed to add output %v", err)
+	}
+	b.AddOutputScript(locks[1], 14000)
+	if !bytes.Equal(b.PrevScript(2), nested) || b.PrevScript(4) != nil || b.PrevScript(-1) != nil {
+		t.Errorf("Expected the locking script of each input and nil out of range")
+	}
+	b.SetLocktime(100)
+	b.SetSequence(0, SequenceFinal)
+
+	if _, err := b.Build(); err != ErrUnsigned {
+		t.Errorf("Expected unsigned transaction to be rejected, got %v", err)
+	}
+	otherKey, _ := cryptography.RandomKeyPair()
+	for i := range locks {
+		if err := b.SignInput(i, otherKey); err != ErrWrongKey {
+			t.Errorf("Expected input %v to reject the wrong key, got %v", i, err)
+		}
+		if err := b.SignInput(i, secretKey); err != nil {
+			t.Errorf("Failed to sign input %v (%v)", i, err)
+		}
+	}
+	raw, err := b.Build()
+	if err != nil {
+		t.Fatalf("Failed to build %v", err)
+	}
+
+	// Round trips
+	decoded, rest, err := DecodeNextTransaction(raw)
+	if err != nil || len(rest) != 0 || !bytes.Equal(decoded.Encode(-1), raw) || len(decoded.txOut) != 2 || !decoded.HasWitness() {
+		t.Errorf("Transaction did not round trip")
+	}
+	tx := b.Transaction()
+	if w := tx.Weight(); w <= 4 * len(tx.encode(-1, false)) || w >= 4 * len(raw) || tx.VSize() != (w + 3) / 4 {
+		t.Errorf("Weight %v out of range", w)
+	}
+	if id, _ := ParseHash(HashString(tx.ID())); !bytes.Equal(id, tx.ID()) {
+		t.Errorf("Transaction id did not round trip through its display form")
+	}
+
+	// The signatures commit to the outputs
+	b.AddOutputScript(locks[0], 1)
+	if _, err := b.Build(); err != ErrUnsigned {
+		t.Errorf("Expected adding an output to invalidate the signatures, got %v", err)
+	}
+	if err := b.SignInput(4, secretKey); err != ErrInputIndex {
+		t.Errorf("Expected index out of range, got %v", err)
+	}
+}
+
+// TestSigHashVectors checks the native P2WPKH example of BIP143 and the key path spends of BIP341 that sign with SIGHASH_DEFAULT or SIGHASH_ALL
+func TestSigHashVectors(t *testing.T) {
+	// Transactions from the BIP143 native P2WPKH and BIP341 keyPathSpending examples
+	tx := Transaction{version: 1, lock_time: NewLocktime(17)}
+	for _, in := range []struct {
+		prev string
+		index int64
+		sequence uint32
+	}{
+		{"fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f", 0, 0xffffffee},
+		{"ef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a", 1, 0xffffffff},
+	} {
+		prev, _ := hex.DecodeString(in.prev)
+		tx.txIn = append(tx.txIn, TransactionInput{prevTransaction: prev, prevIndex: in.index, scriptSig: []byte{}, sequence: in.sequence})
+	}
+	for _, out := range []struct {
+		amount uint64
+		scriptPubKey string
+	}{
+		{112340000, "76a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac"},
+		{223450000, "76a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac"},
+	} {
+		scriptPubKey, _ := hex.DecodeString(out.scriptPubKey)
+		tx.txOut = append(tx.txOut, TransactionOutput{amount: out.amount, scriptPubKey: scriptPubKey})
+	}
+	tx.txIn[1].prevAmount = 600000000
+	scriptCode, _ := hex.DecodeString("76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac")
+	preimage := tx.WitnessV0SigHashPreimage(1, scriptCode)
+	expected := "0100000096b827c8483d4e9b96712b6713a7b68d6e8003a781feba36c31143470b4efd3752b0a642eea2fb7ae638c36f6252b6750293dbe574a806984b8e4d8548339a3bef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a010000001976a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac0046c32300000000ffffffff863ef3e1a92afbfdb97f31ad0fc7683ee943e9abcf2501590ff8f6551f47e5e51100000001000000"
+	if hex.EncodeToString(preimage) != expected {
+		t.Errorf("BIP143 preimage %x", preimage)
+	}
+	if sighash := hex.EncodeToString(cryptography.Hash256(preimage)); sighash != "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670" {
+		t.Errorf("BIP143 sighash %s", sighash)
+	}
+
+	tx = Transaction{version: 2, lock_time: NewLocktime(500000000)}
+	for _, in := range []struct {
+		prev string
+		index int64
+		sequence uint32
+	}{
+		{"7de20cbff686da83a54981d2b9bab3586f4ca7e48f57f5b55963115f3b334e9c", 1, 0x00000000},
+		{"d7b7cab57b1393ace2d064f4d4a2cb8af6def61273e127517d44759b6dafdd99", 0, 0xffffffff},
+		{"f8e1f583384333689228c5d28eac13366be082dc57441760d957275419a41842", 0, 0xffffffff},
+		{"f0689180aa63b30cb162a73c6d2a38b7eeda2a83ece74310fda0843ad604853b", 1, 0xfffffffe},
+		{"aa5202bdf6d8ccd2ee0f0202afbbb7461d9264a25e5bfd3c5a52ee1239e0ba6c", 0, 0xfffffffe},
+		{"956149bdc66faa968eb2be2d2faa29718acbfe3941215893a2a3446d32acd050", 0, 0x00000000},
+		{"e664b9773b88c09c32cb70a2a3e4da0ced63b7ba3b22f848531bbb1d5d5f4c94", 1, 0x00000000},
+		{"e9aa6b8e6c9de67619e6a3924ae25696bb7b694bb677a632a74ef7eadfd4eabf", 0, 0xffffffff},
+		{"a778eb6a263dc090464cd125c466b5a99667720b1c110468831d058aa1b82af1", 1, 0xffffffff},
+	} {
+		prev, _ := hex.DecodeString(in.prev)
+		tx.txIn = append(tx.txIn, TransactionInput{prevTransaction: prev, prevIndex: in.index, scriptSig: []byte{}, sequence: in.sequence})
+	}
+	for _, out := range []struct {
+		amount uint64
+		scriptPubKey string
+	}{
+		{1000000000, "76a91406afd46bcdfd22ef94ac122aa11f241244a37ecc88ac"},
+		{3410000000, "ac9a87f5594be208f8532db38cff670c450ed2fea8fcdefcc9a663f78bab962b"},
+	} {
+		scriptPubKey, _ := hex.DecodeString(out.scriptPubKey)
+		tx.txOut = append(tx.txOut, TransactionOutput{amount: out.amount, scriptPubKey: scriptPubKey})
+	}
+	spent := []struct {
+		amount uint64
+		scriptPubKey string
+	}{
+		{420000000, "512053a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343"},
+		{462000000, "5120147c9c57132f6e7ecddba9800bb0c4449251c92a1e60371ee77557b6620f3ea3"},
+		{294000000, "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac"},
+		{504000000, "5120e4d810fd50586274face62b8a807eb9719cef49c04177cc6b76a9a4251d5450e"},
+		{630000000, "512091b64d5324723a985170e4dc5a0f84c041804f2cd12660fa5dec09fc21783605"},
+		{378000000, "00147dd65592d0ab2fe0d0257d571abf032cd9db93dc"},
+		{672000000, "512075169f4001aa68f15bbed28b218df1d0a62cbbcf1188c6665110c293c907b831"},
+		{546000000, "5120712447206d7a5238acc7ff53fbe94a3b64539ad291c7cdbc490b7577e4b17df5"},
+		{588000000, "512077e30a5522dd9f894c3f8b8bd4c4b2cf82ca7da8a3ea6a239655c39c050ab220"},
+	}
+	for i, out := range spent {
+		tx.txIn[i].prevAmount = out.amount
+		tx.txIn[i].prevTransactionPubKey, _ = hex.DecodeString(out.scriptPubKey)
+	}
+	cases := []struct {
+		index int
+		hashType byte
+		sighash string
+	}{
+		{3, SigHashAll, "bf013ea93474aa67815b1b6cc441d23b64fa310911d991e713cd34c7f5d46669"},
+		{4, SigHashDefault, "4f900a0bae3f1446fd48490c2958b5a023228f01661cda3496a11da502a7f7ef"},
+	}
+	for _, c := range cases {
+		if sighash := hex.EncodeToString(tx.TaprootSigHash(c.index, c.hashType)); sighash != c.sighash {
+			t.Errorf("BIP341 input %d sighash %s, expected %s", c.index, sighash, c.sighash)
+		}
+	}
+}
+
+func ownershipMessage(address string) string {
+	return "I control " + address
+}
@@ -1,24 +1,35 @@
 package chain
 
 import (
-	"bytes"
+	"encoding/binary"
 	"errors"
+	"math"
 	"math/big"
 )
 
-// Difficulty houses logic for computing, encoding and testing difficulty
+// Difficulty houses logic for computing, encoding and testing difficulty, it is immutable so copies may be shared
 type Difficulty struct {
 	target *big.Int
 	targetBytes []byte
 }
 
-func leftPad(b []byte, l int) ([]byte, int) {
-	if len(b) >= l {
-		return b, 0
+// NewDifficulty is the difficulty with the given target, which is copied and must be positive and fit in 256 bits
+func NewDifficulty(target *big.Int) (Difficulty, error) {
+	switch {
+	case target.Sign() < 0:
+		return Difficulty{}, ErrDifficultyNegative
+	case target.Sign() == 0:
+		return Difficulty{}, ErrZeroTarget
+	case target.BitLen() > 256:
+		return Difficulty{}, ErrDifficultyOverflow
 	}
+	return newDifficulty(target), nil
+}
 
-	diff := l - len(b)
-	return append(make([]byte, diff), b...), diff
+// newDifficulty copies a target already known to be in range
+func newDifficulty(target *big.Int) Difficulty {
+	t := new(big.Int).Set(target)
+	return Difficulty{target: t, targetBytes: t.FillBytes(make([]byte, 32))}
 }
 
 func Compare(a, b []byte) int {
@@ -37,63 +48,132 @@ func Compare(a, b []byte) int {
 	return 0
 }
 
-// DecodeDifficulty recovers from mantissa-exponent format
+// ErrDifficultySize when a compact difficulty is not 4 bytes
+var ErrDifficultySize = errors.New("Difficulty field wrong size")
+// ErrDifficultyOverflow when a compact difficulty decodes to a target wider than 256 bits
+var ErrDifficultyOverflow = errors.New("Difficulty target overflows 256 bits")
+// ErrZeroTarget when a target is zero, which no hash can meet
+var ErrZeroTarget = errors.New("Difficulty target is zero")
+// ErrDifficultyNegative when a target is negative, in compact form a nonzero mantissa with its sign bit set
+var ErrDifficultyNegative = errors.New("Difficulty target is negative")
+// ErrDivideByZero when a target is divided by zero
+var ErrDivideByZero = errors.New("Difficulty target divided by zero")
+
+// DecodeDifficulty recovers from mantissa-exponent format, rejecting what Bitcoin Core's SetCompact flags as negative or overflowing
 func DecodeDifficulty(b []byte) (Difficulty, error) {
 	if len(b) != 4 {
-		return Difficulty{}, errors.New("Difficulty field wrong size")
+		return Difficulty{}, ErrDifficultySize
+	}
+	exponent := int(b[0])
+	word := binary.BigEndian.Uint32(b) & 0x007fffff
+
+	// Small exponents shift mantissa bytes out before the sign is checked, as in Bitcoin Core
+	if exponent < 3 {
+		word >>= uint(8*(3-exponent))
+	}
+
+	// The top mantissa bit is a sign, the rest is scaled by 256^(exponent-3)
+	if word != 0 && b[1] & 0x80 != 0 {
+		return Difficulty{}, ErrDifficultyNegative
+	}
+	if word != 0 && (exponent > 34 || (word > 0xff && exponent > 33) || (word > 0xffff && exponent > 32)) {
+		return Difficulty{}, ErrDifficultyOverflow
 	}
-	coefficient := new(big.Int).SetBytes(b[1:4])
-	exponent := uint(8*(int(b[0])-3))
 
-	target := new(big.Int)
-	target.Lsh(coefficient, exponent)
+	target := big.NewInt(int64(word))
+	if exponent > 3 {
+		target.Lsh(target, uint(8*(exponent-3)))
+	}
 
 	targetBytes := target.FillBytes(make([]byte, 32))
 
 	return Difficulty{target: target, targetBytes: targetBytes}, nil
 }
 
-// Encode returns a 4 byte mantissa-exponent encoding of the difficulty
+// DifficultyFromBits decodes the compact difficulty as it appears in chain parameters
+func DifficultyFromBits(bits uint32) (Difficulty, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, bits)
+	return DecodeDifficulty(b)
+}
+
+// Encode returns a 4 byte mantissa-exponent encoding of the difficulty, rounding the target down to 3 significant bytes as Bitcoin Core does
 func (diff Difficulty) Encode() []byte {
-	b := diff.target.FillBytes(make([]byte, 32))
-	var mantissa int
-	for i, digit := range b {
-		if digit != 0x00 {
-			mantissa = len(b) - i
-			b = b[i:min(i+3, len(b))]
-			break
-		}
+	if diff.target == nil {
+		return make([]byte, 4) // Zero value
+	}
+	size := (diff.target.BitLen() + 7) / 8
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(diff.target.Uint64() << uint(8*(3-size)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(diff.target, uint(8*(size-3))).Uint64())
+	}
+
+	// The top mantissa bit is a sign, keep it clear
+	if mantissa & 0x00800000 != 0 {
+		mantissa >>= 8
+		size++
 	}
-	b = bytes.TrimRight(b, string(byte(0x00)))
-	b, amountPadded := leftPad(b, 3) // Ensure its 3 bytes
-	mantissa += amountPadded
+	return []byte{byte(size), byte(mantissa >> 16), byte(mantissa >> 8), byte(mantissa)}
+}
+
+// Bits is the compact encoding as a number, as in chain parameters and RPC
+func (diff Difficulty) Bits() uint32 {
+	return binary.BigEndian.Uint32(diff.Encode())
+}
 
-	return append([]byte{byte(mantissa)}, b...)
+// Target returns a copy of the target
+func (diff Difficulty) Target() *big.Int {
+	if diff.target == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(diff.target)
 }
 
-// IsSolution tests whether a block hash is below the difficulty target
+// Compact is the difficulty rounded to what its encoding can represent
+func (diff Difficulty) Compact() Difficulty {
+	compact, _ := DecodeDifficulty(diff.Encode())
+	return compact
+}
+
+// IsSolution tests whether a block hash, in internal byte order, is at or below the difficulty target
 func (diff Difficulty) IsSolution(hash []byte) bool {
-	if Compare(hash, diff.targetBytes) == -1 {
-		//fmt.Println("FOUND!")
-		//fmt.Printf("%X < %X \n", hash, diff.targetBytes)
+	if diff.target == nil {
+		return false
+	}
+	if Compare(reverseBytes(append([]byte{}, hash...)), diff.targetBytes) != 1 {
 		return true
 	}
 	return false
-	//return compare(hash, diff.targetBytes) == -1
 }
 
-// Mul multiples the difficulty by constant
-func (diff Difficulty) Mul(c *big.Int) Difficulty {
-	diff.target.Mul(diff.target, c)
-	diff.target.FillBytes(diff.targetBytes)
-	return diff
+// Mul returns the difficulty with its target multiplied by a constant, an error if the result is out of range
+func (diff Difficulty) Mul(c *big.Int) (Difficulty, error) {
+	return NewDifficulty(new(big.Int).Mul(diff.target, c))
 }
 
-// Div divides the difficulty by constant
-func (diff Difficulty) Div(c *big.Int) Difficulty {
-	// fmt.Println("Diff-b", diff.target)
-	diff.target.Div(diff.target, c)
-	diff.target.FillBytes(diff.targetBytes)
-	// fmt.Println("Diff-a", diff.target)
-	return diff
-}
\ No newline at end of file
+// Div returns the difficulty with its target divided by a constant, an error if the result is out of range
+func (diff Difficulty) Div(c *big.Int) (Difficulty, error) {
+	if c.Sign() == 0 {
+		return Difficulty{}, ErrDivideByZero
+	}
+	return NewDifficulty(new(big.Int).Div(diff.target, c))
+}
+
+// Work is the expected number of hashes to meet the target, 2^256 / (target + 1), summed along a chain to compare forks
+func (diff Difficulty) Work() *big.Int {
+	denominator := new(big.Int).Add(diff.target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// Float is how many times harder the target is than 0x1d00ffff, mainnet's pow limit, on every network as getdifficulty does, so signet and regtest blocks at their limits are below 1
+func (diff Difficulty) Float() float64 {
+	target := diff.Compact().target
+	if target.Sign() == 0 {
+		return math.Inf(1)
+	}
+	one, _ := DifficultyFromBits(0x1d00ffff)
+	difficulty, _ := new(big.Float).Quo(new(big.Float).SetInt(one.target), new(big.Float).SetInt(target)).Float64()
+	return difficulty
+}
@@ -0,0 +1,74 @@
+//go:build go1.18
+// +build go1.18
+
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// Fuzz targets, run with go test -fuzz=FuzzDecodeTransaction ./internal/chain, decoders must return an error rather than panic
+
+func FuzzDecodeVarInt(f *testing.F) {
+	for _, seed := range []string{"00", "fc", "fdfd00", "fe00000100", "ff0000000001000000", "fdfc00"} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		vi, rest, err := DecodeNextVarInt(b)
+		if err != nil {
+			return
+		}
+		if consumed := b[:len(b)-len(rest)]; !bytes.Equal(vi.EncodeVarInt(), consumed) {
+			t.Errorf("VarInt %x re-encoded as %x", consumed, vi.EncodeVarInt())
+		}
+	})
+}
+
+func FuzzDecodeTransaction(f *testing.F) {
+	for _, seed := range []string{genesisCoinbase, "0100000000010000000000"} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tx, rest, err := DecodeNextTransaction(b)
+		var streamed Transaction
+		streamErr := streamed.Deserialize(bytes.NewReader(b))
+		if (err == nil) != (streamErr == nil) {
+			t.Fatalf("Decoders disagree on %x (%v, %v)", b, err, streamErr)
+		}
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(streamed.Encode(-1), tx.Encode(-1)) {
+			t.Errorf("Decoders disagree on %x", b)
+		}
+		if consumed := b[:len(b)-len(rest)]; !bytes.Equal(tx.Encode(-1), consumed) {
+			t.Errorf("Transaction %x re-encoded as %x", consumed, tx.Encode(-1))
+		}
+		tx.ID()
+		tx.Weight()
+	})
+}
+
+func FuzzDecodeBlock(f *testing.F) {
+	params := chainparams.MainNet()
+	coinbase, _ := hex.DecodeString(genesisCoinbase)
+	header := append(make([]byte, 72), 0xff, 0xff, 0x00, 0x1d, 0x1d, 0xac, 0x2b, 0x7c)
+	data := append(append(header, 0x01), coinbase...)
+	f.Add(append(append(append([]byte{}, params.MagicBytes()...), encodeUint32(uint32(len(data)))...), data...))
+	f.Add(append(params.MagicBytes(), 0xff, 0xff, 0xff, 0xff))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeBlock(b, params)
+		DecodeBlockData(b)
+		var block Block
+		block.Deserialize(bytes.NewReader(b))
+		if proof, _, err := DecodeNextMerkleProof(b); err == nil {
+			VerifyMerkleProof(proof.Header, proof)
+		}
+		DecodeNextBlockHeader(b)
+	})
+}
@@ -0,0 +1,81 @@
+package chain
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// GenesisMessage is the headline Satoshi put in the first coinbase
+const GenesisMessage = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
+// GenesisReward is the 50 BTC paid by the genesis coinbase
+const GenesisReward uint64 = 50 * 100000000
+
+// genesisPubKey is the key the genesis coinbase pays to, the output can never be spent
+const genesisPubKey = "04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f"
+
+// ErrNonceExhausted when no nonce solves a header at its difficulty
+var ErrNonceExhausted = errors.New("No nonce meets the difficulty target")
+
+// Genesis is the first block of the network, built from its parameters
+func Genesis(params *chainparams.Params) Block {
+	coinbase := coinbaseTransaction(GenesisMessage, GenesisReward, genesisLockScript())
+	root, _ := MerkleRoot([][]byte{coinbase.ID()})
+
+	header, err := NewBlockHeader(params.GenesisVersion, make([]byte, 32), root, params.GenesisTime, params.GenesisBits, params.GenesisNonce)
+	if err != nil {
+		panic("Invalid genesis difficulty in chain parameters")
+	}
+	return NewBlock(header, []Transaction{coinbase})
+}
+
+// NewGenesisBlock creates and mines the first block of a private network, its coinbase carrying message and paying reward to scriptPubKey (the original genesis key if nil)
+func NewGenesisBlock(message string, timestamp uint32, bits uint32, reward uint64, scriptPubKey []byte) (Block, error) {
+	if scriptPubKey == nil {
+		scriptPubKey = genesisLockScript()
+	}
+	coinbase := coinbaseTransaction(message, reward, scriptPubKey)
+	root, _ := MerkleRoot([][]byte{coinbase.ID()})
+
+	header, err := NewBlockHeader(1, make([]byte, 32), root, timestamp, bits, 0)
+	if err != nil {
+		return Block{}, err
+	}
+	if header.DifficultyTarget.target.Sign() == 0 {
+		return Block{}, ErrZeroTarget
+	}
+	for !header.DifficultyTarget.IsSolution(header.BlockHash()) {
+		if header.Nonce == 0xFFFFFFFF {
+			return Block{}, ErrNonceExhausted
+		}
+		header.Nonce++
+	}
+	return NewBlock(header, []Transaction{coinbase}), nil
+}
+
+// coinbaseTransaction spends nothing, its scriptSig pushing the original genesis bits, the number 4 and message as Bitcoin Core does
+func coinbaseTransaction(message string, reward uint64, scriptPubKey []byte) Transaction {
+	scriptSig := script.NewScript()
+	scriptSig.AppendData([]byte{0xff, 0xff, 0x00, 0x1d})
+	scriptSig.AppendData([]byte{0x04})
+	scriptSig.AppendData([]byte(message))
+
+	return Transaction{
+		version: 1,
+		txIn: []TransactionInput{{
+			prevTransaction: make([]byte, 32),
+			prevIndex: 0xFFFFFFFF,
+			scriptSig: scriptSig.Encode(),
+			sequence: SequenceFinal,
+		}},
+		txOut: []TransactionOutput{{amount: reward, scriptPubKey: scriptPubKey}},
+		lock_time: NewLocktime(0),
+	}
+}
+
+// genesisLockScript is the pay to public key script of the genesis coinbase
+func genesisLockScript() []byte {
+	pubKey, _ := hex.DecodeString(genesisPubKey)
+	return script.P2PK(pubKey).Encode()
+}
@@ -0,0 +1,23 @@
+package chain
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// ErrInvalidHash when a displayed hash is not 64 hex characters
+var ErrInvalidHash = errors.New("Invalid hash, expected 64 hex characters")
+
+// HashString gives the display form of a transaction or block hash, hex with the bytes reversed
+func HashString(hash []byte) string {
+	return hex.EncodeToString(reverseBytes(append([]byte{}, hash...)))
+}
+
+// ParseHash reads a displayed transaction or block hash back into internal byte order
+func ParseHash(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return nil, ErrInvalidHash
+	}
+	return reverseBytes(b), nil
+}
@@ -0,0 +1,225 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// MaxFutureBlockTime is how far ahead of the local clock a header's timestamp may be
+const MaxFutureBlockTime = 2 * time.Hour
+// medianTimeSpan is the number of previous blocks whose median time a new block must exceed
+const medianTimeSpan = 11
+
+// ErrDuplicateHeader when a header is already in the tree
+var ErrDuplicateHeader = errors.New("Header already known")
+// ErrOrphanHeader when a header's previous block is not in the tree
+var ErrOrphanHeader = errors.New("Previous block of header not known")
+// ErrBadDifficulty when a header's bits are not the difficulty required after its previous block
+var ErrBadDifficulty = errors.New("Header has incorrect difficulty")
+// ErrHighHash when a header's hash does not meet its target, or the target is easier than the network allows
+var ErrHighHash = errors.New("Header hash does not meet proof of work")
+// ErrTimeTooOld when a header's timestamp is not after the median time of the blocks before it
+var ErrTimeTooOld = errors.New("Header timestamp is at or before median time past")
+// ErrTimeTooNew when a header's timestamp is more than MaxFutureBlockTime ahead of the local clock
+var ErrTimeTooNew = errors.New("Header timestamp too far in the future")
+
+// HeaderNode is a header placed in the tree, with its height and the work of the chain ending at it
+type HeaderNode struct {
+	Header *BlockHeader
+	Hash []byte // Internal byte order
+	Height int32
+	ChainWork *big.Int
+	parent *HeaderNode
+}
+
+// Parent is the node of the previous block, nil for genesis
+func (node *HeaderNode) Parent() *HeaderNode {
+	return node.parent
+}
+
+// Ancestor is the node at height on the chain ending at node, nil if height is above it or negative
+func (node *HeaderNode) Ancestor(height int32) *HeaderNode {
+	if height < 0 || height > node.Height {
+		return nil
+	}
+	for node.Height > height {
+		node = node.parent
+	}
+	return node
+}
+
+// MedianTimePast is the median timestamp of the node and up to 10 blocks before it
+func (node *HeaderNode) MedianTimePast() uint32 {
+	times := make([]uint32, 0, medianTimeSpan)
+	for ; node != nil && len(times) < medianTimeSpan; node = node.parent {
+		times = append(times, node.Header.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times) / 2]
+}
+
+// HeaderTree is the block index, every valid header received and the forks they form, starting from the network's genesis
+type HeaderTree struct {
+	params *chainparams.Params
+	nodes map[string]*HeaderNode // Keyed by hash in internal byte order
+	tips map[string]*HeaderNode // Nodes without children, the end of each fork
+	genesis *HeaderNode
+	best *HeaderNode
+}
+
+// NewHeaderTree starts a tree holding only the genesis header of the network
+func NewHeaderTree(params *chainparams.Params) *HeaderTree {
+	header := Genesis(params).Header
+	genesis := &HeaderNode{Header: header, Hash: header.BlockHash(), Height: 0, ChainWork: header.DifficultyTarget.Work()}
+	return &HeaderTree{
+		params: params,
+		nodes: map[string]*HeaderNode{string(genesis.Hash): genesis},
+		tips: map[string]*HeaderNode{string(genesis.Hash): genesis},
+		genesis: genesis,
+		best: genesis,
+	}
+}
+
+// AddHeader validates a header against its previous block and adds it, the best tip moves if its chain has more work
+func (tree *HeaderTree) AddHeader(header *BlockHeader) (*HeaderNode, error) {
+	return tree.addHeader(header, time.Now())
+}
+
+func (tree *HeaderTree) addHeader(header *BlockHeader, now time.Time) (*HeaderNode, error) {
+	if err := header.checkHashes(); err != nil {
+		return nil, err
+	}
+	hash := header.BlockHash()
+	if node, ok := tree.nodes[string(hash)]; ok {
+		return node, ErrDuplicateHeader
+	}
+	parent, ok := tree.nodes[string(header.PrevBlock)]
+	if !ok {
+		return nil, ErrOrphanHeader
+	}
+
+	// Proof of work, against the header's own target which must be no easier than the network's limit
+	target := header.DifficultyTarget.target
+	if target.Sign() <= 0 || target.Cmp(tree.params.PowLimit()) > 0 || !header.DifficultyTarget.IsSolution(hash) {
+		return nil, ErrHighHash
+	}
+
+	// The target must be the one the retarget rules require after parent
+	required, err := tree.NextWorkRequired(parent, header.Time)
+	if err != nil {
+		return nil, err
+	}
+	if header.Bits() != required.Bits() {
+		return nil, ErrBadDifficulty
+	}
+
+	if header.Time <= parent.MedianTimePast() {
+		return nil, ErrTimeTooOld
+	}
+	if int64(header.Time) > now.Add(MaxFutureBlockTime).Unix() {
+		return nil, ErrTimeTooNew
+	}
+
+	node := &HeaderNode{
+		Header: header,
+		Hash: hash,
+		Height: parent.Height + 1,
+		ChainWork: new(big.Int).Add(parent.ChainWork, header.DifficultyTarget.Work()),
+		parent: parent,
+	}
+	tree.nodes[string(hash)] = node
+	delete(tree.tips, string(parent.Hash))
+	tree.tips[string(hash)] = node
+
+	// Ties go to the tip seen first, as in Bitcoin Core
+	if node.ChainWork.Cmp(tree.best.ChainWork) > 0 {
+		tree.best = node
+	}
+	return node, nil
+}
+
+// NextWorkRequired is the difficulty of a block with blockTime built on parent
+func (tree *HeaderTree) NextWorkRequired(parent *HeaderNode, blockTime uint32) (Difficulty, error) {
+	// Lookups move down the chain, so carry on from the last one instead of walking from parent each time
+	cursor := parent
+	return nextWorkRequired(parent.Height, func(height int32) *BlockHeader {
+		if height > cursor.Height {
+			cursor = parent
+		}
+		node := cursor.Ancestor(height)
+		if node == nil {
+			return nil
+		}
+		cursor = node
+		return node.Header
+	}, blockTime, tree.params)
+}
+
+// Lookup is the node with hash in internal byte order, nil if unknown
+func (tree *HeaderTree) Lookup(hash []byte) *HeaderNode {
+	return tree.nodes[string(hash)]
+}
+
+// Genesis is the root of the tree
+func (tree *HeaderTree) Genesis() *HeaderNode {
+	return tree.genesis
+}
+
+// Best is the tip of the chain with the most work
+func (tree *HeaderTree) Best() *HeaderNode {
+	return tree.best
+}
+
+// Tips are the ends of every fork, including the best, highest first
+func (tree *HeaderTree) Tips() []*HeaderNode {
+	tips := make([]*HeaderNode, 0, len(tree.tips))
+	for _, node := range tree.tips {
+		tips = append(tips, node)
+	}
+	sort.Slice(tips, func(i, j int) bool {
+		if tips[i].Height != tips[j].Height {
+			return tips[i].Height > tips[j].Height
+		}
+		return bytes.Compare(tips[i].Hash, tips[j].Hash) < 0
+	})
+	return tips
+}
+
+// Len is the number of headers in the tree, including genesis
+func (tree *HeaderTree) Len() int {
+	return len(tree.nodes)
+}
+
+// CommonAncestor is the last node shared by the chains ending at a and b, nil if they are from different trees
+func CommonAncestor(a, b *HeaderNode) *HeaderNode {
+	if a.Height > b.Height {
+		a = a.Ancestor(b.Height)
+	} else {
+		b = b.Ancestor(a.Height)
+	}
+	for a != b {
+		a, b = a.parent, b.parent
+	}
+	return a
+}
+
+// ReorgPath lists the nodes to disconnect from the tip from, newest first, and connect to reach to, oldest first
+func ReorgPath(from, to *HeaderNode) (disconnect []*HeaderNode, connect []*HeaderNode) {
+	fork := CommonAncestor(from, to)
+	disconnect = make([]*HeaderNode, 0)
+	connect = make([]*HeaderNode, 0)
+	for node := from; node != fork; node = node.parent {
+		disconnect = append(disconnect, node)
+	}
+	for node := to; node != fork; node = node.parent {
+		connect = append(connect, node)
+	}
+	for i, j := 0, len(connect) - 1; i < j; i, j = i + 1, j - 1 {
+		connect[i], connect[j] = connect[j], connect[i]
+	}
+	return disconnect, connect
+}
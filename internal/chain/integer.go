@@ -1,25 +1,40 @@
 package chain
 
 import (
+	"encoding/binary"
+	"errors"
 	"math/big"
 )
 
+// ErrUnexpectedEnd when data ends part way through a field
+var ErrUnexpectedEnd = errors.New("Unexpected end of data")
+// ErrNonCanonicalVarInt when a VarInt uses a longer encoding than its value needs
+var ErrNonCanonicalVarInt = errors.New("VarInt not minimally encoded")
+// ErrCountTooLarge when a count or length claims more items than the remaining data could hold
+var ErrCountTooLarge = errors.New("Count exceeds the remaining data")
+
+// VarInt is the variable length unsigned integer prefixing counts and lengths
 type VarInt struct {
-	val int64
+	val uint64
 }
 
 func NewVarInt(val int) *VarInt {
-	return &VarInt{val: int64(val)}
+	return &VarInt{val: uint64(val)}
+}
+
+// Value of the VarInt
+func (vi *VarInt) Value() uint64 {
+	return vi.val
 }
 
-// EncodeBytes encodes as [big-endian...]
+// EncodeBytes encodes as [little-endian...]
 func (vi *VarInt) EncodeBytes(nbytes int) []byte {
-	buf := make([]byte, nbytes)
-	buf = big.NewInt(vi.val).FillBytes(buf)
-	return buf
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, vi.val)
+	return buf[:nbytes]
 }
 
-// EncodeVarInt encodes as [nbytes, big-endian...]
+// EncodeVarInt encodes as [prefix, little-endian...], the prefix 0xfd, 0xfe or 0xff giving a 2, 4 or 8 byte value
 func (vi *VarInt) EncodeVarInt() []byte {
 	if vi.val < 0xfd {
 		return []byte{byte(vi.val)}
@@ -28,24 +43,67 @@ func (vi *VarInt) EncodeVarInt() []byte {
 	} else if vi.val < 0x100000000 {
 		return append([]byte{0xfe}, vi.EncodeBytes(4)...)
 	} else {
-		return []byte{0xff}
+		return append([]byte{0xff}, vi.EncodeBytes(8)...)
+	}
+}
+
+// DecodeNextVarInt decodes [prefix, little-endian...], returning rest of b, values not in their shortest form are rejected
+func DecodeNextVarInt(b []byte) (*VarInt, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, ErrUnexpectedEnd
+	}
+	size, least := 1, uint64(0)
+	switch b[0] {
+	case 0xfd:
+		size, least = 3, 0xfd
+	case 0xfe:
+		size, least = 5, 0x10000
+	case 0xff:
+		size, least = 9, 0x100000000
+	}
+	if len(b) < size {
+		return nil, b, ErrUnexpectedEnd
+	}
+
+	var val uint64
+	switch size {
+	case 1:
+		val = uint64(b[0])
+	case 3:
+		val = uint64(binary.LittleEndian.Uint16(b[1:3]))
+	case 5:
+		val = uint64(decodeUint32(b[1:5]))
+	default:
+		val = decodeUint64(b[1:9])
+	}
+	if val < least {
+		return nil, b, ErrNonCanonicalVarInt
+	}
+	return &VarInt{val: val}, b[size:], nil
+}
+
+// decodeNextCount reads a count of items each at least minSize bytes, rejecting counts the rest of b cannot hold so callers never allocate for data that is not there
+func decodeNextCount(b []byte, minSize int) (int, []byte, error) {
+	vi, rest, err := DecodeNextVarInt(b)
+	if err != nil {
+		return 0, b, err
+	}
+	if vi.val > uint64(len(rest) / minSize) {
+		return 0, b, ErrCountTooLarge
 	}
+	return int(vi.val), rest, nil
 }
 
-// Decodes [nbytes, big-endian...] into VarInt struct, returning rest of b
-func DecodeNextVarInt(b []byte) (*VarInt, []byte) {
-	nBytes := b[0]
-	if nBytes < 0xfd {
-		return &VarInt{val: int64(nBytes)}, b[1:]
-	} else if nBytes == 0xfd {
-		return &VarInt{val: DecodeInt(b[1:3])}, b[3:]
-	} else if nBytes == 0xfe {
-		return &VarInt{val: DecodeInt(b[1:5])}, b[5:]
-	} else if nBytes == 0xff {
-		// Unsupported past 64-bit
-		return nil, b
+// decodeNextBytes reads a VarInt length prefixed byte string, returning rest of b
+func decodeNextBytes(b []byte) ([]byte, []byte, error) {
+	vi, rest, err := DecodeNextVarInt(b)
+	if err != nil {
+		return nil, b, err
 	}
-	return nil, b
+	if vi.val > uint64(len(rest)) {
+		return nil, b, ErrUnexpectedEnd
+	}
+	return rest[:vi.val], rest[vi.val:], nil
 }
 
 // EncodeInt encodes i as [big-endian...]
@@ -62,6 +120,32 @@ func DecodeInt(b []byte) int64 {
 	return z.Int64()
 }
 
+// encodeUint32 encodes as 4 little-endian bytes, like version, sequence and locktime fields
+func encodeUint32(i uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, i)
+	return buf
+}
+
+func decodeUint32(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
+
+// encodeUint64 encodes as 8 little-endian bytes, like output amounts
+func encodeUint64(i uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, i)
+	return buf
+}
+
+func decodeUint64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func encodeAmount(amount uint64) []byte {
+	return encodeUint64(amount)
+}
+
 func reverseBytes(b []byte) []byte {
 	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
 		b[i], b[j] = b[j], b[i]
@@ -10,14 +10,15 @@ func NewLocktime(t int) Locktime {
 
 func (lt Locktime) Encode() []byte {
 	// Little endian 4 bytes
-	return reverseBytes(EncodeInt(int64(lt.t), 4))
+	return encodeUint32(uint32(lt.t))
 }
 
-func DecodeLocktime(b []byte) Locktime {
-	if len(b) != 4 {
-		panic("Expected 4 bytes for locktime")
+// DecodeLocktime reads a 4 byte locktime, returning rest of b
+func DecodeLocktime(b []byte) (Locktime, []byte, error) {
+	if len(b) < 4 {
+		return Locktime{}, b, ErrUnexpectedEnd
 	}
 	return Locktime{
-		t: int32(DecodeInt(reverseBytes(b))),
-	}
-}
\ No newline at end of file
+		t: int32(decodeUint32(b[0:4])),
+	}, b[4:], nil
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/harveynw/blokechain/internal/cryptography"
+)
+
+// witnessCommitmentHeader starts the coinbase output committing to the witness merkle root (BIP141)
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// ErrBadMerkleRoot when a block header's merkle root does not match its transactions
+var ErrBadMerkleRoot = errors.New("Merkle root does not match the block's transactions")
+// ErrMutatedMerkleTree when a block's transaction list repeats hashes so another list has the same root (CVE-2012-2459)
+var ErrMutatedMerkleTree = errors.New("Duplicate transactions in merkle tree")
+// ErrBadWitnessCommitment when the coinbase witness commitment is missing or does not match the block's witnesses
+var ErrBadWitnessCommitment = errors.New("Witness commitment does not match the block's witnesses")
+// ErrNoCoinbase when a block's first transaction is not a coinbase
+var ErrNoCoinbase = errors.New("First transaction is not a coinbase")
+
+// MerkleRoot hashes pairs of hashes level by level, duplicating the last of an odd level, mutated reports whether equal siblings let a different list give the same root
+func MerkleRoot(hashes [][]byte) (root []byte, mutated bool) {
+	if len(hashes) == 0 {
+		return make([]byte, 32), false
+	}
+
+	level := make([][]byte, len(hashes))
+	copy(level, hashes)
+	pair := make([]byte, 64)
+	for len(level) > 1 {
+		for i := 0; i + 1 < len(level); i += 2 {
+			if bytes.Equal(level[i], level[i+1]) {
+				mutated = true
+			}
+		}
+		if len(level) % 2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+
+		next := make([][]byte, len(level) / 2)
+		for i := range next {
+			copy(pair[:32], level[2*i])
+			copy(pair[32:], level[2*i+1])
+			next[i] = cryptography.Hash256(pair)
+		}
+		level = next
+	}
+	return level[0], mutated
+}
+
+// MerkleRoot of the block's transaction ids, as its header should commit to
+func (block Block) MerkleRoot() ([]byte, bool) {
+	ids := make([][]byte, len(block.txs))
+	for i, tx := range block.txs {
+		ids[i] = tx.ID()
+	}
+	return MerkleRoot(ids)
+}
+
+// WitnessMerkleRoot of the block's witness transaction ids, the coinbase counting as all zeros
+func (block Block) WitnessMerkleRoot() []byte {
+	ids := make([][]byte, len(block.txs))
+	for i, tx := range block.txs {
+		if i == 0 {
+			ids[i] = make([]byte, 32)
+		} else {
+			ids[i] = tx.WitnessID()
+		}
+	}
+	root, _ := MerkleRoot(ids)
+	return root
+}
+
+// WitnessCommitment is the 32 byte commitment in the coinbase's last output starting with the BIP141 header, nil if there is none
+func (block Block) WitnessCommitment() []byte {
+	if len(block.txs) == 0 {
+		return nil
+	}
+	outs := block.txs[0].txOut
+	for i := len(outs) - 1; i >= 0; i-- {
+		lock := outs[i].scriptPubKey
+		if len(lock) >= 38 && bytes.HasPrefix(lock, witnessCommitmentHeader) {
+			return lock[6:38]
+		}
+	}
+	return nil
+}
+
+// CheckMerkleRoot checks the header's merkle root matches the transactions and the list is not mutated
+func (block Block) CheckMerkleRoot() error {
+	root, mutated := block.MerkleRoot()
+	if !bytes.Equal(root, block.Header.MerkleRoot) {
+		return ErrBadMerkleRoot
+	}
+	if mutated {
+		return ErrMutatedMerkleTree
+	}
+	return nil
+}
+
+// CheckWitnessCommitment checks a block with witness data commits to it, Hash256(witness root || coinbase witness reserved value), the commitment being in a coinbase
+func (block Block) CheckWitnessCommitment() error {
+	commitment := block.WitnessCommitment()
+	if commitment == nil {
+		for _, tx := range block.txs {
+			if tx.HasWitness() {
+				return ErrBadWitnessCommitment
+			}
+		}
+		return nil
+	}
+
+	if !block.txs[0].IsCoinbase() {
+		return ErrNoCoinbase
+	}
+	reserved := block.txs[0].txIn[0].witness
+	if len(reserved) != 1 || len(reserved[0]) != 32 {
+		return ErrBadWitnessCommitment
+	}
+	expected := cryptography.Hash256(append(block.WitnessMerkleRoot(), reserved[0]...))
+	if !bytes.Equal(commitment, expected) {
+		return ErrBadWitnessCommitment
+	}
+	return nil
+}
+
+// Validate checks the block starts with a coinbase and its header and coinbase commit to its transactions and witnesses
+func (block Block) Validate() error {
+	if len(block.txs) == 0 || !block.txs[0].IsCoinbase() {
+		return ErrNoCoinbase
+	}
+	if err := block.CheckMerkleRoot(); err != nil {
+		return err
+	}
+	return block.CheckWitnessCommitment()
+}
@@ -0,0 +1,314 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/harveynw/blokechain/internal/cryptography"
+)
+
+// ErrTransactionNotFound when a proof is requested for a transaction not in the block
+var ErrTransactionNotFound = errors.New("Transaction not in block")
+// ErrInvalidMerkleProof when a partial merkle tree or branch is malformed or does not lead to the header's merkle root
+var ErrInvalidMerkleProof = errors.New("Invalid merkle proof")
+
+// MerkleProof is a BIP37 merkleblock, a block header with the partial merkle tree proving which of its transactions matched
+type MerkleProof struct {
+	Header *BlockHeader
+	Transactions uint32 // Number of transactions in the block
+	Hashes [][]byte // Depth first, internal byte order
+	Flags []byte // One bit per node visited, least significant bit first
+}
+
+// MerkleBranch proves one transaction is in a block with the sibling hash at each level, from the leaves up
+type MerkleBranch struct {
+	TxID []byte
+	Index uint32 // Position in the block, which side each sibling is on
+	Transactions uint32 // Number of transactions in the block, which fixes the branch length
+	Branch [][]byte
+}
+
+// BuildMerkleProof makes a partial merkle tree of the block matching txids, each of which must be in the block
+func BuildMerkleProof(block Block, txids [][]byte) (MerkleProof, error) {
+	ids := make([][]byte, len(block.txs))
+	matches := make([]bool, len(block.txs))
+	for i, tx := range block.txs {
+		ids[i] = tx.ID()
+	}
+	for _, txid := range txids {
+		found := false
+		for i, id := range ids {
+			if bytes.Equal(id, txid) {
+				matches[i], found = true, true
+			}
+		}
+		if !found {
+			return MerkleProof{}, ErrTransactionNotFound
+		}
+	}
+
+	tree := partialTree{n: len(ids), hashes: make([][]byte, 0)}
+	tree.build(treeHeight(len(ids)), 0, ids, matches)
+	return MerkleProof{Header: block.Header, Transactions: uint32(len(ids)), Hashes: tree.hashes, Flags: packBits(tree.bits)}, nil
+}
+
+// VerifyMerkleProof checks the proof's partial merkle tree leads to header's merkle root and returns the matched txids, header is the one the caller trusts, not necessarily the proof's own
+func VerifyMerkleProof(header *BlockHeader, proof MerkleProof) ([][]byte, error) {
+	n := int(proof.Transactions)
+	if n == 0 || n > MaxBlockSize / minTransactionSize || len(proof.Hashes) > n || len(proof.Flags) * 8 < len(proof.Hashes) {
+		return nil, ErrInvalidMerkleProof
+	}
+	for _, hash := range proof.Hashes {
+		if len(hash) != 32 {
+			return nil, ErrInvalidMerkleProof
+		}
+	}
+
+	tree := partialTree{n: n, hashes: proof.Hashes, bits: unpackBits(proof.Flags), matched: make([][]byte, 0)}
+	root := tree.extract(treeHeight(n), 0)
+	if tree.bad || tree.hashUsed != len(tree.hashes) || (tree.bitUsed + 7) / 8 != len(proof.Flags) {
+		return nil, ErrInvalidMerkleProof
+	}
+	if !bytes.Equal(root, header.MerkleRoot) {
+		return nil, ErrInvalidMerkleProof
+	}
+	return tree.matched, nil
+}
+
+// Encode serializes the proof as a merkleblock message payload
+func (proof MerkleProof) Encode() []byte {
+	enc := append(proof.Header.Encode(), encodeUint32(proof.Transactions)...)
+	enc = append(enc, NewVarInt(len(proof.Hashes)).EncodeVarInt()...)
+	for _, hash := range proof.Hashes {
+		enc = append(enc, hash...)
+	}
+	enc = append(enc, NewVarInt(len(proof.Flags)).EncodeVarInt()...)
+	return append(enc, proof.Flags...)
+}
+
+// DecodeNextMerkleProof recovers a merkleblock message payload and returns rest of data
+func DecodeNextMerkleProof(b []byte) (MerkleProof, []byte, error) {
+	header, rest, err := DecodeNextBlockHeader(b)
+	if err != nil {
+		return MerkleProof{}, b, err
+	}
+	if len(rest) < 4 {
+		return MerkleProof{}, b, ErrUnexpectedEnd
+	}
+	transactions, rest := decodeUint32(rest[0:4]), rest[4:]
+
+	count, rest, err := decodeNextCount(rest, 32)
+	if err != nil {
+		return MerkleProof{}, b, err
+	}
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		hashes[i], rest = rest[0:32], rest[32:]
+	}
+	flags, rest, err := decodeNextBytes(rest)
+	if err != nil {
+		return MerkleProof{}, b, err
+	}
+	return MerkleProof{Header: &header, Transactions: transactions, Hashes: hashes, Flags: flags}, rest, nil
+}
+
+// BuildMerkleBranch proves a single transaction is in the block
+func BuildMerkleBranch(block Block, txid []byte) (MerkleBranch, error) {
+	level := make([][]byte, len(block.txs))
+	index := -1
+	for i, tx := range block.txs {
+		level[i] = tx.ID()
+		if index == -1 && bytes.Equal(level[i], txid) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return MerkleBranch{}, ErrTransactionNotFound
+	}
+
+	branch := MerkleBranch{TxID: append([]byte{}, txid...), Index: uint32(index), Transactions: uint32(len(level)), Branch: make([][]byte, 0)}
+	for pos := index; len(level) > 1; pos /= 2 {
+		if len(level) % 2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		branch.Branch = append(branch.Branch, level[pos^1])
+
+		next := make([][]byte, len(level) / 2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return branch, nil
+}
+
+// Root is the merkle root the branch leads to
+func (branch MerkleBranch) Root() []byte {
+	hash, pos := branch.TxID, branch.Index
+	for _, sibling := range branch.Branch {
+		if pos & 1 == 1 {
+			hash = hashPair(sibling, hash)
+		} else {
+			hash = hashPair(hash, sibling)
+		}
+		pos >>= 1
+	}
+	return hash
+}
+
+// VerifyMerkleBranch checks the branch leads to header's merkle root, from a leaf of a tree the height of the block's transaction count
+func VerifyMerkleBranch(header *BlockHeader, branch MerkleBranch) error {
+	// A short branch would pass an inner node off as a txid, and an index past the last leaf its duplicate
+	n := int(branch.Transactions)
+	if len(branch.TxID) != 32 || n == 0 || n > MaxBlockSize / minTransactionSize || int(branch.Index) >= n || len(branch.Branch) != treeHeight(n) {
+		return ErrInvalidMerkleProof
+	}
+	for _, sibling := range branch.Branch {
+		if len(sibling) != 32 {
+			return ErrInvalidMerkleProof
+		}
+	}
+	if !bytes.Equal(branch.Root(), header.MerkleRoot) {
+		return ErrInvalidMerkleProof
+	}
+	return nil
+}
+
+// Encode serializes the branch as txid, index, transaction count and the sibling hashes
+func (branch MerkleBranch) Encode() []byte {
+	enc := append(append([]byte{}, branch.TxID...), encodeUint32(branch.Index)...)
+	enc = append(enc, encodeUint32(branch.Transactions)...)
+	enc = append(enc, NewVarInt(len(branch.Branch)).EncodeVarInt()...)
+	for _, hash := range branch.Branch {
+		enc = append(enc, hash...)
+	}
+	return enc
+}
+
+// DecodeNextMerkleBranch recovers a branch and returns rest of data
+func DecodeNextMerkleBranch(b []byte) (MerkleBranch, []byte, error) {
+	if len(b) < 40 {
+		return MerkleBranch{}, b, ErrUnexpectedEnd
+	}
+	txid, index, transactions := b[0:32], decodeUint32(b[32:36]), decodeUint32(b[36:40])
+	count, rest, err := decodeNextCount(b[40:], 32)
+	if err != nil {
+		return MerkleBranch{}, b, err
+	}
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		hashes[i], rest = rest[0:32], rest[32:]
+	}
+	return MerkleBranch{TxID: txid, Index: index, Transactions: transactions, Branch: hashes}, rest, nil
+}
+
+// partialTree walks a BIP37 partial merkle tree depth first, building or extracting its hashes and flag bits
+type partialTree struct {
+	n int
+	hashes [][]byte
+	bits []bool
+	hashUsed, bitUsed int
+	matched [][]byte
+	bad bool
+}
+
+// width of the tree at height, height 0 being the transactions
+func (tree *partialTree) width(height int) int {
+	return (tree.n + (1 << uint(height)) - 1) >> uint(height)
+}
+
+// nodeHash computes the hash of a node from the full list of txids
+func (tree *partialTree) nodeHash(height, pos int, ids [][]byte) []byte {
+	if height == 0 {
+		return ids[pos]
+	}
+	left := tree.nodeHash(height-1, pos*2, ids)
+	right := left
+	if pos*2+1 < tree.width(height-1) {
+		right = tree.nodeHash(height-1, pos*2+1, ids)
+	}
+	return hashPair(left, right)
+}
+
+func (tree *partialTree) build(height, pos int, ids [][]byte, matches []bool) {
+	// Flag whether any transaction below this node matched
+	parentOfMatch := false
+	for p := pos << uint(height); p < (pos + 1) << uint(height) && p < tree.n; p++ {
+		parentOfMatch = parentOfMatch || matches[p]
+	}
+	tree.bits = append(tree.bits, parentOfMatch)
+
+	if height == 0 || !parentOfMatch {
+		tree.hashes = append(tree.hashes, tree.nodeHash(height, pos, ids))
+		return
+	}
+	tree.build(height-1, pos*2, ids, matches)
+	if pos*2+1 < tree.width(height-1) {
+		tree.build(height-1, pos*2+1, ids, matches)
+	}
+}
+
+func (tree *partialTree) extract(height, pos int) []byte {
+	if tree.bad || tree.bitUsed >= len(tree.bits) {
+		tree.bad = true
+		return nil
+	}
+	parentOfMatch := tree.bits[tree.bitUsed]
+	tree.bitUsed++
+
+	if height == 0 || !parentOfMatch {
+		if tree.hashUsed >= len(tree.hashes) {
+			tree.bad = true
+			return nil
+		}
+		hash := tree.hashes[tree.hashUsed]
+		tree.hashUsed++
+		if height == 0 && parentOfMatch {
+			tree.matched = append(tree.matched, hash)
+		}
+		return hash
+	}
+
+	left := tree.extract(height-1, pos*2)
+	right := left
+	if pos*2+1 < tree.width(height-1) {
+		right = tree.extract(height-1, pos*2+1)
+		// Identical siblings would let a different transaction list prove the same root (CVE-2012-2459)
+		if bytes.Equal(left, right) {
+			tree.bad = true
+		}
+	}
+	if tree.bad {
+		return nil
+	}
+	return hashPair(left, right)
+}
+
+func treeHeight(n int) int {
+	height := 0
+	for (n + (1 << uint(height)) - 1) >> uint(height) > 1 {
+		height++
+	}
+	return height
+}
+
+func hashPair(left, right []byte) []byte {
+	return cryptography.Hash256(append(append(make([]byte, 0, 64), left...), right...))
+}
+
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits) + 7) / 8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << uint(i % 8)
+		}
+	}
+	return packed
+}
+
+func unpackBits(packed []byte) []bool {
+	bits := make([]bool, len(packed) * 8)
+	for i := range bits {
+		bits[i] = packed[i/8] & (1 << uint(i % 8)) != 0
+	}
+	return bits
+}
@@ -0,0 +1,95 @@
+package chain
+
+import (
+	"errors"
+	"math/big"
+	"time"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// ErrMissingHeader when the headers given do not reach back as far as a retarget needs
+var ErrMissingHeader = errors.New("Not enough previous headers to compute the difficulty")
+
+// NextWorkRequired is the difficulty of the block after prevHeaders, which run from genesis to the tip so prevHeaders[h] is at height h, blockTime is the new block's timestamp (only used by min-difficulty networks)
+func NextWorkRequired(prevHeaders []*BlockHeader, blockTime uint32, params *chainparams.Params) (Difficulty, error) {
+	tipHeight := int32(len(prevHeaders)) - 1
+	return nextWorkRequired(tipHeight, func(height int32) *BlockHeader {
+		if height < 0 || height > tipHeight {
+			return nil
+		}
+		return prevHeaders[height]
+	}, blockTime, params)
+}
+
+// nextWorkRequired follows Bitcoin Core's GetNextWorkRequired, ancestor gives the header at a height of the tip's chain
+func nextWorkRequired(tipHeight int32, ancestor func(int32) *BlockHeader, blockTime uint32, params *chainparams.Params) (Difficulty, error) {
+	powLimit := newDifficulty(params.PowLimit()).Compact()
+	tip := ancestor(tipHeight)
+	if tip == nil {
+		if tipHeight < 0 {
+			return powLimit, nil // Genesis
+		}
+		return Difficulty{}, ErrMissingHeader
+	}
+
+	interval := int32(params.RetargetInterval)
+	if (tipHeight + 1) % interval != 0 {
+		if !params.ReduceMinDifficulty {
+			return tip.DifficultyTarget, nil
+		}
+
+		// A block more than MinDiffReductionTime after the tip may be mined at the minimum difficulty
+		if int64(blockTime) > int64(tip.Time) + int64(params.MinDiffReductionTime / time.Second) {
+			return powLimit, nil
+		}
+
+		// Otherwise the difficulty of the last block that was not one of those
+		height, header := tipHeight, tip
+		for height % interval != 0 && header.Bits() == params.PowLimitBits {
+			height--
+			if header = ancestor(height); header == nil {
+				return Difficulty{}, ErrMissingHeader
+			}
+		}
+		return header.DifficultyTarget, nil
+	}
+
+	if params.NoRetargeting {
+		return tip.DifficultyTarget, nil
+	}
+
+	// The period's first block, one too late as in the original client, so a retarget spans interval - 1 blocks
+	first := ancestor(tipHeight - (interval - 1))
+	if first == nil {
+		return Difficulty{}, ErrMissingHeader
+	}
+	return retarget(tip.DifficultyTarget, first.Time, tip.Time, params), nil
+}
+
+// ChainWork is the total work of headers, the chain with the most being the best
+func ChainWork(headers []*BlockHeader) *big.Int {
+	work := new(big.Int)
+	for _, header := range headers {
+		work.Add(work, header.DifficultyTarget.Work())
+	}
+	return work
+}
+
+// retarget scales the target by how long the period took against TargetTimespan, at most by a factor of 4 either way and never easier than PowLimit
+func retarget(last Difficulty, firstTime, lastTime uint32, params *chainparams.Params) Difficulty {
+	timespan := int64(params.TargetTimespan / time.Second)
+	actual := int64(lastTime) - int64(firstTime)
+	if actual < timespan / 4 {
+		actual = timespan / 4
+	}
+	if actual > timespan * 4 {
+		actual = timespan * 4
+	}
+
+	target := new(big.Int).Mul(last.target, big.NewInt(actual))
+	target.Div(target, big.NewInt(timespan))
+	if target.Cmp(params.PowLimit()) > 0 {
+		target.Set(params.PowLimit())
+	}
+	return newDifficulty(target).Compact()
+}
@@ -0,0 +1,399 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// MaxBlockSize bounds any single serialized block, so streamed counts and lengths are capped without knowing how much data is left
+const MaxBlockSize = 4000000
+
+// maxPrealloc is the most items allocated up front for a streamed count, longer lists grow as their items arrive
+const maxPrealloc = 1024
+
+// encoder writes wire types to a stream, keeping the first error
+type encoder struct {
+	w io.Writer
+	scratch [9]byte
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uint32(i uint32) {
+	binary.LittleEndian.PutUint32(e.scratch[:4], i)
+	e.write(e.scratch[:4])
+}
+
+func (e *encoder) uint64(i uint64) {
+	binary.LittleEndian.PutUint64(e.scratch[:8], i)
+	e.write(e.scratch[:8])
+}
+
+func (e *encoder) varInt(i int) {
+	n := varIntSize(i)
+	switch n {
+	case 1:
+		e.scratch[0] = byte(i)
+	case 3:
+		e.scratch[0] = 0xfd
+	case 5:
+		e.scratch[0] = 0xfe
+	default:
+		e.scratch[0] = 0xff
+	}
+	if n > 1 {
+		binary.LittleEndian.PutUint64(e.scratch[1:9], uint64(i))
+	}
+	e.write(e.scratch[:n])
+}
+
+func (e *encoder) varBytes(b []byte) {
+	e.varInt(len(b))
+	e.write(b)
+}
+
+// decoder reads wire types from a stream, keeping the first error
+type decoder struct {
+	r io.Reader
+	scratch [8]byte
+	read int
+	err error
+}
+
+// fill reads exactly len(b) bytes, a stream ending before the first byte gives io.EOF and one ending part way ErrUnexpectedEnd
+func (d *decoder) fill(b []byte) {
+	if d.err != nil {
+		return
+	}
+	n, err := io.ReadFull(d.r, b)
+	d.read += n
+	switch {
+	case err == io.EOF && d.read == 0:
+		d.err = io.EOF
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.err = ErrUnexpectedEnd
+	default:
+		d.err = err
+	}
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) byte() byte {
+	d.fill(d.scratch[:1])
+	return d.scratch[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	d.fill(d.scratch[:4])
+	return binary.LittleEndian.Uint32(d.scratch[:4])
+}
+
+func (d *decoder) uint64() uint64 {
+	d.fill(d.scratch[:8])
+	return binary.LittleEndian.Uint64(d.scratch[:8])
+}
+
+// varIntFrom reads the rest of a VarInt whose prefix byte has already been read
+func (d *decoder) varIntFrom(prefix byte) uint64 {
+	switch prefix {
+	case 0xfd:
+		d.fill(d.scratch[:2])
+		val := uint64(binary.LittleEndian.Uint16(d.scratch[:2]))
+		if val < 0xfd {
+			d.fail(ErrNonCanonicalVarInt)
+		}
+		return val
+	case 0xfe:
+		val := uint64(d.uint32())
+		if val < 0x10000 {
+			d.fail(ErrNonCanonicalVarInt)
+		}
+		return val
+	case 0xff:
+		val := d.uint64()
+		if val < 0x100000000 {
+			d.fail(ErrNonCanonicalVarInt)
+		}
+		return val
+	}
+	return uint64(prefix)
+}
+
+func (d *decoder) varInt() uint64 {
+	return d.varIntFrom(d.byte())
+}
+
+// count checks a count of items each at least minSize bytes could fit in a block
+func (d *decoder) count(val uint64, minSize int) int {
+	if val > MaxBlockSize / uint64(minSize) {
+		d.fail(ErrCountTooLarge)
+		return 0
+	}
+	return int(val)
+}
+
+func (d *decoder) varBytes() []byte {
+	n := d.count(d.varInt(), 1)
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	d.fill(b)
+	return b
+}
+
+// Serialize writes the transaction as Encode(-1) does, including witness data when present
+func (ts Transaction) Serialize(w io.Writer) error {
+	e := &encoder{w: w}
+	ts.serialize(e, ts.HasWitness())
+	return e.err
+}
+
+func (ts Transaction) serialize(e *encoder, withWitness bool) {
+	e.uint32(uint32(ts.version))
+	if withWitness {
+		e.scratch[0], e.scratch[1] = 0x00, 0x01
+		e.write(e.scratch[:2])
+	}
+
+	e.varInt(len(ts.txIn))
+	for _, in := range ts.txIn {
+		e.write(in.prevTransaction)
+		e.uint32(uint32(in.prevIndex))
+		e.varBytes(in.scriptSig)
+		e.uint32(in.sequence)
+	}
+
+	e.varInt(len(ts.txOut))
+	for _, out := range ts.txOut {
+		e.uint64(out.amount)
+		e.varBytes(out.scriptPubKey)
+	}
+
+	if withWitness {
+		for _, in := range ts.txIn {
+			e.varInt(len(in.witness))
+			for _, item := range in.witness {
+				e.varBytes(item)
+			}
+		}
+	}
+
+	e.uint32(uint32(ts.lock_time.t))
+}
+
+// Deserialize reads a transaction from r, accepting exactly what DecodeNextTransaction does
+func (ts *Transaction) Deserialize(r io.Reader) error {
+	d := &decoder{r: r}
+	ts.deserialize(d)
+	return d.err
+}
+
+func (ts *Transaction) deserialize(d *decoder) {
+	version := d.uint32()
+
+	// Marker and flag, otherwise the zero was the input count and the next byte starts the output count
+	inputCounter, isSegwit := d.varInt(), false
+	var outputPrefix byte
+	if inputCounter == 0 && d.err == nil {
+		if outputPrefix = d.byte(); outputPrefix == 0x01 {
+			isSegwit, inputCounter = true, d.varInt()
+		}
+	}
+
+	n := d.count(inputCounter, minInputSize)
+	txIn := make([]TransactionInput, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		var in TransactionInput
+		in.prevTransaction = make([]byte, 32)
+		d.fill(in.prevTransaction)
+		in.prevIndex = int64(d.uint32())
+		in.scriptSig = d.varBytes()
+		in.sequence = d.uint32()
+		txIn = append(txIn, in)
+	}
+
+	var outputCounter uint64
+	if inputCounter == 0 && !isSegwit {
+		outputCounter = d.varIntFrom(outputPrefix)
+	} else {
+		outputCounter = d.varInt()
+	}
+	n = d.count(outputCounter, minOutputSize)
+	txOut := make([]TransactionOutput, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		var out TransactionOutput
+		if out.amount = d.uint64(); out.amount > MaxMoney {
+			d.fail(ErrInvalidAmount)
+		}
+		out.scriptPubKey = d.varBytes()
+		txOut = append(txOut, out)
+	}
+
+	if isSegwit {
+		hasWitness := false
+		for i := range txIn {
+			items := d.count(d.varInt(), 1)
+			if d.err != nil {
+				break
+			}
+			witness := make([][]byte, 0, min(items, maxPrealloc))
+			for j := 0; j < items && d.err == nil; j++ {
+				witness = append(witness, d.varBytes())
+			}
+			txIn[i].witness = witness
+			hasWitness = hasWitness || items > 0
+		}
+		if !hasWitness {
+			d.fail(ErrSuperfluousWitness)
+		}
+	}
+
+	lock_time := NewLocktime(int(int32(d.uint32())))
+	if d.err != nil {
+		return
+	}
+	*ts = Transaction{version: int32(version), txIn: txIn, txOut: txOut, lock_time: lock_time}
+}
+
+// SerializeSize is the length Serialize writes, computed without encoding
+func (ts Transaction) SerializeSize() int {
+	return ts.serializeSize(ts.HasWitness())
+}
+
+func (ts Transaction) serializeSize(withWitness bool) int {
+	size := 4 + varIntSize(len(ts.txIn)) + varIntSize(len(ts.txOut)) + 4
+	for _, in := range ts.txIn {
+		size += 32 + 4 + varBytesSize(in.scriptSig) + 4
+	}
+	for _, out := range ts.txOut {
+		size += 8 + varBytesSize(out.scriptPubKey)
+	}
+	if withWitness {
+		size += 2
+		for _, in := range ts.txIn {
+			size += varIntSize(len(in.witness))
+			for _, item := range in.witness {
+				size += varBytesSize(item)
+			}
+		}
+	}
+	return size
+}
+
+// hash256 is the double SHA256 of the transaction as serialized, without an intermediate buffer
+func (ts Transaction) hash256(withWitness bool) []byte {
+	h := sha256.New()
+	ts.serialize(&encoder{w: h}, withWitness)
+	first := h.Sum(nil)
+	second := sha256.Sum256(first)
+	return second[:]
+}
+
+// Serialize writes the 80 byte header, ErrInvalidHeaderHash if a hash is not 32 bytes
+func (bh BlockHeader) Serialize(w io.Writer) error {
+	if err := bh.checkHashes(); err != nil {
+		return err
+	}
+	_, err := w.Write(bh.Encode())
+	return err
+}
+
+// Deserialize reads an 80 byte header from r
+func (bh *BlockHeader) Deserialize(r io.Reader) error {
+	d := &decoder{r: r}
+	bh.deserialize(d)
+	return d.err
+}
+
+func (bh *BlockHeader) deserialize(d *decoder) {
+	b := make([]byte, BlockHeaderSize)
+	d.fill(b)
+	if d.err != nil {
+		return
+	}
+	header, _, err := DecodeNextBlockHeader(b)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	*bh = header
+}
+
+// SerializeSize of a header is fixed
+func (bh BlockHeader) SerializeSize() int {
+	return BlockHeaderSize
+}
+
+// Serialize writes the block as peers send it, without the magic no and blocksize Encode adds
+func (block Block) Serialize(w io.Writer) error {
+	if err := block.Header.checkHashes(); err != nil {
+		return err
+	}
+	e := &encoder{w: w}
+	e.write(block.Header.Encode())
+	e.varInt(len(block.txs))
+	for _, tx := range block.txs {
+		tx.serialize(e, tx.HasWitness())
+	}
+	return e.err
+}
+
+// Deserialize reads a block from r, as DecodeBlockData does
+func (block *Block) Deserialize(r io.Reader) error {
+	d := &decoder{r: r}
+	var header BlockHeader
+	header.deserialize(d)
+
+	n := d.count(d.varInt(), minTransactionSize)
+	txs := make([]Transaction, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		var tx Transaction
+		tx.deserialize(d)
+		txs = append(txs, tx)
+	}
+	if d.err == io.EOF && d.read > 0 {
+		d.err = ErrUnexpectedEnd
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*block = Block{Header: &header, txs: txs}
+	return nil
+}
+
+// SerializeSize is the length Serialize writes, computed without encoding
+func (block Block) SerializeSize() int {
+	size := BlockHeaderSize + varIntSize(len(block.txs))
+	for _, tx := range block.txs {
+		size += tx.SerializeSize()
+	}
+	return size
+}
+
+func varIntSize(i int) int {
+	switch {
+	case i < 0xfd:
+		return 1
+	case i < 0x10000:
+		return 3
+	case uint64(i) < 0x100000000:
+		return 5
+	}
+	return 9
+}
+
+func varBytesSize(b []byte) int {
+	return varIntSize(len(b)) + len(b)
+}
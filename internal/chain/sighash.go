@@ -0,0 +1,80 @@
+package chain
+
+import (
+	"github.com/harveynw/blokechain/internal/cryptography"
+)
+
+// SigHashAll signs every input and output, the only hash type produced here
+const SigHashAll byte = 0x01
+// SigHashDefault is the taproot equivalent of SigHashAll, implied by a 64 byte signature
+const SigHashDefault byte = 0x00
+
+// LegacySigHashPreimage is the data signed for a pre-segwit input, with scriptCode (the locking or redeem script) in place of its scriptSig
+func (ts Transaction) LegacySigHashPreimage(index int, scriptCode []byte) []byte {
+	txIn := make([]TransactionInput, len(ts.txIn))
+	for i, in := range ts.txIn {
+		in.scriptSig = []byte{}
+		if i == index {
+			in.scriptSig = scriptCode
+		}
+		txIn[i] = in
+	}
+	ts.txIn = txIn
+
+	return append(ts.encode(-1, false), encodeUint32(uint32(SigHashAll))...)
+}
+
+// WitnessV0SigHashPreimage is the BIP143 data signed for a segwit version 0 input
+func (ts Transaction) WitnessV0SigHashPreimage(index int, scriptCode []byte) []byte {
+	prevouts, sequences, outputs := make([]byte, 0), make([]byte, 0), make([]byte, 0)
+	for _, in := range ts.txIn {
+		prevouts = append(prevouts, in.encodeOutpoint()...)
+		sequences = append(sequences, encodeUint32(in.sequence)...)
+	}
+	for _, out := range ts.txOut {
+		outputs = append(outputs, out.Encode()...)
+	}
+	in := ts.txIn[index]
+
+	enc := make([]byte, 0, 4 + 32 * 3 + 36 + len(scriptCode) + 9 + 8 + 4 + 4 + 4)
+	enc = append(enc, encodeUint32(uint32(ts.version))...)
+	enc = append(enc, cryptography.Hash256(prevouts)...)
+	enc = append(enc, cryptography.Hash256(sequences)...)
+	enc = append(enc, in.encodeOutpoint()...)
+	enc = append(enc, NewVarInt(len(scriptCode)).EncodeVarInt()...)
+	enc = append(enc, scriptCode...)
+	enc = append(enc, encodeAmount(in.prevAmount)...)
+	enc = append(enc, encodeUint32(in.sequence)...)
+	enc = append(enc, cryptography.Hash256(outputs)...)
+	enc = append(enc, ts.lock_time.Encode()...)
+	enc = append(enc, encodeUint32(uint32(SigHashAll))...)
+	return enc
+}
+
+// TaprootSigHash is the BIP341 digest signed for a taproot key path spend, hashType is SigHashDefault or SigHashAll
+func (ts Transaction) TaprootSigHash(index int, hashType byte) []byte {
+	prevouts, amounts, scriptPubKeys, sequences, outputs := make([]byte, 0), make([]byte, 0), make([]byte, 0), make([]byte, 0), make([]byte, 0)
+	for _, in := range ts.txIn {
+		prevouts = append(prevouts, in.encodeOutpoint()...)
+		amounts = append(amounts, encodeAmount(in.prevAmount)...)
+		scriptPubKeys = append(scriptPubKeys, NewVarInt(len(in.prevTransactionPubKey)).EncodeVarInt()...)
+		scriptPubKeys = append(scriptPubKeys, in.prevTransactionPubKey...)
+		sequences = append(sequences, encodeUint32(in.sequence)...)
+	}
+	for _, out := range ts.txOut {
+		outputs = append(outputs, out.Encode()...)
+	}
+
+	enc := make([]byte, 0, 2 + 4 + 4 + 32 * 5 + 1 + 4)
+	enc = append(enc, 0x00, hashType) // Epoch, hash type
+	enc = append(enc, encodeUint32(uint32(ts.version))...)
+	enc = append(enc, ts.lock_time.Encode()...)
+	enc = append(enc, cryptography.SHA256(prevouts)...)
+	enc = append(enc, cryptography.SHA256(amounts)...)
+	enc = append(enc, cryptography.SHA256(scriptPubKeys)...)
+	enc = append(enc, cryptography.SHA256(sequences)...)
+	enc = append(enc, cryptography.SHA256(outputs)...)
+	enc = append(enc, 0x00) // Key path, no annex
+	enc = append(enc, encodeUint32(uint32(index))...)
+	return cryptography.TaggedHash("TapSighash", enc)
+}
@@ -2,15 +2,25 @@ package chain
 
 import (
 	"bytes"
-	"github.com/harveynw/blokechain/internal/cryptography"
+	"errors"
 )
 
+// Smallest serialized input (outpoint, empty scriptSig, sequence) and output (amount, empty script), bounding counts against the data left
+const minInputSize = 32 + 4 + 1 + 4
+const minOutputSize = 8 + 1
+// MaxMoney is the most satoshis that will ever exist, no output may hold more
+const MaxMoney uint64 = 21000000 * 100000000
+
+// ErrSuperfluousWitness when a transaction is marked segwit but every witness is empty
+var ErrSuperfluousWitness = errors.New("Segwit marker present without witness data")
+// ErrInvalidAmount when an output holds more than MaxMoney
+var ErrInvalidAmount = errors.New("Output amount out of range")
+
 // Transaction data structure containing multiple inputs and outputs
 type Transaction struct {
-	isSegwit bool
+	version int32
 	txIn []TransactionInput
 	txOut []TransactionOutput
-	Witnesses []byte // todo
 	lock_time Locktime
 }
 
@@ -19,7 +29,10 @@ type TransactionInput struct {
 	prevTransaction []byte // Transaction hash containing UXTO
 	prevIndex int64 // Select UXTO by index
 	prevTransactionPubKey []byte // Previous script pubkey, needed for signature generation
+	prevAmount uint64 // Satoshis held by the UXTO, needed for segwit signature generation
 	scriptSig []byte
+	sequence uint32
+	witness [][]byte // Segwit unlocking data, not part of the transaction id
 }
 
 // TransactionOutput data structure specifying spent coins and locking script
@@ -28,20 +41,64 @@ type TransactionOutput struct {
 	scriptPubKey []byte // Unlocking script
 }
 
-// ID returns the transaction id SHA256(SHA256(transaction))
+// ID returns the transaction id SHA256(SHA256(transaction)), which excludes witness data
 func(ts Transaction) ID() []byte {
-	return cryptography.Hash256(ts.Encode(-1))
+	return ts.hash256(false)
+}
+
+// WitnessID returns the hash of the transaction including witness data (wtxid)
+func(ts Transaction) WitnessID() []byte {
+	return ts.hash256(ts.HasWitness())
+}
+
+// Weight is three times the size without witness data plus the full size (BIP141)
+func (ts Transaction) Weight() int {
+	return 3 * ts.serializeSize(false) + ts.SerializeSize()
+}
+
+// VSize is the weight in virtual bytes, rounded up, which fees are paid on
+func (ts Transaction) VSize() int {
+	return (ts.Weight() + 3) / 4
+}
+
+// HasWitness reports whether any input carries witness data
+func (ts Transaction) HasWitness() bool {
+	for _, in := range ts.txIn {
+		if len(in.witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Inputs of the transaction
+func (ts Transaction) Inputs() []TransactionInput {
+	return ts.txIn
+}
+
+// Outputs of the transaction
+func (ts Transaction) Outputs() []TransactionOutput {
+	return ts.txOut
+}
+
+// IsCoinbase reports whether the transaction creates new coins, its only input spends no outpoint
+func (ts Transaction) IsCoinbase() bool {
+	return len(ts.txIn) == 1 && ts.txIn[0].prevIndex == 0xFFFFFFFF && bytes.Equal(ts.txIn[0].prevTransaction, make([]byte, 32))
 }
 
 // Encode transaction data structure using the protocol, signingIndex (if not -1) specifies the current input being using for signature generation
 func (ts Transaction) Encode(signingIndex int) []byte {
+	return ts.encode(signingIndex, signingIndex == -1 && ts.HasWitness())
+}
+
+func (ts Transaction) encode(signingIndex int, withWitness bool) []byte {
 	enc := make([]byte, 0)
 
-	// Version, always 1
-	enc = append(enc, 0x00, 0x00, 0x00, 0x01)
+	// Version
+	enc = append(enc, encodeUint32(uint32(ts.version))...)
 
 	// If witness data present, else omitted
-	if ts.isSegwit {
+	if withWitness {
 		enc = append(enc, 0x00, 0x01)
 	}
 
@@ -62,17 +119,18 @@ func (ts Transaction) Encode(signingIndex int) []byte {
 	}
 
 	// Output Counter
-	n_outputs := NewVarInt(len(ts.txIn))
+	n_outputs := NewVarInt(len(ts.txOut))
 	enc = append(enc, n_outputs.EncodeVarInt()...)
 	// Outputs
 	for _, outTx := range ts.txOut {
 		enc = append(enc, outTx.Encode()...)
 	}
 
-	// Witness data
-	if ts.isSegwit {
-		// TODO
-		panic("SegWit not implemented")
+	// Witness data, a stack per input
+	if withWitness {
+		for _, inTx := range ts.txIn {
+			enc = append(enc, encodeWitness(inTx.witness)...)
+		}
 	}
 
 	// Locktime
@@ -81,49 +139,65 @@ func (ts Transaction) Encode(signingIndex int) []byte {
 	return enc
 }
 
-// DecodeTransaction recovers Transaction according to the protocol
-func DecodeNextTransaction(b []byte) (Transaction, []byte) {
-	var version []byte
-	version, b = b[0:4], b[4:]
-	if bytes.Compare(version, []byte{0x00, 0x00, 0x00, 0x01}) != 0 {
-		panic("Incompatible version")
+// DecodeNextTransaction recovers Transaction according to the protocol and returns rest of data
+func DecodeNextTransaction(b []byte) (Transaction, []byte, error) {
+	if len(b) < 4 {
+		return Transaction{}, b, ErrUnexpectedEnd
 	}
+	version, rest := decodeUint32(b[0:4]), b[4:]
 
+	// Marker and flag, a transaction cannot otherwise have zero inputs
 	isSegwit := false
-	if bytes.Compare(b[0:2], []byte{0x00, 0x01}) == 0 {
-		isSegwit, b = true, b[2:]
+	if len(rest) >= 2 && rest[0] == 0x00 && rest[1] == 0x01 {
+		isSegwit, rest = true, rest[2:]
 	}
 
-	inputCounter, b := DecodeNextVarInt(b)
-	txIn := make([]TransactionInput, 0)
-	for i := 0; i < int(inputCounter.val); i++ {
-		var tx TransactionInput
-		tx, b = DecodeNextTransactionInput(b)
-		txIn = append(txIn, tx)
+	inputCounter, rest, err := decodeNextCount(rest, minInputSize)
+	if err != nil {
+		return Transaction{}, b, err
+	}
+	txIn := make([]TransactionInput, inputCounter)
+	for i := range txIn {
+		if txIn[i], rest, err = DecodeNextTransactionInput(rest); err != nil {
+			return Transaction{}, b, err
+		}
 	}
 
-	outputCounter, b := DecodeNextVarInt(b)
-	txOut := make([]TransactionOutput, 0)
-	for i := 0; i < int(outputCounter.val); i++ {
-		var tx TransactionOutput
-		tx, b = DecodeNextTransactionOutput(b)
-		txOut = append(txOut, tx)
+	outputCounter, rest, err := decodeNextCount(rest, minOutputSize)
+	if err != nil {
+		return Transaction{}, b, err
+	}
+	txOut := make([]TransactionOutput, outputCounter)
+	for i := range txOut {
+		if txOut[i], rest, err = DecodeNextTransactionOutput(rest); err != nil {
+			return Transaction{}, b, err
+		}
 	}
 
 	if isSegwit {
-		// TODO Witnesses
-		panic("SegWit not implemented")
+		hasWitness := false
+		for i := range txIn {
+			if txIn[i].witness, rest, err = decodeNextWitness(rest); err != nil {
+				return Transaction{}, b, err
+			}
+			hasWitness = hasWitness || len(txIn[i].witness) > 0
+		}
+		if !hasWitness {
+			return Transaction{}, b, ErrSuperfluousWitness
+		}
 	}
 
-	lock_time := DecodeLocktime(b[0:4])
+	lock_time, rest, err := DecodeLocktime(rest)
+	if err != nil {
+		return Transaction{}, b, err
+	}
 
 	return Transaction{
-		isSegwit: isSegwit,
+		version: int32(version),
 		txIn: txIn,
 		txOut: txOut,
-		Witnesses: nil,
 		lock_time: lock_time,
-	}, b[4:]
+	}, rest, nil
 }
 
 // Encode transaction input using protocol
@@ -135,8 +209,7 @@ func (in TransactionInput) Encode() []byte {
 	}
 
 	// Previous transaction (32 bytes) + Output index (4 bytes)
-	enc = append(enc, in.prevTransaction...)
-	enc = append(enc, EncodeInt(int64(in.prevIndex), 4)...)
+	enc = append(enc, in.encodeOutpoint()...)
 	
 	// Unlocking script size VarInt
 	script_size := NewVarInt(len(in.scriptSig))
@@ -145,12 +218,21 @@ func (in TransactionInput) Encode() []byte {
 	// Unlocking script
 	enc = append(enc, in.scriptSig...)
 
-	// Sequence number (not used)
-	enc = append(enc, 0xFF, 0xFF, 0xFF, 0xFF)
+	// Sequence number
+	enc = append(enc, encodeUint32(in.sequence)...)
 
 	return enc
 }
 
+// PrevOutpoint is the transaction id (internal byte order) and output index the input spends
+func (in TransactionInput) PrevOutpoint() ([]byte, uint32) {
+	return in.prevTransaction, uint32(in.prevIndex)
+}
+
+func (in TransactionInput) encodeOutpoint() []byte {
+	return append(append(make([]byte, 0, 36), in.prevTransaction...), encodeUint32(uint32(in.prevIndex))...)
+}
+
 // EncodeScriptSigOverride encodes the transaction input, replacing the scriptSig with the previous tx pubKey (required for signature verification)
 func (in TransactionInput) EncodeScriptSigOverride() []byte {
 	in.scriptSig = in.prevTransactionPubKey
@@ -164,19 +246,23 @@ func (in TransactionInput) EncodeScriptSigEmpty() []byte {
 }
 
 // DecodeNextTransactionInput recovers TransactionInput according to the protocol and returns rest of data
-func DecodeNextTransactionInput(b []byte) (TransactionInput, []byte) {
+func DecodeNextTransactionInput(b []byte) (TransactionInput, []byte, error) {
+	if len(b) < 36 {
+		return TransactionInput{}, b, ErrUnexpectedEnd
+	}
 	prevTransaction := b[0:32]
-	prevIndex := DecodeInt(b[32:36])
+	prevIndex := int64(decodeUint32(b[32:36]))
 
-	scriptSigSizeVarInt, b := DecodeNextVarInt(b[36:])
-	scriptSigSize := int(scriptSigSizeVarInt.val)
-	scriptSig := b[0:scriptSigSize]
-
-	if len(b[scriptSigSize:]) != 4 || bytes.Compare(b[scriptSigSize:], []byte{0xFF, 0xFF, 0xFF, 0xFF}) != 0 {
-		panic("Expected 4 bytes for sequence_no")
+	scriptSig, rest, err := decodeNextBytes(b[36:])
+	if err != nil {
+		return TransactionInput{}, b, err
+	}
+	if len(rest) < 4 {
+		return TransactionInput{}, b, ErrUnexpectedEnd
 	}
+	sequence := decodeUint32(rest[0:4])
 
-	return TransactionInput{prevTransaction: prevTransaction, prevIndex: prevIndex, scriptSig: scriptSig}, b[scriptSigSize+4:]
+	return TransactionInput{prevTransaction: prevTransaction, prevIndex: prevIndex, scriptSig: scriptSig, sequence: sequence}, rest[4:], nil
 }
 
 // Encode transaction output using protocol
@@ -184,7 +270,7 @@ func (out TransactionOutput) Encode() []byte {
 	enc := make([]byte, 0)
 
 	// Amount in satoshis
-	enc = append(enc, EncodeInt(int64(out.amount), 8)...)
+	enc = append(enc, encodeAmount(out.amount)...)
 
 	// Locking script size
 	script_size := NewVarInt(len(out.scriptPubKey))
@@ -196,11 +282,55 @@ func (out TransactionOutput) Encode() []byte {
 	return enc
 }
 
+// Amount held by the output in satoshis
+func (out TransactionOutput) Amount() uint64 {
+	return out.amount
+}
+
+// ScriptPubKey is the output's locking script
+func (out TransactionOutput) ScriptPubKey() []byte {
+	return out.scriptPubKey
+}
+
 // DecodeNextTransactionOutput recovers TransactionOutput according to the protocol and returns rest of data
-func DecodeNextTransactionOutput(b []byte) (TransactionOutput, []byte) {
-	amount := uint64(DecodeInt(b[0:8]))
-	scriptPubKeySizeVarInt, b := DecodeNextVarInt(b[8:])
-	scriptPubKeySize := int(scriptPubKeySizeVarInt.val)
+func DecodeNextTransactionOutput(b []byte) (TransactionOutput, []byte, error) {
+	if len(b) < 8 {
+		return TransactionOutput{}, b, ErrUnexpectedEnd
+	}
+	amount := decodeUint64(b[0:8])
+	if amount > MaxMoney {
+		return TransactionOutput{}, b, ErrInvalidAmount
+	}
+	scriptPubKey, rest, err := decodeNextBytes(b[8:])
+	if err != nil {
+		return TransactionOutput{}, b, err
+	}
+
+	return TransactionOutput{amount: amount, scriptPubKey: scriptPubKey}, rest, nil
+}
 
-	return TransactionOutput{amount: amount, scriptPubKey: b[0:scriptPubKeySize]}, b[scriptPubKeySize:]
-}
\ No newline at end of file
+// encodeWitness serializes a witness stack as a count followed by length prefixed items
+func encodeWitness(witness [][]byte) []byte {
+	enc := NewVarInt(len(witness)).EncodeVarInt()
+	for _, item := range witness {
+		enc = append(enc, NewVarInt(len(item)).EncodeVarInt()...)
+		enc = append(enc, item...)
+	}
+	return enc
+}
+
+// decodeNextWitness recovers a witness stack and returns the rest of the data
+func decodeNextWitness(b []byte) ([][]byte, []byte, error) {
+	count, rest, err := decodeNextCount(b, 1)
+	if err != nil {
+		return nil, b, err
+	}
+
+	witness := make([][]byte, count)
+	for i := range witness {
+		if witness[i], rest, err = decodeNextBytes(rest); err != nil {
+			return nil, b, err
+		}
+	}
+	return witness, rest, nil
+}
@@ -1,7 +1,9 @@
 package chain
 
 import (
+	"bytes"
 	"errors"
+	"github.com/harveynw/blokechain/internal/cryptography"
 	"github.com/harveynw/blokechain/internal/script"
 )
 
@@ -9,14 +11,15 @@ import (
 var ErrPubKeyMissing = errors.New("Previous transaction public key is missing")
 // ErrScriptSigInvalid When the provided signature does not match the original public key
 var ErrScriptSigInvalid = errors.New("Unlock script failed")
+// ErrWitnessInvalid When the witness of a segwit input does not satisfy its witness program
+var ErrWitnessInvalid = errors.New("Witness failed")
+// ErrUnsupportedScript When an input spends a script type that cannot be verified, such as a taproot script path
+var ErrUnsupportedScript = errors.New("Unsupported locking script")
 
 // Verify by executing the unlock + locking script and checking input >= output
 func (ts Transaction) Verify() (bool, error) {
-	for i, txIn := range ts.txIn {
-		sigEncoding := ts.Encode(i) 
-		valid, err := verifyTransactionInput(sigEncoding, txIn)
-
-		if !(valid && err == nil) {
+	for i := range ts.txIn {
+		if err := ts.VerifyInput(i); err != nil {
 			return false, err
 		}
 	}
@@ -25,18 +28,119 @@ func (ts Transaction) Verify() (bool, error) {
 	return true, nil
 }
 
-func verifyTransactionInput(sigEncoding []byte, txIn TransactionInput) (bool, error) {
-	if len(txIn.prevTransactionPubKey) == 0 {
-		return false, ErrPubKeyMissing
+// VerifyInput checks input i unlocks the output it spends, covering P2PKH, P2SH, segwit v0 and taproot key path spends
+func (ts Transaction) VerifyInput(i int) error {
+	txIn := ts.txIn[i]
+	lock := txIn.prevTransactionPubKey
+	if len(lock) == 0 {
+		return ErrPubKeyMissing
+	}
+
+	if version, program, ok := script.ParseWitnessProgram(lock); ok {
+		if len(txIn.scriptSig) != 0 {
+			return ErrScriptSigInvalid
+		}
+		return ts.verifyWitnessProgram(i, version, program, false)
+	}
+
+	// Unlocking then locking script, sharing one stack
+	vm := script.NewVM(ts.LegacySigHashPreimage(i, lock))
+	if !vm.Run(script.DecodeScript(txIn.scriptSig)) {
+		return ErrScriptSigInvalid
+	}
+	unlocked := append([][]byte{}, vm.Stack...)
+	if !vm.Run(script.DecodeScript(lock)) || !vm.Succeeded() {
+		return ErrScriptSigInvalid
+	}
+
+	if !script.IsP2SH(lock) {
+		return nil
 	}
 
-	unlock, lock := script.DecodeScript(txIn.scriptSig), script.DecodeScript(txIn.prevTransactionPubKey)
-	unlock.Concat(lock)
-	unlock.Print()
-	result := unlock.Execute(sigEncoding)
+	// P2SH, the last push of the scriptSig is the redeem script and runs on the rest
+	if _, pushOnly := script.PushedData(txIn.scriptSig); !pushOnly || len(unlocked) == 0 {
+		return ErrScriptSigInvalid
+	}
+	redeem := unlocked[len(unlocked)-1]
 
-	if result {
-		return true, nil
+	if version, program, ok := script.ParseWitnessProgram(redeem); ok {
+		// Nested segwit, the scriptSig may only push the witness program
+		if len(unlocked) != 1 {
+			return ErrScriptSigInvalid
+		}
+		return ts.verifyWitnessProgram(i, version, program, true)
 	}
-	return false, ErrScriptSigInvalid
-}
\ No newline at end of file
+
+	vm = script.NewVM(ts.LegacySigHashPreimage(i, redeem))
+	vm.Stack = unlocked[:len(unlocked)-1]
+	if !vm.Run(script.DecodeScript(redeem)) || !vm.Succeeded() {
+		return ErrScriptSigInvalid
+	}
+	return nil
+}
+
+func (ts Transaction) verifyWitnessProgram(i int, version byte, program []byte, nested bool) error {
+	witness := copyStack(ts.txIn[i].witness)
+
+	switch {
+	case version == 0 && len(program) == 20:
+		// P2WPKH, the witness is a signature and public key for the implied P2PKH script
+		if len(witness) != 2 {
+			return ErrWitnessInvalid
+		}
+		scriptCode := script.P2PKH(program).Encode()
+		return runWitnessScript(ts.WitnessV0SigHashPreimage(i, scriptCode), scriptCode, witness)
+
+	case version == 0 && len(program) == 32:
+		// P2WSH, the last witness item is the script committed to by the program
+		if len(witness) == 0 {
+			return ErrWitnessInvalid
+		}
+		witnessScript := witness[len(witness)-1]
+		if !bytes.Equal(cryptography.SHA256(witnessScript), program) {
+			return ErrWitnessInvalid
+		}
+		return runWitnessScript(ts.WitnessV0SigHashPreimage(i, witnessScript), witnessScript, witness[:len(witness)-1])
+
+	case version == 1 && len(program) == 32 && !nested:
+		// Taproot, drop the annex if present
+		if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == 0x50 {
+			witness = witness[:len(witness)-1]
+		}
+		if len(witness) != 1 {
+			return ErrUnsupportedScript // Script path
+		}
+
+		sig, hashType := witness[0], SigHashDefault
+		if len(sig) == 65 {
+			sig, hashType = sig[:64], sig[64]
+			if hashType != SigHashAll {
+				return ErrUnsupportedScript
+			}
+		}
+		if !cryptography.SchnorrVerify(program, ts.TaprootSigHash(i, hashType), sig) {
+			return ErrWitnessInvalid
+		}
+		return nil
+	}
+
+	return ErrUnsupportedScript
+}
+
+// runWitnessScript executes a segwit v0 script, which must leave exactly one true value
+func runWitnessScript(preimage, scriptCode []byte, stack [][]byte) error {
+	vm := script.NewVM(preimage)
+	vm.Stack = stack
+	if !vm.Run(script.DecodeScript(scriptCode)) || len(vm.Stack) != 1 || !vm.Succeeded() {
+		return ErrWitnessInvalid
+	}
+	return nil
+}
+
+func copyStack(stack [][]byte) [][]byte {
+	copied := make([][]byte, len(stack))
+	for i, item := range stack {
+		copied[i] = append([]byte{}, item...)
+	}
+	return copied
+}
@@ -0,0 +1,49 @@
+package chainparams
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"mainnet", "testnet", "signet", "regtest"} {
+		params, err := Lookup(name)
+		if err != nil || params.Name != name {
+			t.Errorf("Failed lookup of %s: %v", name, err)
+		}
+	}
+	if _, err := Lookup("litecoin"); err != ErrUnknownNetwork {
+		t.Errorf("Expected unknown network, got %v", err)
+	}
+}
+
+func TestMagicBytes(t *testing.T) {
+	if !bytes.Equal(MainNet().MagicBytes(), []byte{0xf9, 0xbe, 0xb4, 0xd9}) {
+		t.Errorf("Wrong mainnet magic %x", MainNet().MagicBytes())
+	}
+	if !bytes.Equal(RegTest().MagicBytes(), []byte{0xfa, 0xbf, 0xb5, 0xda}) {
+		t.Errorf("Wrong regtest magic %x", RegTest().MagicBytes())
+	}
+}
+
+func TestRetargetInterval(t *testing.T) {
+	for _, params := range []*Params{MainNet(), TestNet(), SigNet(), RegTest()} {
+		if int64(params.TargetTimespan / params.TargetTimePerBlock) != params.RetargetInterval {
+			t.Errorf("%s retarget interval does not match its timespan", params.Name)
+		}
+	}
+}
+
+func TestParamsCopied(t *testing.T) {
+	params := MainNet()
+	params.Name = "changed"
+	params.PowLimit().SetInt64(1)
+	if MainNet().Name != "mainnet" || MainNet().PowLimit().BitLen() != 224 {
+		t.Errorf("Changing one copy of the parameters changed the next")
+	}
+	lookedUp, _ := Lookup("regtest")
+	lookedUp.CoinbaseMaturity = 1
+	if again, _ := Lookup("regtest"); again.CoinbaseMaturity != 100 {
+		t.Errorf("Lookup shares its parameters")
+	}
+}
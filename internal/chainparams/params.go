@@ -0,0 +1,273 @@
+package chainparams
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+// ErrUnknownNetwork when a network name does not match any parameter set
+var ErrUnknownNetwork = errors.New("Unknown network")
+
+// Params bundles everything that distinguishes one Bitcoin network from another
+type Params struct {
+	Name string
+	Net uint32 // Magic bytes, written little-endian on the wire
+	DefaultPort string
+	RPCPort string // Bitcoin Core JSON-RPC
+	CoreDataSubdir string // Where Bitcoin Core keeps this network within its data directory
+
+	// Genesis block header, hash is in display (big-endian) hex
+	GenesisHash string
+	GenesisMerkleRoot string
+	GenesisVersion int32
+	GenesisTime uint32
+	GenesisBits uint32
+	GenesisNonce uint32
+
+	// Proof of work
+	powLimit *big.Int // Shared by every copy, so only read through PowLimit
+	PowLimitBits uint32
+	TargetTimespan time.Duration
+	TargetTimePerBlock time.Duration
+	RetargetInterval int64
+	ReduceMinDifficulty bool // Allow min-difficulty blocks after MinDiffReductionTime without a block
+	MinDiffReductionTime time.Duration
+	NoRetargeting bool
+
+	// BIP activation heights
+	BIP34Height int32
+	BIP65Height int32
+	BIP66Height int32
+	CSVHeight int32
+	SegwitHeight int32
+
+	CoinbaseMaturity int32
+
+	// Address encoding
+	PubKeyHashAddrID byte
+	ScriptHashAddrID byte
+	PrivateKeyID byte
+	Bech32HRPSegwit string
+
+	// BIP32 extended key versions and BIP44 coin type
+	HDPrivateKeyID [4]byte
+	HDPublicKeyID [4]byte
+	HDCoinType uint32
+}
+
+// Shared by every network, the coinbase of the original genesis block is reused
+const genesisMerkleRoot = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+
+// mainNetParams are the parameters of the main Bitcoin network
+var mainNetParams = Params{
+	Name: "mainnet",
+	Net: 0xD9B4BEF9,
+	DefaultPort: "8333",
+	RPCPort: "8332",
+	CoreDataSubdir: "",
+
+	GenesisHash: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+	GenesisMerkleRoot: genesisMerkleRoot,
+	GenesisVersion: 1,
+	GenesisTime: 1231006505,
+	GenesisBits: 0x1d00ffff,
+	GenesisNonce: 2083236893,
+
+	powLimit: parsePowLimit("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits: 0x1d00ffff,
+	TargetTimespan: 14 * 24 * time.Hour,
+	TargetTimePerBlock: 10 * time.Minute,
+	RetargetInterval: 2016,
+
+	BIP34Height: 227931,
+	BIP65Height: 388381,
+	BIP66Height: 363725,
+	CSVHeight: 419328,
+	SegwitHeight: 481824,
+
+	CoinbaseMaturity: 100,
+
+	PubKeyHashAddrID: 0x00,
+	ScriptHashAddrID: 0x05,
+	PrivateKeyID: 0x80,
+	Bech32HRPSegwit: "bc",
+
+	HDPrivateKeyID: [4]byte{0x04, 0x88, 0xad, 0xe4}, // xprv
+	HDPublicKeyID: [4]byte{0x04, 0x88, 0xb2, 0x1e}, // xpub
+	HDCoinType: 0,
+}
+
+// testNetParams are the parameters of the public test network (version 3)
+var testNetParams = Params{
+	Name: "testnet",
+	Net: 0x0709110B,
+	DefaultPort: "18333",
+	RPCPort: "18332",
+	CoreDataSubdir: "testnet3",
+
+	GenesisHash: "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	GenesisMerkleRoot: genesisMerkleRoot,
+	GenesisVersion: 1,
+	GenesisTime: 1296688602,
+	GenesisBits: 0x1d00ffff,
+	GenesisNonce: 414098458,
+
+	powLimit: parsePowLimit("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits: 0x1d00ffff,
+	TargetTimespan: 14 * 24 * time.Hour,
+	TargetTimePerBlock: 10 * time.Minute,
+	RetargetInterval: 2016,
+	ReduceMinDifficulty: true,
+	MinDiffReductionTime: 20 * time.Minute,
+
+	BIP34Height: 21111,
+	BIP65Height: 581885,
+	BIP66Height: 330776,
+	CSVHeight: 770112,
+	SegwitHeight: 834624,
+
+	CoinbaseMaturity: 100,
+
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	PrivateKeyID: 0xef,
+	Bech32HRPSegwit: "tb",
+
+	HDPrivateKeyID: [4]byte{0x04, 0x35, 0x83, 0x94}, // tprv
+	HDPublicKeyID: [4]byte{0x04, 0x35, 0x87, 0xcf}, // tpub
+	HDCoinType: 1,
+}
+
+// sigNetParams are the parameters of the default signet
+var sigNetParams = Params{
+	Name: "signet",
+	Net: 0x40CF030A,
+	DefaultPort: "38333",
+	RPCPort: "38332",
+	CoreDataSubdir: "signet",
+
+	GenesisHash: "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+	GenesisMerkleRoot: genesisMerkleRoot,
+	GenesisVersion: 1,
+	GenesisTime: 1598918400,
+	GenesisBits: 0x1e0377ae,
+	GenesisNonce: 52613770,
+
+	powLimit: parsePowLimit("00000377ae000000000000000000000000000000000000000000000000000000"),
+	PowLimitBits: 0x1e0377ae,
+	TargetTimespan: 14 * 24 * time.Hour,
+	TargetTimePerBlock: 10 * time.Minute,
+	RetargetInterval: 2016,
+
+	BIP34Height: 1,
+	BIP65Height: 1,
+	BIP66Height: 1,
+	CSVHeight: 1,
+	SegwitHeight: 1,
+
+	CoinbaseMaturity: 100,
+
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	PrivateKeyID: 0xef,
+	Bech32HRPSegwit: "tb",
+
+	HDPrivateKeyID: [4]byte{0x04, 0x35, 0x83, 0x94}, // tprv
+	HDPublicKeyID: [4]byte{0x04, 0x35, 0x87, 0xcf}, // tpub
+	HDCoinType: 1,
+}
+
+// regTestParams are the parameters of a private regression test network
+var regTestParams = Params{
+	Name: "regtest",
+	Net: 0xDAB5BFFA,
+	DefaultPort: "18444",
+	RPCPort: "18443",
+	CoreDataSubdir: "regtest",
+
+	GenesisHash: "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	GenesisMerkleRoot: genesisMerkleRoot,
+	GenesisVersion: 1,
+	GenesisTime: 1296688602,
+	GenesisBits: 0x207fffff,
+	GenesisNonce: 2,
+
+	powLimit: parsePowLimit("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits: 0x207fffff,
+	TargetTimespan: 14 * 24 * time.Hour,
+	TargetTimePerBlock: 10 * time.Minute,
+	RetargetInterval: 2016,
+	ReduceMinDifficulty: true,
+	MinDiffReductionTime: 20 * time.Minute,
+	NoRetargeting: true,
+
+	BIP34Height: 1,
+	BIP65Height: 1,
+	BIP66Height: 1,
+	CSVHeight: 1,
+	SegwitHeight: 0,
+
+	CoinbaseMaturity: 100,
+
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	PrivateKeyID: 0xef,
+	Bech32HRPSegwit: "bcrt",
+
+	HDPrivateKeyID: [4]byte{0x04, 0x35, 0x83, 0x94}, // tprv
+	HDPublicKeyID: [4]byte{0x04, 0x35, 0x87, 0xcf}, // tpub
+	HDCoinType: 1,
+}
+
+// MainNet returns a copy of the mainnet parameters, changing it affects no other caller
+func MainNet() *Params {
+	params := mainNetParams
+	return &params
+}
+
+// TestNet returns a copy of the testnet parameters
+func TestNet() *Params {
+	params := testNetParams
+	return &params
+}
+
+// SigNet returns a copy of the signet parameters
+func SigNet() *Params {
+	params := sigNetParams
+	return &params
+}
+
+// RegTest returns a copy of the regtest parameters
+func RegTest() *Params {
+	params := regTestParams
+	return &params
+}
+
+// Lookup returns a copy of the parameter set for a network name
+func Lookup(name string) (*Params, error) {
+	for _, params := range []*Params{MainNet(), TestNet(), SigNet(), RegTest()} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, ErrUnknownNetwork
+}
+
+// MagicBytes returns the network magic in wire order
+func (params *Params) MagicBytes() []byte {
+	return []byte{byte(params.Net), byte(params.Net >> 8), byte(params.Net >> 16), byte(params.Net >> 24)}
+}
+
+// PowLimit returns a copy of the easiest target a block may have
+func (params *Params) PowLimit() *big.Int {
+	return new(big.Int).Set(params.powLimit)
+}
+
+func parsePowLimit(hex string) *big.Int {
+	limit, ok := new(big.Int).SetString(hex, 16)
+	if !ok {
+		panic("Invalid proof of work limit")
+	}
+	return limit
+}
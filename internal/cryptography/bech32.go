@@ -0,0 +1,216 @@
+package cryptography
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bech32Encoding selects the checksum constant, Bech32 (BIP173) or Bech32m (BIP350)
+type Bech32Encoding int
+
+const (
+	// Bech32 is used for witness version 0 addresses
+	Bech32 Bech32Encoding = iota + 1
+	// Bech32m is used for witness version 1+ addresses
+	Bech32m
+)
+
+const bech32charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const bech32Const = 1
+const bech32mConst = 0x2bc830a3
+
+// ErrInvalidBech32 when a string is not a valid Bech32 or Bech32m encoding
+var ErrInvalidBech32 = errors.New("Invalid Bech32 encoding")
+// ErrInvalidSegwitAddress when a Bech32 string does not hold a valid witness program for the network
+var ErrInvalidSegwitAddress = errors.New("Invalid segwit address")
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	return expanded
+}
+
+func bech32Checksum(hrp string, data []byte, enc Bech32Encoding) []byte {
+	constant := uint32(bech32Const)
+	if enc == Bech32m {
+		constant = bech32mConst
+	}
+
+	values := append(bech32HrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	polymod := bech32Polymod(values) ^ constant
+
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte((polymod >> uint(5*(5-i))) & 31)
+	}
+	return checksum
+}
+
+// Bech32Encode encodes a human-readable part and 5-bit data values
+func Bech32Encode(hrp string, data []byte, enc Bech32Encoding) (string, error) {
+	if len(hrp) < 1 || len(hrp)+len(data)+7 > 90 {
+		return "", ErrInvalidBech32
+	}
+	for _, c := range []byte(hrp) {
+		if c < 33 || c > 126 {
+			return "", ErrInvalidBech32
+		}
+	}
+	hrp = strings.ToLower(hrp)
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, values := range [][]byte{data, bech32Checksum(hrp, data, enc)} {
+		for _, v := range values {
+			if v > 31 {
+				return "", ErrInvalidBech32
+			}
+			sb.WriteByte(bech32charset[v])
+		}
+	}
+	return sb.String(), nil
+}
+
+// Bech32Decode returns the human-readable part, 5-bit data values and which checksum was used
+func Bech32Decode(s string) (hrp string, data []byte, enc Bech32Encoding, err error) {
+	if len(s) > 90 {
+		return "", nil, 0, ErrInvalidBech32
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, ErrInvalidBech32
+	}
+	for _, c := range []byte(s) {
+		if c < 33 || c > 126 {
+			return "", nil, 0, ErrInvalidBech32
+		}
+	}
+	s = strings.ToLower(s)
+
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, 0, ErrInvalidBech32
+	}
+
+	hrp = s[:sep]
+	data = make([]byte, 0, len(s)-sep-1)
+	for _, c := range []byte(s[sep+1:]) {
+		v := strings.IndexByte(bech32charset, c)
+		if v == -1 {
+			return "", nil, 0, ErrInvalidBech32
+		}
+		data = append(data, byte(v))
+	}
+
+	switch bech32Polymod(append(bech32HrpExpand(hrp), data...)) {
+	case bech32Const:
+		enc = Bech32
+	case bech32mConst:
+		enc = Bech32m
+	default:
+		return "", nil, 0, ErrInvalidBech32
+	}
+
+	return hrp, data[:len(data)-6], enc, nil
+}
+
+// ConvertBits regroups data from fromBits-bit values to toBits-bit values
+func ConvertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<toBits - 1
+	out := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, ErrInvalidBech32
+		}
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte((acc>>bits)&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			out = append(out, byte((acc<<(toBits-bits))&maxv))
+		}
+	} else if bits >= fromBits || (acc<<(toBits-bits))&maxv != 0 {
+		return nil, ErrInvalidBech32
+	}
+	return out, nil
+}
+
+// EncodeSegwitAddress encodes a witness program, using Bech32 for version 0 and Bech32m otherwise
+func EncodeSegwitAddress(hrp string, version byte, program []byte) (string, error) {
+	if !isValidWitnessProgram(version, program) {
+		return "", ErrInvalidSegwitAddress
+	}
+
+	enc := Bech32
+	if version > 0 {
+		enc = Bech32m
+	}
+
+	converted, err := ConvertBits(program, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return Bech32Encode(hrp, append([]byte{version}, converted...), enc)
+}
+
+// DecodeSegwitAddress recovers the witness version and program, checking the address belongs to hrp
+func DecodeSegwitAddress(hrp, address string) (version byte, program []byte, err error) {
+	decodedHrp, data, enc, err := Bech32Decode(address)
+	if err != nil {
+		return 0, nil, err
+	}
+	if decodedHrp != hrp || len(data) < 1 {
+		return 0, nil, ErrInvalidSegwitAddress
+	}
+
+	version = data[0]
+	if (version == 0 && enc != Bech32) || (version != 0 && enc != Bech32m) {
+		return 0, nil, ErrInvalidSegwitAddress
+	}
+
+	program, err = ConvertBits(data[1:], 5, 8, false)
+	if err != nil || !isValidWitnessProgram(version, program) {
+		return 0, nil, ErrInvalidSegwitAddress
+	}
+	return version, program, nil
+}
+
+func isValidWitnessProgram(version byte, program []byte) bool {
+	if version > 16 || len(program) < 2 || len(program) > 40 {
+		return false
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return false
+	}
+	return true
+}
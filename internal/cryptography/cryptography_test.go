@@ -1,8 +1,13 @@
 package cryptography
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"github.com/harveynw/blokechain/internal/chainparams"
 )
 
 func TestCurveGenerator(t *testing.T) {
@@ -42,4 +47,520 @@ func TestSignature(t *testing.T) {
 	if sigRecovered.r.Cmp(sig.r) != 0 || sigRecovered.s.Cmp(sig.s) != 0 {
 		t.Error("DER Encoding and then decoding did not give back the same signature")
 	}
-}
\ No newline at end of file
+}
+
+func TestBase58Check(t *testing.T) {
+	// Genesis block coinbase address
+	version, hash, err := DecodeAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa")
+	if err != nil {
+		t.Fatalf("Failed decode %s", err)
+	}
+	if version != 0x00 || hex.EncodeToString(hash) != "62e907b15cbf27d5425399ebf6f0fb50ebb88f18" {
+		t.Errorf("Decoded wrong version %x or hash %x", version, hash)
+	}
+	if Base58CheckEncode(version, hash) != "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa" {
+		t.Error("Encoding then decoding did not give back the same address")
+	}
+
+	if _, _, err := DecodeAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb"); err != ErrChecksumMismatch {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+	if _, _, err := DecodeAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7Divf0a"); err != ErrInvalidBase58 {
+		t.Errorf("Expected invalid character, got %v", err)
+	}
+
+	// Leading zero bytes are kept
+	b, _ := Base58Decode(Base58Encode([]byte{0x00, 0x00, 0x01, 0x02}))
+	if !bytes.Equal(b, []byte{0x00, 0x00, 0x01, 0x02}) {
+		t.Errorf("Leading zeros lost %x", b)
+	}
+}
+
+func TestToAddress(t *testing.T) {
+	// Secret key 1 is the generator point
+	pk := gen.publicKeyFromSecretKey(big.NewInt(1))
+	if addr := pk.ToAddress(chainparams.MainNet()); addr != "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH" {
+		t.Errorf("Wrong address %s for secret key 1", addr)
+	}
+	if addr := pk.ToAddress(chainparams.TestNet()); addr != "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r" {
+		t.Errorf("Wrong testnet address %s for secret key 1", addr)
+	}
+}
+
+func TestBech32Vectors(t *testing.T) {
+	valid := map[string]Bech32Encoding{
+		"A12UEL5L": Bech32,
+		"a12uel5l": Bech32,
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs": Bech32,
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw": Bech32,
+		"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j": Bech32,
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w": Bech32,
+		"?1ezyfcl": Bech32,
+		"A1LQFN3A": Bech32m,
+		"a1lqfn3a": Bech32m,
+		"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6": Bech32m,
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx": Bech32m,
+		"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8": Bech32m,
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v": Bech32m,
+		"?1v759aa": Bech32m,
+	}
+	for s, expected := range valid {
+		hrp, data, enc, err := Bech32Decode(s)
+		if err != nil || enc != expected {
+			t.Errorf("Failed decode of %s: %v", s, err)
+			continue
+		}
+		reencoded, err := Bech32Encode(hrp, data, enc)
+		if err != nil || reencoded != strings.ToLower(s) {
+			t.Errorf("Encoding then decoding %s gave %s", s, reencoded)
+		}
+	}
+
+	invalid := []string{
+		"\x201nwldj5",
+		"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx",
+		"pzry9x0s0muk",
+		"1pzry9x0s0muk",
+		"x1b4n0q5v",
+		"li1dgmt3",
+		"A1G7SGD8",
+		"10a06t8",
+		"1qzzfhee",
+		"1p2gdwpf",
+		"16plkw9",
+		"1l2zn2r",
+	}
+	for _, s := range invalid {
+		if _, _, _, err := Bech32Decode(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestSegwitAddressVectors(t *testing.T) {
+	valid := map[string]string{
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4": "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7": "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262",
+		"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y": "5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6",
+		"BC1SW50QGDZ25J": "6002751e",
+		"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs": "5210751e76e8199196d454941c45d1b3a323",
+		"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy": "0020000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c": "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+	}
+	for addr, scriptPubKey := range valid {
+		hrp := strings.ToLower(addr[:strings.LastIndexByte(addr, '1')])
+		version, program, err := DecodeSegwitAddress(hrp, addr)
+		if err != nil {
+			t.Errorf("Failed decode of %s: %v", addr, err)
+			continue
+		}
+
+		op := version
+		if version > 0 {
+			op += 0x50
+		}
+		script := append([]byte{op, byte(len(program))}, program...)
+		if hex.EncodeToString(script) != scriptPubKey {
+			t.Errorf("Wrong witness program for %s: %x", addr, script)
+		}
+
+		reencoded, err := EncodeSegwitAddress(hrp, version, program)
+		if err != nil || reencoded != strings.ToLower(addr) {
+			t.Errorf("Encoding then decoding %s gave %s", addr, reencoded)
+		}
+	}
+
+	invalid := []string{
+		"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd",
+		"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf",
+		"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",
+		"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47",
+		"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4",
+		"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R",
+		"bc1pw5dgrnzv",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav",
+		"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P",
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf",
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j",
+		"bc1gmk9yu",
+	}
+	for _, addr := range invalid {
+		for _, hrp := range []string{"bc", "tb", "bcrt"} {
+			if _, _, err := DecodeSegwitAddress(hrp, addr); err == nil {
+				t.Errorf("Expected %s to be rejected for %s", addr, hrp)
+			}
+		}
+	}
+}
+
+func TestToSegwitAddress(t *testing.T) {
+	pk := gen.publicKeyFromSecretKey(big.NewInt(1))
+	if addr := pk.ToSegwitAddress(chainparams.MainNet()); addr != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("Wrong segwit address %s for secret key 1", addr)
+	}
+
+	addr := pk.ToSegwitAddress(chainparams.RegTest())
+	if !strings.HasPrefix(addr, "bcrt1q") {
+		t.Errorf("Wrong regtest address %s", addr)
+	}
+	if _, program, err := DecodeSegwitAddress("bcrt", addr); err != nil || !bytes.Equal(program, pk.HashEncode()) {
+		t.Errorf("Failed regtest round trip %v", err)
+	}
+}
+
+type bip32Vector struct {
+	path string
+	xpub string
+	xprv string
+}
+
+func TestBIP32Vectors(t *testing.T) {
+	params := chainparams.MainNet()
+	vectors := map[string][]bip32Vector{
+		"000102030405060708090a0b0c0d0e0f": {
+			{"m", "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8", "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"},
+			{"m/0'", "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw", "xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvvkX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7"},
+			{"m/0'/1", "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ", "xprv9wTYmMFdV23N2TdNG573QoEsfRrWKQgWeibmLntzniatZvR9BmLnvSxqu53Kw1UmYPxLgboyZQaXwTCg8MSY3H2EU4pWcQDnRnrVA1xe8fs"},
+			{"m/0'/1/2'", "xpub6D4BDPcP2GT577Vvch3R8wDkScZWzQzMMUm3PWbmWvVJrZwQY4VUNgqFJPMM3No2dFDFGTsxxpG5uJh7n7epu4trkrX7x7DogT5Uv6fcLW5", "xprv9z4pot5VBttmtdRTWfWQmoH1taj2axGVzFqSb8C9xaxKymcFzXBDptWmT7FwuEzG3ryjH4ktypQSAewRiNMjANTtpgP4mLTj34bhnZX7UiM"},
+			{"m/0'/1/2'/2", "xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV", "xprvA2JDeKCSNNZky6uBCviVfJSKyQ1mDYahRjijr5idH2WwLsEd4Hsb2Tyh8RfQMuPh7f7RtyzTtdrbdqqsunu5Mm3wDvUAKRHSC34sJ7in334"},
+			{"m/0'/1/2'/2/1000000000", "xpub6H1LXWLaKsWFhvm6RVpEL9P4KfRZSW7abD2ttkWP3SSQvnyA8FSVqNTEcYFgJS2UaFcxupHiYkro49S8yGasTvXEYBVPamhGW6cFJodrTHy", "xprvA41z7zogVVwxVSgdKUHDy1SKmdb533PjDz7J6N6mV6uS3ze1ai8FHa8kmHScGpWmj4WggLyQjgPie1rFSruoUihUZREPSL39UNdE3BBDu76"},
+		},
+		"fffcf9f6f3f0edeae7e4e1dedbd8d5d2cfccc9c6c3c0bdbab7b4b1aeaba8a5a29f9c999693908d8a8784817e7b7875726f6c696663605d5a5754514e4b484542": {
+			{"m", "xpub661MyMwAqRbcFW31YEwpkMuc5THy2PSt5bDMsktWQcFF8syAmRUapSCGu8ED9W6oDMSgv6Zz8idoc4a6mr8BDzTJY47LJhkJ8UB7WEGuduB", "xprv9s21ZrQH143K31xYSDQpPDxsXRTUcvj2iNHm5NUtrGiGG5e2DtALGdso3pGz6ssrdK4PFmM8NSpSBHNqPqm55Qn3LqFtT2emdEXVYsCzC2U"},
+			{"m/0", "xpub69H7F5d8KSRgmmdJg2KhpAK8SR3DjMwAdkxj3ZuxV27CprR9LgpeyGmXUbC6wb7ERfvrnKZjXoUmmDznezpbZb7ap6r1D3tgFxHmwMkQTPH", "xprv9vHkqa6EV4sPZHYqZznhT2NPtPCjKuDKGY38FBWLvgaDx45zo9WQRUT3dKYnjwih2yJD9mkrocEZXo1ex8G81dwSM1fwqWpWkeS3v86pgKt"},
+			{"m/0/2147483647'", "xpub6ASAVgeehLbnwdqV6UKMHVzgqAG8Gr6riv3Fxxpj8ksbH9ebxaEyBLZ85ySDhKiLDBrQSARLq1uNRts8RuJiHjaDMBU4Zn9h8LZNnBC5y4a", "xprv9wSp6B7kry3Vj9m1zSnLvN3xH8RdsPP1Mh7fAaR7aRLcQMKTR2vidYEeEg2mUCTAwCd6vnxVrcjfy2kRgVsFawNzmjuHc2YmYRmagcEPdU9"},
+			{"m/0/2147483647'/1", "xpub6DF8uhdarytz3FWdA8TvFSvvAh8dP3283MY7p2V4SeE2wyWmG5mg5EwVvmdMVCQcoNJxGoWaU9DCWh89LojfZ537wTfunKau47EL2dhHKon", "xprv9zFnWC6h2cLgpmSA46vutJzBcfJ8yaJGg8cX1e5StJh45BBciYTRXSd25UEPVuesF9yog62tGAQtHjXajPPdbRCHuWS6T8XA2ECKADdw4Ef"},
+			{"m/0/2147483647'/1/2147483646'", "xpub6ERApfZwUNrhLCkDtcHTcxd75RbzS1ed54G1LkBUHQVHQKqhMkhgbmJbZRkrgZw4koxb5JaHWkY4ALHY2grBGRjaDMzQLcgJvLJuZZvRcEL", "xprvA1RpRA33e1JQ7ifknakTFpgNXPmW2YvmhqLQYMmrj4xJXXWYpDPS3xz7iAxn8L39njGVyuoseXzU6rcxFLJ8HFsTjSyQbLYnMpCqE2VbFWc"},
+			{"m/0/2147483647'/1/2147483646'/2", "xpub6FnCn6nSzZAw5Tw7cgR9bi15UV96gLZhjDstkXXxvCLsUXBGXPdSnLFbdpq8p9HmGsApME5hQTZ3emM2rnY5agb9rXpVGyy3bdW6EEgAtqt", "xprvA2nrNbFZABcdryreWet9Ea4LvTJcGsqrMzxHx98MMrotbir7yrKCEXw7nadnHM8Dq38EGfSh6dqA9QWTyefMLEcBYJUuekgW4BYPJcr9E7j"},
+		},
+		"4b381541583be4423346c643850da4b320e46a87ae3d2a4e6da11eba819cd4acba45d239319ac14f863b8d5ab5a0d0c64d2e8a1e7d1457df2e5a3c51c73235be": {
+			{"m", "xpub661MyMwAqRbcEZVB4dScxMAdx6d4nFc9nvyvH3v4gJL378CSRZiYmhRoP7mBy6gSPSCYk6SzXPTf3ND1cZAceL7SfJ1Z3GC8vBgp2epUt13", "xprv9s21ZrQH143K25QhxbucbDDuQ4naNntJRi4KUfWT7xo4EKsHt2QJDu7KXp1A3u7Bi1j8ph3EGsZ9Xvz9dGuVrtHHs7pXeTzjuxBrCmmhgC6"},
+			{"m/0'", "xpub68NZiKmJWnxxS6aaHmn81bvJeTESw724CRDs6HbuccFQN9Ku14VQrADWgqbhhTHBaohPX4CjNLf9fq9MYo6oDaPPLPxSb7gwQN3ih19Zm4Y", "xprv9uPDJpEQgRQfDcW7BkF7eTya6RPxXeJCqCJGHuCJ4GiRVLzkTXBAJMu2qaMWPrS7AANYqdq6vcBcBUdJCVVFceUvJFjaPdGZ2y9WACViL4L"},
+		},
+		"3ddd5602285899a946114506157c7997e5444528f3003f6134712147db19b678": {
+			{"m", "xpub661MyMwAqRbcGczjuMoRm6dXaLDEhW1u34gKenbeYqAix21mdUKJyuyu5F1rzYGVxyL6tmgBUAEPrEz92mBXjByMRiJdba9wpnN37RLLAXa", "xprv9s21ZrQH143K48vGoLGRPxgo2JNkJ3J3fqkirQC2zVdk5Dgd5w14S7fRDyHH4dWNHUgkvsvNDCkvAwcSHNAQwhwgNMgZhLtQC63zxwhQmRv"},
+			{"m/0'", "xpub69AUMk3qDBi3uW1sXgjCmVjJ2G6WQoYSnNHyzkmdCHEhSZ4tBok37xfFEqHd2AddP56Tqp4o56AePAgCjYdvpW2PU2jbUPFKsav5ut6Ch1m", "xprv9vB7xEWwNp9kh1wQRfCCQMnZUEG21LpbR9NPCNN1dwhiZkjjeGRnaALmPXCX7SgjFTiCTT6bXes17boXtjq3xLpcDjzEuGLQBM5ohqkao9G"},
+			{"m/0'/1'", "xpub6BJA1jSqiukeaesWfxe6sNK9CCGaujFFSJLomWHprUL9DePQ4JDkM5d88n49sMGJxrhpjazuXYWdMf17C9T5XnxkopaeS7jGk1GyyVziaMt", "xprv9xJocDuwtYCMNAo3Zw76WENQeAS6WGXQ55RCy7tDJ8oALr4FWkuVoHJeHVAcAqiZLE7Je3vZJHxspZdFHfnBEjHqU5hG1Jaj32dVoS6XLT1"},
+		},
+	}
+
+	for seedHex, chain := range vectors {
+		seed, _ := hex.DecodeString(seedHex)
+		master, err := NewMasterKey(seed, params)
+		if err != nil {
+			t.Fatalf("Failed master key %v", err)
+		}
+
+		var parentPub *ExtendedKey
+		for _, v := range chain {
+			path, err := ParseDerivationPath(v.path)
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %v", v.path, err)
+			}
+			if FormatDerivationPath(path) != v.path {
+				t.Errorf("Path %s formatted as %s", v.path, FormatDerivationPath(path))
+			}
+
+			key, err := master.Derive(path)
+			if err != nil {
+				t.Fatalf("Failed derivation of %s: %v", v.path, err)
+			}
+			if key.String() != v.xprv {
+				t.Errorf("Wrong xprv at %s: %s", v.path, key)
+			}
+			pub := key.Neuter(params)
+			if pub.String() != v.xpub {
+				t.Errorf("Wrong xpub at %s: %s", v.path, pub)
+			}
+
+			// Non-hardened children are derivable from the parent public key alone
+			if len(path) > 0 && path[len(path)-1] < HardenedKeyStart {
+				child, err := parentPub.Child(path[len(path)-1])
+				if err != nil || child.String() != v.xpub {
+					t.Errorf("Public derivation at %s gave %v (%v)", v.path, child, err)
+				}
+			}
+			parentPub = pub
+
+			for _, s := range []string{v.xprv, v.xpub} {
+				parsed, err := ParseExtendedKey(s, params)
+				if err != nil || parsed.String() != s {
+					t.Errorf("Failed round trip of %s: %v", s, err)
+				}
+			}
+		}
+	}
+}
+
+func TestBIP32Invalid(t *testing.T) {
+	params := chainparams.MainNet()
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, _ := NewMasterKey(seed, params)
+
+	if _, err := master.Neuter(params).Child(HardenedKeyStart); err != ErrDeriveHardenedFromPublic {
+		t.Errorf("Expected hardened derivation from xpub to fail, got %v", err)
+	}
+	if _, err := ParseExtendedKey(master.String(), chainparams.TestNet()); err != ErrInvalidExtendedKey {
+		t.Errorf("Expected xprv to be rejected on testnet, got %v", err)
+	}
+	if _, err := NewMasterKey(seed[:15], params); err != ErrInvalidSeed {
+		t.Errorf("Expected short seed to be rejected, got %v", err)
+	}
+
+	// Reserialize the master key with one field corrupted at a time
+	corrupt := func(f func(b []byte)) string {
+		_, payload, _ := Base58CheckDecode(master.String())
+		b := append([]byte{0x04}, payload...)
+		f(b)
+		return Base58Encode(append(b, checksum(b)...))
+	}
+	invalid := map[string]string{
+		"zero depth with parent fingerprint": corrupt(func(b []byte) { b[5] = 0x01 }),
+		"zero depth with child index": corrupt(func(b []byte) { b[12] = 0x01 }),
+		"private key prefix": corrupt(func(b []byte) { b[45] = 0x04 }),
+		"private key zero": corrupt(func(b []byte) { copy(b[46:], make([]byte, 32)) }),
+		"private key order": corrupt(func(b []byte) { gen.order.FillBytes(b[46:]) }),
+		"unknown version": corrupt(func(b []byte) { b[3] = 0x00 }),
+		"public version private data": corrupt(func(b []byte) { copy(b[0:4], params.HDPublicKeyID[:]) }),
+	}
+	for reason, s := range invalid {
+		if _, err := ParseExtendedKey(s, params); err == nil {
+			t.Errorf("Expected key with %s to be rejected", reason)
+		}
+	}
+
+	if _, err := ParseDerivationPath("m/0'/x"); err != ErrInvalidPath {
+		t.Errorf("Expected invalid path, got %v", err)
+	}
+	if _, err := ParseDerivationPath("m/2147483648"); err != ErrInvalidPath {
+		t.Errorf("Expected out of range index, got %v", err)
+	}
+	if path, _ := ParseDerivationPath("m/84h/0H/0'/0/5"); FormatDerivationPath(path) != "m/84'/0'/0'/0/5" {
+		t.Errorf("Failed to parse alternative hardened notation %v", path)
+	}
+}
+
+func TestBIP39Vectors(t *testing.T) {
+	// Trezor reference vectors, all using the passphrase "TREZOR"
+	vectors := [][3]string{
+		{"00000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"},
+		{"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f", "legal winner thank year wave sausage worth useful legal winner thank yellow", "2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607"},
+		{"80808080808080808080808080808080", "letter advice cage absurd amount doctor acoustic avoid letter advice cage above", "d71de856f81a8acc65e6fc851a38d4d7ec216fd0796d0a6827a3ad6ed5511a30fa280f12eb2e47ed2ac03b5c462a0358d18d69fe4f985ec81778c1b370b652a8"},
+		{"ffffffffffffffffffffffffffffffff", "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong", "ac27495480225222079d7be181583751e86f571027b0497b5b5d11218e0a8a13332572917f0f8e5a589620c6f15b11c61dee327651a14c34e18231052e48c069"},
+		{"9e885d952ad362caeb4efe34a8e91bd2", "ozone drill grab fiber curtain grace pudding thank cruise elder eight picnic", "274ddc525802f7c828d8ef7ddbcdc5304e87ac3535913611fbbfa986d0c9e5476c91689f9c8a54fd55bd38606aa6a8595ad213d4c9c9f9aca3fb217069a41028"},
+		{"0000000000000000000000000000000000000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art", "bda85446c68413707090a52022edd26a1c9462295029f2e60cd7c4f2bbd3097170af7a4d73245cafa9c3cca8d561a7c3de6f5d4a10be8ed2a5e608d68f92fcc8"},
+		{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote", "dd48c104698c30cfe2b6142103248622fb7bb0ff692eebb00089b32d22484e1613912f0a5b694407be899ffd31ed3992c456cdf60f5d4564b8ba3f05a69890ad"},
+	}
+
+	for _, v := range vectors {
+		entropy, _ := hex.DecodeString(v[0])
+		mnemonic, err := NewMnemonic(entropy)
+		if err != nil || mnemonic != v[1] {
+			t.Errorf("Entropy %s gave mnemonic %q (%v)", v[0], mnemonic, err)
+		}
+
+		recovered, err := MnemonicToEntropy(v[1])
+		if err != nil || !bytes.Equal(recovered, entropy) {
+			t.Errorf("Mnemonic %q gave entropy %x (%v)", v[1], recovered, err)
+		}
+
+		seed, err := MnemonicToSeed(v[1], "TREZOR")
+		if err != nil || hex.EncodeToString(seed) != v[2] {
+			t.Errorf("Mnemonic %q gave seed %x (%v)", v[1], seed, err)
+		}
+	}
+}
+
+func TestMnemonicValidation(t *testing.T) {
+	invalid := []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon", // Bad checksum
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon", // 11 words
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon bitcoin", // Unknown word
+	}
+	for _, mnemonic := range invalid {
+		if IsMnemonicValid(mnemonic) {
+			t.Errorf("Expected %q to be invalid", mnemonic)
+		}
+	}
+
+	if _, err := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "naïve"); err != ErrNonASCIIPassphrase {
+		t.Errorf("Expected non-ASCII passphrase to be rejected, got %v", err)
+	}
+
+	for _, bits := range []int{128, 256} {
+		entropy, _ := NewEntropy(bits)
+		mnemonic, _ := NewMnemonic(entropy)
+		if len(strings.Fields(mnemonic)) != bits/32*3 || !IsMnemonicValid(mnemonic) {
+			t.Errorf("Generated invalid mnemonic %q", mnemonic)
+		}
+	}
+	if _, err := NewEntropy(100); err != ErrInvalidEntropy {
+		t.Errorf("Expected invalid entropy size, got %v", err)
+	}
+}
+
+func TestWIF(t *testing.T) {
+	one := big.NewInt(1)
+	vectors := []struct {
+		wif string
+		compressed bool
+		params *chainparams.Params
+	}{
+		{"5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAnchuDf", false, chainparams.MainNet()},
+		{"KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn", true, chainparams.MainNet()},
+		{"cMahea7zqjxrtgAbB7LSGbcQUr1uX1ojuat9jZodMN87JcbXMTcA", true, chainparams.TestNet()},
+	}
+	for _, v := range vectors {
+		if wif := EncodeWIF(one, v.compressed, v.params); wif != v.wif {
+			t.Errorf("Secret key 1 encoded as %s, expected %s", wif, v.wif)
+		}
+		secret, compressed, err := DecodeWIF(v.wif, v.params)
+		if err != nil || secret.Cmp(one) != 0 || compressed != v.compressed {
+			t.Errorf("Failed decode of %s: %v", v.wif, err)
+		}
+	}
+
+	if _, _, err := DecodeWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn", chainparams.RegTest()); err != ErrWIFNetwork {
+		t.Errorf("Expected mainnet key to be rejected on regtest, got %v", err)
+	}
+	if _, _, err := DecodeWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWo", chainparams.MainNet()); err != ErrInvalidWIF {
+		t.Errorf("Expected bad checksum to be rejected, got %v", err)
+	}
+	zero := Base58CheckEncode(0x80, append(make([]byte, 32), 0x01))
+	if _, _, err := DecodeWIF(zero, chainparams.MainNet()); err != ErrInvalidWIF {
+		t.Errorf("Expected zero key to be rejected, got %v", err)
+	}
+}
+
+func TestPublicKeyRecovery(t *testing.T) {
+	secretKey, pk := RandomKeyPair()
+	hash := Hash256([]byte("I'm afraid there is no money"))
+
+	for _, compressed := range []bool{true, false} {
+		recovered, wasCompressed, err := RecoverCompact(SignCompact(secretKey, hash, compressed), hash)
+		if err != nil || wasCompressed != compressed || !bytes.Equal(recovered.Encode(), pk.Encode()) {
+			t.Errorf("Failed to recover public key (%v)", err)
+		}
+	}
+
+	if _, _, err := RecoverCompact(make([]byte, 64), hash); err != ErrInvalidCompactSignature {
+		t.Errorf("Expected short signature to be rejected, got %v", err)
+	}
+}
+
+func TestBitcoinMessage(t *testing.T) {
+	params := chainparams.MainNet()
+
+	// Signature made by bitcoinjs-message
+	valid, err := VerifyBitcoinMessage("1F3sAm6ZtwLAUnj7d38pGFxtP3RVEvtsbV", "H9L5yLFjti0QTHhPyFrZCT1V/MMnBtXKmoiKDZ78NDBjERki6ZTQZdSMCtkgoNmp17By9ItJr8o7ChX0XxY91nk=", "This is an example of a signed message.", params)
+	if err != nil || !valid {
+		t.Errorf("Failed to verify reference signature (%v)", err)
+	}
+
+	secretKey, pk := RandomKeyPair()
+	sig := SignBitcoinMessage(secretKey, "I own this address")
+	if valid, err := VerifyBitcoinMessage(pk.ToAddress(params), sig, "I own this address", params); err != nil || !valid {
+		t.Errorf("Failed to verify own signature (%v)", err)
+	}
+	if valid, _ := VerifyBitcoinMessage(pk.ToAddress(params), sig, "I own that address", params); valid {
+		t.Error("Signature should not verify for a different message")
+	}
+	if _, err := VerifyBitcoinMessage("3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", sig, "I own this address", params); err != ErrNotPubKeyHashAddress {
+		t.Errorf("Expected P2SH address to be rejected, got %v", err)
+	}
+}
+
+func TestSchnorrVectors(t *testing.T) {
+	// BIP340 test vectors 0 to 3 [secret key, public key, aux, message, signature]
+	signing := [][5]string{
+		{"0000000000000000000000000000000000000000000000000000000000000003", "F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9", "0000000000000000000000000000000000000000000000000000000000000000", "0000000000000000000000000000000000000000000000000000000000000000", "E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0"},
+		{"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "0000000000000000000000000000000000000000000000000000000000000001", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A"},
+		{"C90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B14E5C9", "DD308AFEC5777E13121FA72B9CC1B7CC0139715309B086C960E18FD969774EB8", "C87AA53824B4D7AE2EB035A2B5BBBCCC080E76CDC6D1692C4B0B62D798E6D906", "7E2D58D8B3BCDF1ABADEC7829054F90DDA9805AAB56C77333024B9D0A508B75C", "5831AAEED7B44BB74E5EAB94BA9D4294C49BCF2A60728D8B4C200F50DD313C1BAB745879A5AD954A72C45A91C3A51D3C7ADEA98D82F8481E0E1E03674A6F3FB7"},
+		{"0B432B2677937381AEF05BB02A66ECD012773062CF3FA2549E44F58ED2401710", "25D1DFF95105F5253C4022F628A996AD3A0D95FBF21D468A1B33F8C160D8F517", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", "7EB0509757E246F19449885651611CB965ECC1A187DD51B64FDA1EDC9637D5EC97582B9CB13DB3933705B32BA982AF5AF25FD78881EBB32771FC5922EFC66EA3"},
+	}
+	for _, v := range signing {
+		secretKey := new(big.Int).SetBytes(mustHex(v[0]))
+		if pk := PublicKeyFromSecretKey(secretKey).XOnly(); !strings.EqualFold(hex.EncodeToString(pk), v[1]) {
+			t.Errorf("Public key %x, expected %s", pk, v[1])
+		}
+		sig, err := SchnorrSign(secretKey, mustHex(v[3]), mustHex(v[2]))
+		if err != nil || !strings.EqualFold(hex.EncodeToString(sig), v[4]) {
+			t.Errorf("Signature %x (%v), expected %s", sig, err, v[4])
+		}
+	}
+
+	// Verification only vectors [public key, message, signature, valid]
+	verifying := [][4]string{
+		{"D69C3509BB99E412E68B0FE8544E72837DFA30746D8BE2AA65975F29D22DC7B9", "4DF3C3F68FCC83B27E9D42C90431A72499F17875C81A599B566C9889B9696703", "00000000000000000000003B78CE563F89A0ED9414F5AA28AD0D96D6795F9C6376AFB1548AF603B3EB45C9F8207DEE1060CB71C04E80F593060B07D28308D7F4", "true"},
+		{"EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", "false"},
+		{"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "FFF97BD5755EEEA420453A14355235D382F6472F8568A18B2F057A14602975563CC27944640AC607CD107AE10923D9EF7A73C643E166BE5EBEAFA34B1AC553E2", "false"},
+		{"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "1FA62E331EDBC21C394792D2AB1100A7B432B013DF3F6FF4F99FCB33E0E1515F28890B3EDB6E7189B630448B515CE4F8622A954CFE545735AAEA5134FCCDB2BD", "false"},
+		{"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "0000000000000000000000000000000000000000000000000000000000000000123DDA8328AF9C23A94C1FEECFD123BA4FB73476F0D594DCB65C6425BD186051", "false"},
+		{"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC30", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", "false"},
+	}
+	for i, v := range verifying {
+		if valid := SchnorrVerify(mustHex(v[0]), mustHex(v[1]), mustHex(v[2])); fmt.Sprint(valid) != v[3] {
+			t.Errorf("Verification vector %v gave %v", i, valid)
+		}
+	}
+}
+
+func TestTaprootAddress(t *testing.T) {
+	// BIP86 first receive address of the all "abandon" mnemonic
+	seed, _ := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	master, _ := NewMasterKey(seed, chainparams.MainNet())
+	key, err := master.Derive([]uint32{HardenedKeyStart + 86, HardenedKeyStart, HardenedKeyStart, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if internal := hex.EncodeToString(key.PublicKey().XOnly()); internal != "cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115" {
+		t.Errorf("Internal key %s", internal)
+	}
+	if addr := key.PublicKey().ToTaprootAddress(chainparams.MainNet()); addr != "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr" {
+		t.Errorf("Taproot address %s", addr)
+	}
+
+	// The tweaked secret key signs for the output key
+	secretKey, _ := key.SecretKey()
+	tweaked, _ := TaprootTweakSecretKey(secretKey, nil)
+	outputKey, _ := TaprootOutputKey(key.PublicKey(), nil)
+	msg := SHA256([]byte("taproot"))
+	sig, err := SchnorrSign(tweaked, msg, nil)
+	if err != nil || !SchnorrVerify(outputKey, msg, sig) {
+		t.Errorf("Tweaked key signature failed (%v)", err)
+	}
+}
+
+func TestSignatureDER(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		secretKey, _ := RandomKeyPair()
+		sig := SignMessage(secretKey, []byte{byte(i)})
+		der := sig.Encode()
+
+		// Minimal integers, never read as negative
+		if der[4] & 0x80 != 0 || (der[4] == 0x00 && der[5] & 0x80 == 0) {
+			t.Errorf("r is not minimally encoded: %x", der)
+		}
+		decoded, err := DecodeSignature(append(der, 0x01))
+		if err != nil || decoded.r.Cmp(sig.r) != 0 || decoded.s.Cmp(sig.s) != 0 {
+			t.Errorf("DER round trip failed for %x (%v)", der, err)
+		}
+	}
+
+	if _, err := DecodeSignature([]byte{0x30, 0x06, 0x02}); err == nil {
+		t.Error("Truncated signature should be rejected")
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
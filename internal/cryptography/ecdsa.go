@@ -53,34 +53,59 @@ var gen generator = generator{
 
 // SignMessage using ECDSA (non-deterministic!)
 func SignMessage(secretKey *big.Int, message []byte) Signature {
-	e := new(big.Int).SetBytes(Hash256(message))
+	sig, _ := signHash(secretKey, Hash256(message))
+	return sig
+}
+
+// signHash signs a 32 byte digest, also returning the recovery id of the nonce point
+func signHash(secretKey *big.Int, hash []byte) (Signature, byte) {
+	e := new(big.Int).SetBytes(hash)
 	n := &gen.order
 
-	k := gen.randomSecretKey()
-	curvePoint := gen.G.curve.curveMultiply(k, gen.G)
+	for {
+		k := gen.randomSecretKey()
+		curvePoint := gen.G.curve.curveMultiply(k, gen.G)
 
-	r := new(big.Int)
-	*r = curvePoint.x
+		r := new(big.Int).Mod(&curvePoint.x, n)
+		if r.Sign() == 0 {
+			continue
+		}
 
-	s := new(big.Int)
-	s.Mul(r, secretKey).Add(s, e).Mul(s, new(big.Int).ModInverse(k, n)).Mod(s, n)
+		s := new(big.Int)
+		s.Mul(r, secretKey).Add(s, e).Mul(s, new(big.Int).ModInverse(k, n)).Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
 
-	if new(big.Int).Div(n, big.NewInt(2)).Cmp(s) == -1 {
-		s.Neg(s).Add(n, s)
-	}
+		// Parity of y, and whether x overflowed the order
+		recid := byte(curvePoint.y.Bit(0))
+		if curvePoint.x.Cmp(n) >= 0 {
+			recid |= 2
+		}
 
-	return Signature{r: r, s: s}
+		// Low s, negating s mirrors the nonce point so flip the parity
+		if new(big.Int).Div(n, big.NewInt(2)).Cmp(s) == -1 {
+			s.Neg(s).Add(n, s)
+			recid ^= 1
+		}
+
+		return Signature{r: r, s: s}, recid
+	}
 }
 
 // VerifySignature using ECDSA
 func (sig *Signature) VerifySignature(pk PublicKey, message []byte) bool {
+	return sig.verifyHash(pk, Hash256(message))
+}
+
+func (sig *Signature) verifyHash(pk PublicKey, hash []byte) bool {
 	n := &gen.order
 
 	if !pk.isValidPublicKey() || !sig.isValidSignature() {
 		return false
 	}
 
-	e := new(big.Int).SetBytes(Hash256(message))
+	e := new(big.Int).SetBytes(hash)
 
 	sInv := new(big.Int)
 	sInv.ModInverse(sig.s, n)
@@ -191,6 +216,11 @@ func RandomKeyPair() (secret *big.Int, pk PublicKey) {
 	return
 }
 
+// PublicKeyFromSecretKey computes the public key of a secret key
+func PublicKeyFromSecretKey(secret *big.Int) PublicKey {
+	return gen.publicKeyFromSecretKey(secret)
+}
+
 func (gen generator) publicKeyFromSecretKey(secret *big.Int) PublicKey {
 	return PublicKey{p: gen.G.curve.curveMultiply(secret, gen.G)}
 }
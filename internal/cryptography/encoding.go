@@ -4,8 +4,19 @@ import (
 	"errors"
 	"bytes"
 	"math/big"
+	"strings"
+	"github.com/harveynw/blokechain/internal/chainparams"
 )
 
+const base58alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// ErrInvalidBase58 when a string is not valid Base58 or too short to hold a checksum
+var ErrInvalidBase58 = errors.New("Invalid Base58 encoding")
+// ErrChecksumMismatch when the Base58Check checksum does not match the payload
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+// ErrInvalidAddress when a decoded address does not hold a 20 byte hash
+var ErrInvalidAddress = errors.New("Invalid address")
+
 func fromPoint(p point) PublicKey {
 	return PublicKey{p: p}
 }
@@ -15,16 +26,27 @@ func (pk PublicKey) HashEncode() []byte {
 	return Hash160(pk.EncodeCompressed())
 }
 
-// ToAddress gives a compressed public key address
-func (pk PublicKey) ToAddress() string {
-	pkHash := pk.HashEncode()
-	verPkHash := append([]byte("\x00"), pkHash...) // Main Net
-
-	checksumHash := Hash160(verPkHash)
+// ToAddress gives a compressed public key address on the given network
+func (pk PublicKey) ToAddress(params *chainparams.Params) string {
+	return Base58CheckEncode(params.PubKeyHashAddrID, pk.HashEncode())
+}
 
-	bytesAddress := append(verPkHash, checksumHash[:4]...)
+// ToSegwitAddress gives a native segwit (P2WPKH) address for the compressed public key on the given network
+func (pk PublicKey) ToSegwitAddress(params *chainparams.Params) string {
+	addr, _ := EncodeSegwitAddress(params.Bech32HRPSegwit, 0, pk.HashEncode())
+	return addr
+}
 
-	return Base58Encode(bytesAddress)
+// DecodeAddress parses a Base58Check address into its version byte and 20 byte hash
+func DecodeAddress(address string) (version byte, hash []byte, err error) {
+	version, hash, err = Base58CheckDecode(address)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(hash) != 20 {
+		return 0, nil, ErrInvalidAddress
+	}
+	return version, hash, nil
 }
 
 // Encode gives full (x, y) coordinates uncompressed for a public key
@@ -50,7 +72,7 @@ func (pk PublicKey) EncodeCompressed() []byte {
 		prefix = []byte{0x03}
 	}
 
-	return append(prefix, pk.p.x.Bytes()...)
+	return append(prefix, pk.p.x.FillBytes(make([]byte, 32))...)
 }
 
 // DecodePublicKey returns public key object from uncompressed format
@@ -94,8 +116,11 @@ func DecodePublicKeyCompressed(b []byte) (PublicKey, error) {
 // Encode signature using DER format
 func (sig Signature) Encode() []byte {
 	intEncode := func (i *big.Int) []byte {
-		buf := make([]byte, 32)
-		buf = i.FillBytes(buf)
+		// Minimal big-endian, with a zero byte so the integer is not read as negative
+		buf := i.Bytes()
+		if len(buf) == 0 || buf[0] & 0x80 != 0 {
+			buf = append([]byte{0x00}, buf...)
+		}
 		return append([]byte{0x02, byte(len(buf))}, buf...)
 	}
 
@@ -103,22 +128,29 @@ func (sig Signature) Encode() []byte {
 	return append([]byte{0x30, byte(len(contents))}, contents...)
 }
 
-// DecodeSignature recovers Signature from DER encoding
+// DecodeSignature recovers Signature from DER encoding, ignoring any trailing sighash byte
 func DecodeSignature(b []byte) (Signature, error) {
-	// SIGHASH_SINGLE only
-	if b[0] != 0x30 {
+	if len(b) < 8 || b[0] != 0x30 {
 		return *new(Signature) , errors.New("Invalid format")
 	}
 
 	contentLen := int(b[1])
-	
-	rStart, rHeader, rLen := 4, int(b[2]), int(b[3])
+	if len(b) < 2 + contentLen {
+		return *new(Signature) , errors.New("Invalid format")
+	}
+
+	rStart, rHeader, rLen := 4, 2, int(b[3])
+	if rStart+rLen+2 > 2 + contentLen {
+		return *new(Signature) , errors.New("Invalid r, s format")
+	}
 	rBytes := b[rStart:rStart+rLen]
 
-	sStart, sHeader, sLen := rStart+rLen+2, int(b[rStart+rLen]), int(b[rStart+rLen+1])
+	sStart, sHeader, sLen := rStart+rLen+2, rStart+rLen, int(b[rStart+rLen+1])
+	if sStart+sLen > 2 + contentLen {
+		return *new(Signature) , errors.New("Invalid r, s format")
+	}
 	sBytes := b[sStart:sStart+sLen]
 
-
 	if b[rHeader] != 0x02 || b[sHeader] != 0x02 || contentLen != 4 + rLen + sLen {
 		return *new(Signature) , errors.New("Invalid r, s format")
 	}
@@ -131,7 +163,6 @@ func DecodeSignature(b []byte) (Signature, error) {
 // Base58Encode Encodes arbitrary bytes
 func Base58Encode(b []byte) string {
 	x := new(big.Int).SetBytes(b)
-	base58alphabet := "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
 	base := big.NewInt(58)
 
 	output := *new([]byte)
@@ -149,6 +180,55 @@ func Base58Encode(b []byte) string {
 	return string(append(pad, reverseBytes(output)...))
 }
 
+// Base58Decode recovers the bytes from a Base58 string
+func Base58Decode(s string) ([]byte, error) {
+	x := new(big.Int)
+	base := big.NewInt(58)
+
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58alphabet, c)
+		if i == -1 {
+			return nil, ErrInvalidBase58
+		}
+		x.Mul(x, base).Add(x, big.NewInt(int64(i)))
+	}
+
+	// Leading zeros
+	trimmed := strings.TrimLeft(s, base58alphabet[0:1])
+	pad := make([]byte, len(s) - len(trimmed))
+
+	return append(pad, x.Bytes()...), nil
+}
+
+// Base58CheckEncode prefixes the payload with a version byte and appends a 4 byte checksum
+func Base58CheckEncode(version byte, payload []byte) string {
+	b := append([]byte{version}, payload...)
+	return Base58Encode(append(b, checksum(b)...))
+}
+
+// Base58CheckDecode verifies the checksum and returns the version byte and payload
+func Base58CheckDecode(s string) (version byte, payload []byte, err error) {
+	b, err := Base58Decode(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 1 + 4 {
+		return 0, nil, ErrInvalidBase58
+	}
+
+	data, check := b[:len(b)-4], b[len(b)-4:]
+	if !bytes.Equal(checksum(data), check) {
+		return 0, nil, ErrChecksumMismatch
+	}
+
+	return data[0], data[1:], nil
+}
+
+// checksum is the first 4 bytes of the double SHA-256 digest
+func checksum(b []byte) []byte {
+	return Hash256(b)[:4]
+}
+
 func reverseBytes(b []byte) []byte {
 	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
 		b[i], b[j] = b[j], b[i]
@@ -0,0 +1,290 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// HardenedKeyStart is the index of the first hardened child key
+const HardenedKeyStart uint32 = 0x80000000
+
+const serializedKeyLen = 4 + 1 + 4 + 4 + 32 + 33
+
+// ErrInvalidSeed when a master key seed is outside the 128 to 512 bit range
+var ErrInvalidSeed = errors.New("Seed must be between 128 and 512 bits")
+// ErrInvalidChild when a derivation yields an invalid key, the next index should be used instead
+var ErrInvalidChild = errors.New("Derived key is invalid, use the next index")
+// ErrDeriveHardenedFromPublic when a hardened child is requested from a public extended key
+var ErrDeriveHardenedFromPublic = errors.New("Cannot derive a hardened key from a public key")
+// ErrNotPrivate when an operation needs the private half of an extended key
+var ErrNotPrivate = errors.New("Extended key is not private")
+// ErrInvalidExtendedKey when a serialized extended key is malformed
+var ErrInvalidExtendedKey = errors.New("Invalid extended key")
+// ErrInvalidPath when a derivation path cannot be parsed
+var ErrInvalidPath = errors.New("Invalid derivation path")
+
+// ExtendedKey is a BIP32 hierarchical deterministic key, private if it holds a secret key
+type ExtendedKey struct {
+	version [4]byte
+	depth byte
+	parentFP []byte
+	childNum uint32
+	chainCode []byte
+	secret *big.Int
+	pk PublicKey
+}
+
+// NewMasterKey derives the root extended private key from a seed
+func NewMasterKey(seed []byte, params *chainparams.Params) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, ErrInvalidSeed
+	}
+
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+
+	secret := new(big.Int).SetBytes(I[:32])
+	if secret.Sign() == 0 || secret.Cmp(&gen.order) >= 0 {
+		return nil, ErrInvalidSeed
+	}
+
+	return &ExtendedKey{
+		version: params.HDPrivateKeyID,
+		parentFP: make([]byte, 4),
+		chainCode: I[32:],
+		secret: secret,
+		pk: gen.publicKeyFromSecretKey(secret),
+	}, nil
+}
+
+// Child derives the child key at index i, indexes from HardenedKeyStart give hardened keys
+func (k *ExtendedKey) Child(i uint32) (*ExtendedKey, error) {
+	if i >= HardenedKeyStart && !k.IsPrivate() {
+		return nil, ErrDeriveHardenedFromPublic
+	}
+
+	data := make([]byte, 0, 33 + 4)
+	if i >= HardenedKeyStart {
+		data = append(data, 0x00)
+		data = append(data, k.secret.FillBytes(make([]byte, 32))...)
+	} else {
+		data = append(data, k.pk.EncodeCompressed()...)
+	}
+	data = append(data, uint32Bytes(i)...)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	I := mac.Sum(nil)
+
+	tweak := new(big.Int).SetBytes(I[:32])
+	if tweak.Cmp(&gen.order) >= 0 {
+		return nil, ErrInvalidChild
+	}
+
+	child := &ExtendedKey{
+		version: k.version,
+		depth: k.depth + 1,
+		parentFP: k.Fingerprint(),
+		childNum: i,
+		chainCode: I[32:],
+	}
+
+	if k.IsPrivate() {
+		child.secret = new(big.Int).Add(tweak, k.secret)
+		child.secret.Mod(child.secret, &gen.order)
+		if child.secret.Sign() == 0 {
+			return nil, ErrInvalidChild
+		}
+		child.pk = gen.publicKeyFromSecretKey(child.secret)
+	} else {
+		p := gen.G.curve.addPointsOnCurve(gen.G.curve.curveMultiply(tweak, gen.G), k.pk.p)
+		if p.isZero() {
+			return nil, ErrInvalidChild
+		}
+		child.pk = PublicKey{p: p}
+	}
+
+	return child, nil
+}
+
+// Derive follows a path of child indexes from this key
+func (k *ExtendedKey) Derive(path []uint32) (*ExtendedKey, error) {
+	key := k
+	for _, i := range path {
+		var err error
+		key, err = key.Child(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Neuter returns the extended public key, dropping the secret key
+func (k *ExtendedKey) Neuter(params *chainparams.Params) *ExtendedKey {
+	return &ExtendedKey{
+		version: params.HDPublicKeyID,
+		depth: k.depth,
+		parentFP: k.parentFP,
+		childNum: k.childNum,
+		chainCode: k.chainCode,
+		pk: k.pk,
+	}
+}
+
+// IsPrivate reports whether the extended key holds a secret key
+func (k *ExtendedKey) IsPrivate() bool {
+	return k.secret != nil
+}
+
+// PublicKey returns the public key of this node
+func (k *ExtendedKey) PublicKey() PublicKey {
+	return k.pk
+}
+
+// SecretKey returns the secret key of this node
+func (k *ExtendedKey) SecretKey() (*big.Int, error) {
+	if !k.IsPrivate() {
+		return nil, ErrNotPrivate
+	}
+	return new(big.Int).Set(k.secret), nil
+}
+
+// Fingerprint is the first 4 bytes of the Hash160 of the public key
+func (k *ExtendedKey) Fingerprint() []byte {
+	return k.pk.HashEncode()[:4]
+}
+
+// ParentFingerprint identifies the parent key, zero for a master key
+func (k *ExtendedKey) ParentFingerprint() []byte {
+	return k.parentFP
+}
+
+// Depth is the number of derivations from the master key
+func (k *ExtendedKey) Depth() byte {
+	return k.depth
+}
+
+// ChildIndex is the index this key was derived at
+func (k *ExtendedKey) ChildIndex() uint32 {
+	return k.childNum
+}
+
+// String serializes the key as xprv/xpub (or the network's equivalent)
+func (k *ExtendedKey) String() string {
+	b := make([]byte, 0, serializedKeyLen + 4)
+	b = append(b, k.version[:]...)
+	b = append(b, k.depth)
+	b = append(b, k.parentFP...)
+	b = append(b, uint32Bytes(k.childNum)...)
+	b = append(b, k.chainCode...)
+	if k.IsPrivate() {
+		b = append(b, 0x00)
+		b = append(b, k.secret.FillBytes(make([]byte, 32))...)
+	} else {
+		b = append(b, k.pk.EncodeCompressed()...)
+	}
+	return Base58Encode(append(b, checksum(b)...))
+}
+
+// ParseExtendedKey recovers a serialized extended key, checking it belongs to the network
+func ParseExtendedKey(s string, params *chainparams.Params) (*ExtendedKey, error) {
+	version, payload, err := Base58CheckDecode(s)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte{version}, payload...)
+	if len(b) != serializedKeyLen {
+		return nil, ErrInvalidExtendedKey
+	}
+
+	k := &ExtendedKey{
+		depth: b[4],
+		parentFP: b[5:9],
+		childNum: binary.BigEndian.Uint32(b[9:13]),
+		chainCode: b[13:45],
+	}
+	copy(k.version[:], b[0:4])
+	keyData := b[45:78]
+
+	if k.depth == 0 && (!bytes.Equal(k.parentFP, make([]byte, 4)) || k.childNum != 0) {
+		return nil, ErrInvalidExtendedKey
+	}
+
+	switch k.version {
+	case params.HDPrivateKeyID:
+		if keyData[0] != 0x00 {
+			return nil, ErrInvalidExtendedKey
+		}
+		k.secret = new(big.Int).SetBytes(keyData[1:])
+		if k.secret.Sign() == 0 || k.secret.Cmp(&gen.order) >= 0 {
+			return nil, ErrInvalidExtendedKey
+		}
+		k.pk = gen.publicKeyFromSecretKey(k.secret)
+	case params.HDPublicKeyID:
+		pk, err := DecodePublicKeyCompressed(keyData)
+		if err != nil || !pk.p.isOnCurve() {
+			return nil, ErrInvalidExtendedKey
+		}
+		k.pk = pk
+	default:
+		return nil, ErrInvalidExtendedKey
+	}
+
+	return k, nil
+}
+
+// ParseDerivationPath parses paths like m/84'/0'/0'/0/5, accepting ' or h for hardened indexes
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, ErrInvalidPath
+	}
+
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") || strings.HasSuffix(part, "H")
+		if hardened {
+			part = part[:len(part)-1]
+		}
+
+		i, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || uint32(i) >= HardenedKeyStart {
+			return nil, ErrInvalidPath
+		}
+		if hardened {
+			i += uint64(HardenedKeyStart)
+		}
+		indexes = append(indexes, uint32(i))
+	}
+	return indexes, nil
+}
+
+// FormatDerivationPath is the inverse of ParseDerivationPath, using ' for hardened indexes
+func FormatDerivationPath(path []uint32) string {
+	var sb strings.Builder
+	sb.WriteString("m")
+	for _, i := range path {
+		if i >= HardenedKeyStart {
+			fmt.Fprintf(&sb, "/%d'", i - HardenedKeyStart)
+		} else {
+			fmt.Fprintf(&sb, "/%d", i)
+		}
+	}
+	return sb.String()
+}
+
+func uint32Bytes(i uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, i)
+	return b
+}
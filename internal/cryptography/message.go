@@ -0,0 +1,138 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+const messageMagic = "Bitcoin Signed Message:\n"
+
+// ErrInvalidCompactSignature when a compact signature is malformed or recovers no public key
+var ErrInvalidCompactSignature = errors.New("Invalid compact signature")
+// ErrNotPubKeyHashAddress when message signing is asked of anything but a P2PKH address
+var ErrNotPubKeyHashAddress = errors.New("Message signing needs a P2PKH address")
+
+// SignCompact signs a 32 byte digest as a 65 byte recoverable signature [header, r, s]
+func SignCompact(secretKey *big.Int, hash []byte, compressed bool) []byte {
+	sig, recid := signHash(secretKey, hash)
+
+	header := 27 + recid
+	if compressed {
+		header += 4
+	}
+
+	b := make([]byte, 0, 65)
+	b = append(b, header)
+	b = append(b, sig.r.FillBytes(make([]byte, 32))...)
+	b = append(b, sig.s.FillBytes(make([]byte, 32))...)
+	return b
+}
+
+// RecoverCompact recovers the signing public key from a compact signature of a digest
+func RecoverCompact(compactSig []byte, hash []byte) (pk PublicKey, compressed bool, err error) {
+	if len(compactSig) != 65 || compactSig[0] < 27 || compactSig[0] > 34 {
+		return PublicKey{}, false, ErrInvalidCompactSignature
+	}
+	recid := (compactSig[0] - 27) & 3
+	compressed = compactSig[0] >= 31
+
+	sig := Signature{r: new(big.Int).SetBytes(compactSig[1:33]), s: new(big.Int).SetBytes(compactSig[33:65])}
+	pk, err = RecoverPublicKey(sig, recid, hash)
+	return pk, compressed, err
+}
+
+// RecoverPublicKey finds the public key that produced a signature of a digest, given its recovery id
+func RecoverPublicKey(sig Signature, recid byte, hash []byte) (PublicKey, error) {
+	n := &gen.order
+	if !sig.isValidSignature() || recid > 3 {
+		return PublicKey{}, ErrInvalidCompactSignature
+	}
+
+	// Rebuild the nonce point R from r
+	x := new(big.Int).Set(sig.r)
+	if recid & 2 != 0 {
+		x.Add(x, n)
+	}
+	if x.Cmp(&secp256k1.p) >= 0 {
+		return PublicKey{}, ErrInvalidCompactSignature
+	}
+	even, odd := YfromX(x)
+	y := even
+	if recid & 1 == 1 {
+		y = odd
+	}
+	R := point{curve: &secp256k1, x: *x, y: *y}
+	if !R.isOnCurve() {
+		return PublicKey{}, ErrInvalidCompactSignature
+	}
+
+	// Q = r^-1 (sR - eG)
+	rInv := new(big.Int).ModInverse(sig.r, n)
+	e := new(big.Int).SetBytes(hash)
+	u1 := new(big.Int).Neg(e)
+	u1.Mul(u1, rInv).Mod(u1, n)
+	u2 := new(big.Int).Mul(sig.s, rInv)
+	u2.Mod(u2, n)
+
+	Q := secp256k1.addPointsOnCurve(secp256k1.curveMultiply(u1, gen.G), secp256k1.curveMultiply(u2, R))
+	if Q.isZero() {
+		return PublicKey{}, ErrInvalidCompactSignature
+	}
+	return PublicKey{p: Q}, nil
+}
+
+// MessageHash is the digest signed by signmessage, the double SHA-256 of the prefixed message
+func MessageHash(message string) []byte {
+	b := make([]byte, 0, len(messageMagic) + len(message) + 10)
+	b = append(b, compactSize(len(messageMagic))...)
+	b = append(b, messageMagic...)
+	b = append(b, compactSize(len(message))...)
+	b = append(b, message...)
+	return Hash256(b)
+}
+
+// SignBitcoinMessage signs a message like Bitcoin Core's signmessage, giving a base64 signature
+func SignBitcoinMessage(secretKey *big.Int, message string) string {
+	return base64.StdEncoding.EncodeToString(SignCompact(secretKey, MessageHash(message), true))
+}
+
+// VerifyBitcoinMessage checks a signmessage signature was made by the key behind a P2PKH address
+func VerifyBitcoinMessage(address, signature, message string, params *chainparams.Params) (bool, error) {
+	version, hash, err := DecodeAddress(address)
+	if err != nil {
+		return false, err
+	}
+	if version != params.PubKeyHashAddrID {
+		return false, ErrNotPubKeyHashAddress
+	}
+
+	compactSig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false, ErrInvalidCompactSignature
+	}
+	pk, compressed, err := RecoverCompact(compactSig, MessageHash(message))
+	if err != nil {
+		return false, err
+	}
+
+	recoveredHash := Hash160(pk.Encode())
+	if compressed {
+		recoveredHash = pk.HashEncode()
+	}
+	return bytes.Equal(recoveredHash, hash), nil
+}
+
+// compactSize is the variable length integer prefix used in Bitcoin serialization
+func compactSize(n int) []byte {
+	switch {
+	case n < 0xfd:
+		return []byte{byte(n)}
+	case n <= 0xffff:
+		return []byte{0xfd, byte(n), byte(n >> 8)}
+	default:
+		return []byte{0xfe, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}
+	}
+}
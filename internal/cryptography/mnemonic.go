@@ -0,0 +1,107 @@
+package cryptography
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+	"strings"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrInvalidEntropy when entropy is not 128 to 256 bits in steps of 32
+var ErrInvalidEntropy = errors.New("Entropy must be 128, 160, 192, 224 or 256 bits")
+// ErrInvalidMnemonic when a phrase has the wrong word count, unknown words or a bad checksum
+var ErrInvalidMnemonic = errors.New("Invalid mnemonic")
+// ErrNonASCIIPassphrase when a passphrase would need unicode normalisation, which is not supported
+var ErrNonASCIIPassphrase = errors.New("Passphrase must be ASCII")
+
+var wordIndex = func() map[string]int {
+	index := make(map[string]int, len(englishWordlist))
+	for i, word := range englishWordlist {
+		index[word] = i
+	}
+	return index
+}()
+
+// NewEntropy returns random entropy for a mnemonic, 128 bits gives 12 words and 256 bits gives 24
+func NewEntropy(bits int) ([]byte, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return nil, ErrInvalidEntropy
+	}
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return nil, err
+	}
+	return entropy, nil
+}
+
+// NewMnemonic encodes entropy as a BIP39 English mnemonic
+func NewMnemonic(entropy []byte) (string, error) {
+	bits := len(entropy) * 8
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", ErrInvalidEntropy
+	}
+	checksumBits := uint(bits / 32)
+
+	// Entropy followed by the first bits of its SHA-256
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, checksumBits)
+	data.Or(data, big.NewInt(int64(SHA256(entropy)[0] >> (8 - checksumBits))))
+
+	n := (bits + int(checksumBits)) / 11
+	words := make([]string, n)
+	mask := big.NewInt(2047)
+	for i := n - 1; i >= 0; i-- {
+		words[i] = englishWordlist[new(big.Int).And(data, mask).Int64()]
+		data.Rsh(data, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy recovers the entropy of a mnemonic, verifying its checksum
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, ErrInvalidMnemonic
+	}
+
+	data := new(big.Int)
+	for _, word := range words {
+		i, ok := wordIndex[word]
+		if !ok {
+			return nil, ErrInvalidMnemonic
+		}
+		data.Lsh(data, 11).Or(data, big.NewInt(int64(i)))
+	}
+
+	checksumBits := uint(len(words) / 3)
+	check := new(big.Int).And(data, big.NewInt(int64(1 << checksumBits - 1)))
+	entropy := data.Rsh(data, checksumBits).FillBytes(make([]byte, checksumBits * 4))
+
+	if check.Int64() != int64(SHA256(entropy)[0] >> (8 - checksumBits)) {
+		return nil, ErrInvalidMnemonic
+	}
+	return entropy, nil
+}
+
+// IsMnemonicValid reports whether every word is known and the checksum matches
+func IsMnemonicValid(mnemonic string) bool {
+	_, err := MnemonicToEntropy(mnemonic)
+	return err == nil
+}
+
+// MnemonicToSeed derives the 64 byte BIP32 seed with PBKDF2, the passphrase may be empty
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	if !IsMnemonicValid(mnemonic) {
+		return nil, ErrInvalidMnemonic
+	}
+	for _, c := range []byte(passphrase) {
+		if c > 127 {
+			return nil, ErrNonASCIIPassphrase
+		}
+	}
+
+	normalised := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(normalised), []byte("mnemonic" + passphrase), 2048, 64, sha512.New), nil
+}
@@ -0,0 +1,187 @@
+package cryptography
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// ErrInvalidXOnlyKey when 32 bytes are not the x coordinate of a point on the curve
+var ErrInvalidXOnlyKey = errors.New("Invalid x-only public key")
+// ErrSchnorrSign when signing yields an invalid nonce or a signature that fails verification
+var ErrSchnorrSign = errors.New("Schnorr signing failed")
+// ErrInvalidTweak when a taproot tweak is out of range
+var ErrInvalidTweak = errors.New("Invalid taproot tweak")
+
+// TaggedHash is the BIP340 domain separated hash SHA256(SHA256(tag) || SHA256(tag) || msg)
+func TaggedHash(tag string, msgs ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	return h.Sum(nil)
+}
+
+// XOnly encodes the public key as its 32 byte x coordinate (BIP340)
+func (pk PublicKey) XOnly() []byte {
+	return pk.p.x.FillBytes(make([]byte, 32))
+}
+
+// DecodeXOnly recovers the point with even y from a 32 byte x coordinate
+func DecodeXOnly(b []byte) (PublicKey, error) {
+	if len(b) != 32 {
+		return PublicKey{}, ErrInvalidXOnlyKey
+	}
+	p, ok := liftX(new(big.Int).SetBytes(b))
+	if !ok {
+		return PublicKey{}, ErrInvalidXOnlyKey
+	}
+	return PublicKey{p: p}, nil
+}
+
+// SchnorrSign gives a 64 byte BIP340 signature, aux should be 32 fresh random bytes or nil to draw them here
+func SchnorrSign(secretKey *big.Int, msg, aux []byte) ([]byte, error) {
+	n := &gen.order
+	if secretKey.Sign() <= 0 || secretKey.Cmp(n) >= 0 {
+		return nil, ErrSchnorrSign
+	}
+	if aux == nil {
+		aux = make([]byte, 32)
+		if _, err := rand.Read(aux); err != nil {
+			return nil, err
+		}
+	}
+
+	P := gen.G.curve.curveMultiply(secretKey, gen.G)
+	d := evenYSecret(secretKey, P)
+	px := P.x.FillBytes(make([]byte, 32))
+
+	// Nonce derived from the key, message and auxiliary randomness
+	t := d.FillBytes(make([]byte, 32))
+	for i, b := range TaggedHash("BIP0340/aux", aux) {
+		t[i] ^= b
+	}
+	k := new(big.Int).SetBytes(TaggedHash("BIP0340/nonce", t, px, msg))
+	k.Mod(k, n)
+	if k.Sign() == 0 {
+		return nil, ErrSchnorrSign
+	}
+	R := gen.G.curve.curveMultiply(k, gen.G)
+	k = evenYSecret(k, R)
+	rx := R.x.FillBytes(make([]byte, 32))
+
+	e := schnorrChallenge(rx, px, msg)
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k).Mod(s, n)
+
+	sig := append(rx, s.FillBytes(make([]byte, 32))...)
+	if !SchnorrVerify(px, msg, sig) {
+		return nil, ErrSchnorrSign
+	}
+	return sig, nil
+}
+
+// SchnorrVerify checks a 64 byte BIP340 signature against an x-only public key
+func SchnorrVerify(pubKeyX, msg, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	pk, err := DecodeXOnly(pubKeyX)
+	if err != nil {
+		return false
+	}
+
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(&secp256k1.p) >= 0 || s.Cmp(&gen.order) >= 0 {
+		return false
+	}
+
+	// R = sG - eP
+	e := schnorrChallenge(sig[:32], pubKeyX, msg)
+	e.Sub(&gen.order, e)
+	c := gen.G.curve
+	R := c.addPointsOnCurve(c.curveMultiply(s, gen.G), c.curveMultiply(e, pk.p))
+
+	return !R.isZero() && R.y.Bit(0) == 0 && R.x.Cmp(r) == 0
+}
+
+// TaprootOutputKey tweaks an internal key by a script tree root (nil for key path only), giving the x-only output key
+func TaprootOutputKey(internal PublicKey, merkleRoot []byte) ([]byte, error) {
+	P, ok := liftX(&internal.p.x)
+	if !ok {
+		return nil, ErrInvalidXOnlyKey
+	}
+	t, err := taprootTweak(P, merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	Q := gen.G.curve.addPointsOnCurve(P, gen.G.curve.curveMultiply(t, gen.G))
+	if Q.isZero() {
+		return nil, ErrInvalidTweak
+	}
+	return Q.x.FillBytes(make([]byte, 32)), nil
+}
+
+// TaprootTweakSecretKey tweaks a secret key so it signs for the output key of TaprootOutputKey
+func TaprootTweakSecretKey(secretKey *big.Int, merkleRoot []byte) (*big.Int, error) {
+	P := gen.G.curve.curveMultiply(secretKey, gen.G)
+	d := evenYSecret(secretKey, P)
+
+	t, err := taprootTweak(P, merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	tweaked := new(big.Int).Add(d, t)
+	tweaked.Mod(tweaked, &gen.order)
+	if tweaked.Sign() == 0 {
+		return nil, ErrInvalidTweak
+	}
+	return tweaked, nil
+}
+
+// ToTaprootAddress gives a key path only taproot (P2TR) address on the given network
+func (pk PublicKey) ToTaprootAddress(params *chainparams.Params) string {
+	outputKey, err := TaprootOutputKey(pk, nil)
+	if err != nil {
+		return ""
+	}
+	addr, _ := EncodeSegwitAddress(params.Bech32HRPSegwit, 1, outputKey)
+	return addr
+}
+
+func taprootTweak(P point, merkleRoot []byte) (*big.Int, error) {
+	t := new(big.Int).SetBytes(TaggedHash("TapTweak", P.x.FillBytes(make([]byte, 32)), merkleRoot))
+	if t.Cmp(&gen.order) >= 0 {
+		return nil, ErrInvalidTweak
+	}
+	return t, nil
+}
+
+func schnorrChallenge(rx, px, msg []byte) *big.Int {
+	e := new(big.Int).SetBytes(TaggedHash("BIP0340/challenge", rx, px, msg))
+	return e.Mod(e, &gen.order)
+}
+
+// evenYSecret negates a secret if its point has odd y, so it matches the x-only key
+func evenYSecret(secret *big.Int, p point) *big.Int {
+	if p.y.Bit(0) == 0 {
+		return new(big.Int).Set(secret)
+	}
+	return new(big.Int).Sub(&gen.order, secret)
+}
+
+// liftX finds the point with even y for x, if there is one
+func liftX(x *big.Int) (point, bool) {
+	if x.Cmp(&secp256k1.p) >= 0 {
+		return point{}, false
+	}
+	even, _ := YfromX(x)
+	p := point{curve: &secp256k1, x: *new(big.Int).Set(x), y: *even}
+	return p, p.isOnCurve()
+}
@@ -0,0 +1,47 @@
+package cryptography
+
+import (
+	"errors"
+	"math/big"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// ErrInvalidWIF when a string is not a valid Wallet Import Format key
+var ErrInvalidWIF = errors.New("Invalid WIF key")
+// ErrWIFNetwork when a WIF key was exported for a different network
+var ErrWIFNetwork = errors.New("WIF key is for a different network")
+
+// EncodeWIF gives the Wallet Import Format of a secret key on the given network
+func EncodeWIF(secret *big.Int, compressed bool, params *chainparams.Params) string {
+	payload := secret.FillBytes(make([]byte, 32))
+	if compressed {
+		payload = append(payload, 0x01)
+	}
+	return Base58CheckEncode(params.PrivateKeyID, payload)
+}
+
+// DecodeWIF recovers a secret key, reporting whether its public key should be compressed
+func DecodeWIF(wif string, params *chainparams.Params) (secret *big.Int, compressed bool, err error) {
+	version, payload, err := Base58CheckDecode(wif)
+	if err != nil {
+		return nil, false, ErrInvalidWIF // Never echo back the key material
+	}
+
+	switch {
+	case len(payload) == 33 && payload[32] == 0x01:
+		compressed = true
+	case len(payload) == 32:
+		compressed = false
+	default:
+		return nil, false, ErrInvalidWIF
+	}
+	if version != params.PrivateKeyID {
+		return nil, false, ErrWIFNetwork
+	}
+
+	secret = new(big.Int).SetBytes(payload[:32])
+	if secret.Sign() == 0 || secret.Cmp(&gen.order) >= 0 {
+		return nil, false, ErrInvalidWIF
+	}
+	return secret, compressed, nil
+}
@@ -2,8 +2,10 @@ package miner
 
 import (
 	"fmt"
+	"math/big"
 	"time"
 	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
 )
 
 // Mine performs a fixed number of iterations attempting to mine a block header
@@ -38,10 +40,19 @@ func Mine(bh chain.BlockHeader) (success bool, bhSolved chain.BlockHeader) {
 	return false, bh
 }
 
-// MinerTest tests
+// MinerTest times mining the regtest genesis header from nonce zero, halving the target four times each round
 func MinerTest() {
-	for i := 1; i <= 256; i+=2 {
-		genBlockHeader := chain.Genesis(int64(i)).Header
+	params := chainparams.RegTest()
+	for i := 0; i <= 24; i+=4 {
+		genBlockHeader := chain.Genesis(params).Header
+		target, _ := chain.DifficultyFromBits(params.GenesisBits)
+		target, err := target.Div(new(big.Int).Lsh(big.NewInt(1), uint(i)))
+		if err != nil {
+			fmt.Println("Failed to set difficulty:", err)
+			return
+		}
+		genBlockHeader.DifficultyTarget = target
+		genBlockHeader.Nonce = 0
 		start := time.Now()
 		success := false
 		for !success {
@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// ErrInvalidBlock when the node returns a block that cannot be decoded
+var ErrInvalidBlock = errors.New("Node returned an invalid block")
+// ErrInvalidBlockHeader when the node returns a block header that cannot be decoded
+var ErrInvalidBlockHeader = errors.New("Node returned an invalid block header")
+// ErrInvalidTransaction when the node returns a transaction that cannot be decoded
+var ErrInvalidTransaction = errors.New("Node returned an invalid transaction")
+// ErrInvalidCookie when a cookie file is not of the form user:password
+var ErrInvalidCookie = errors.New("Invalid RPC cookie file")
+
+// Error returned by the node for a failed call
+type Error struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// Client for the JSON-RPC interface of a Bitcoin Core node
+type Client struct {
+	URL string
+	User, Password string
+	HTTP *http.Client
+}
+
+// NewClient connects to url with basic authentication
+func NewClient(url, user, password string) *Client {
+	return &Client{URL: url, User: user, Password: password, HTTP: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// NewCookieClient connects to url with the credentials the node writes to its cookie file
+func NewCookieClient(url, cookiePath string) (*Client, error) {
+	data, err := ioutil.ReadFile(cookiePath)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCookie
+	}
+	return NewClient(url, parts[0], parts[1]), nil
+}
+
+// DefaultURL is the RPC address of a node on the same machine
+func DefaultURL(params *chainparams.Params) string {
+	return "http://127.0.0.1:" + params.RPCPort
+}
+
+// DefaultCookiePath is where Bitcoin Core writes its cookie file with its default data directory
+func DefaultCookiePath(params *chainparams.Params) string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".bitcoin", params.CoreDataSubdir, ".cookie")
+}
+
+// Call invokes method with positional params, decoding the result into result unless it is nil
+func (c *Client) Call(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "1.0", "id": "blokechain", "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.User, c.Password)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("RPC authentication failed (%v)", resp.Status)
+	}
+
+	// Core answers failed calls with a 500 status and the error in the body
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error *Error `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("Invalid RPC response (%v): %w", resp.Status, err)
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// SendRawTransaction submits a serialized transaction to the node's mempool and returns its txid
+func (c *Client) SendRawTransaction(raw []byte) (string, error) {
+	var txid string
+	err := c.Call("sendrawtransaction", &txid, hex.EncodeToString(raw))
+	return txid, err
+}
+
+// BestHeight is the height of the node's best block
+func (c *Client) BestHeight() (int32, error) {
+	var height int32
+	err := c.Call("getblockcount", &height)
+	return height, err
+}
+
+// BlockHash is the hash, in internal byte order, of the best chain's block at height
+func (c *Client) BlockHash(height int32) ([]byte, error) {
+	var hash string
+	if err := c.Call("getblockhash", &hash, height); err != nil {
+		return nil, err
+	}
+	return chain.ParseHash(hash)
+}
+
+// BlockHeader fetches and decodes the header of a block by hash
+func (c *Client) BlockHeader(hash []byte) (*chain.BlockHeader, error) {
+	var raw string
+	if err := c.Call("getblockheader", &raw, chain.HashString(hash), false); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, ErrInvalidBlockHeader
+	}
+	header, rest, err := chain.DecodeNextBlockHeader(data)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrInvalidBlockHeader
+	}
+	return &header, nil
+}
+
+// Block fetches and decodes a block by hash
+func (c *Client) Block(hash []byte) (chain.Block, error) {
+	var raw string
+	if err := c.Call("getblock", &raw, chain.HashString(hash), 0); err != nil {
+		return chain.Block{}, err
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return chain.Block{}, ErrInvalidBlock
+	}
+	block, rest, err := chain.DecodeBlockData(data)
+	if err != nil || len(rest) != 0 {
+		return chain.Block{}, ErrInvalidBlock
+	}
+	return block, nil
+}
+
+// Mempool lists the ids, in internal byte order, of the transactions in the node's mempool
+func (c *Client) Mempool() ([][]byte, error) {
+	var txids []string
+	if err := c.Call("getrawmempool", &txids); err != nil {
+		return nil, err
+	}
+	ids := make([][]byte, 0, len(txids))
+	for _, txid := range txids {
+		id, err := chain.ParseHash(txid)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Transaction fetches and decodes a mempool transaction by id, confirmed ones need the node's -txindex
+func (c *Client) Transaction(id []byte) (chain.Transaction, error) {
+	var raw string
+	if err := c.Call("getrawtransaction", &raw, chain.HashString(id), false); err != nil {
+		return chain.Transaction{}, err
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return chain.Transaction{}, ErrInvalidTransaction
+	}
+	tx, rest, err := chain.DecodeNextTransaction(data)
+	if err != nil || len(rest) != 0 {
+		return chain.Transaction{}, ErrInvalidTransaction
+	}
+	return tx, nil
+}
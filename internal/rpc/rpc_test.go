@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendRawTransaction(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "__cookie__" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Method string
+			Params []string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "sendrawtransaction" {
+			t.Errorf("Unexpected method %s", req.Method)
+		}
+		if req.Params[0] == "00" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"result":null,"error":{"code":-22,"message":"TX decode failed"},"id":"blokechain"}`))
+			return
+		}
+		w.Write([]byte(`{"result":"` + req.Params[0] + `","error":null,"id":"blokechain"}`))
+	}))
+	defer server.Close()
+
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	ioutil.WriteFile(cookie, []byte("__cookie__:secret\n"), 0600)
+	client, err := NewCookieClient(server.URL, cookie)
+	if err != nil {
+		t.Fatalf("Failed to read cookie %v", err)
+	}
+
+	if txid, err := client.SendRawTransaction([]byte{0xab, 0xcd}); err != nil || txid != "abcd" {
+		t.Errorf("Got %s (%v)", txid, err)
+	}
+	_, err = client.SendRawTransaction([]byte{0x00})
+	if rpcErr, ok := err.(*Error); !ok || rpcErr.Code != -22 {
+		t.Errorf("Expected node error, got %v", err)
+	}
+	if _, err := NewClient(server.URL, "user", "wrong").SendRawTransaction([]byte{0x01}); err == nil {
+		t.Errorf("Expected authentication failure")
+	}
+}
+
+func TestBlockSource(t *testing.T) {
+	// Regtest genesis times and bits, encoded as the header decoder reads them
+	genesisCoinbase := "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+	genesisTxID := "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+	rawHeader := "02000001" + strings.Repeat("00", 64) + "dae5494d" + "ffff7f20" + "02000000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string
+			Params []interface{}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "getblockcount":
+			w.Write([]byte(`{"result":7,"error":null}`))
+		case "getblockhash":
+			w.Write([]byte(`{"result":"0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206","error":null}`))
+		case "getblockheader":
+			w.Write([]byte(`{"result":"` + rawHeader + `","error":null}`))
+		case "getblock":
+			w.Write([]byte(`{"result":"0100","error":null}`))
+		case "getrawmempool":
+			w.Write([]byte(`{"result":["` + genesisTxID + `"],"error":null}`))
+		case "getrawtransaction":
+			if req.Params[0] != genesisTxID {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"result":null,"error":{"code":-5,"message":"No such mempool or blockchain transaction"}}`))
+				return
+			}
+			w.Write([]byte(`{"result":"` + genesisCoinbase + `","error":null}`))
+		}
+	}))
+	defer server.Close()
+	client := NewClient(server.URL, "user", "password")
+
+	if height, err := client.BestHeight(); err != nil || height != 7 {
+		t.Errorf("Got height %v (%v)", height, err)
+	}
+	hash, err := client.BlockHash(0)
+	if err != nil || hash[0] != 0x06 || hash[31] != 0x0f {
+		t.Errorf("Hash not in internal byte order %x (%v)", hash, err)
+	}
+	if header, err := client.BlockHeader(hash); err != nil || header.Time != 1296688602 || hex.EncodeToString(header.Encode()) != rawHeader {
+		t.Errorf("Got header %v (%v)", header, err)
+	}
+	if _, err := client.Block(hash); err != ErrInvalidBlock {
+		t.Errorf("Expected truncated block to be rejected, got %v", err)
+	}
+
+	ids, err := client.Mempool()
+	if err != nil || len(ids) != 1 || ids[0][0] != 0x3b {
+		t.Fatalf("Mempool ids not in internal byte order %x (%v)", ids, err)
+	}
+	if tx, err := client.Transaction(ids[0]); err != nil || hex.EncodeToString(tx.Encode(-1)) != genesisCoinbase {
+		t.Errorf("Got transaction %x (%v)", tx.Encode(-1), err)
+	}
+	if _, err := client.Transaction(hash); err == nil {
+		t.Errorf("Expected unknown transaction to fail")
+	}
+}
@@ -43,6 +43,9 @@ func decodeInt(b []byte) (err bool, val int64) {
 		return false, 0
 	}
 
+	// Work on a copy, b may alias the script or the stack
+	b = append(make([]byte, 0, 8), b...)
+
 	// Determine sign and remove sign bit
 	t := b[l-1]
 	isNeg := int64((t >> 7) & 0x01)
@@ -73,7 +73,7 @@ func OP_CHECKSIG(vm *VM) bool {
 	if err3 != nil {
 		return false
 	}
-	pubKey, err4 := cryptography.DecodePublicKeyCompressed(pubKeyBytes)
+	pubKey, err4 := decodePublicKey(pubKeyBytes)
 	if err4 != nil {
 		return false
 	}
@@ -87,88 +87,92 @@ func OP_CHECKSIG(vm *VM) bool {
 	return true
 }
 
+// OP_CHECKSIGVERIFY Same as OP_CHECKSIG, then OP_VERIFY
 func OP_CHECKSIGVERIFY(vm *VM) bool {
-	err1 := OP_CHECKSIG(vm)
-	if err1 {
+	if !OP_CHECKSIG(vm) {
 		return false
 	}
-
-	err2 := OP_VERIFY(vm)
-	return !err2
+	return OP_VERIFY(vm)
 }
 
+// OP_CHECKMULTISIG Pushes true if the m signatures match m of the n pub keys, in the same order
 func OP_CHECKMULTISIG(vm *VM) bool {
-	// Public Keys
-	err_m, m_b := vm.Pop(false)
-	if err_m {
+	// Public Keys, popped in reverse so put back in script order
+	err_n, n_b := vm.Pop(false)
+	if err_n {
 		return false
 	}
-	err_dec_m, m := decodeInt(m_b)
-	if err_dec_m {
+	err_dec_n, n := decodeInt(n_b)
+	if err_dec_n || n < 0 || n > 20 {
 		return false
 	}
-	pks := make([]cryptography.PublicKey, 0)
-	for i := int64(0); i < m; i++ {
+	pks := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
 		err_pk, pk_b := vm.Pop(false)
 		if err_pk {
 			return false
 		}
-		pubKey, pk_dec_err := cryptography.DecodePublicKeyCompressed(pk_b)
-		if pk_dec_err != nil {
-			return false
-		}
-		pks = append(pks, pubKey)
+		pks[i] = pk_b
 	}
 
 	// Signatures
-	err_n, n_b := vm.Pop(false)
-	if err_n {
+	err_m, m_b := vm.Pop(false)
+	if err_m {
 		return false
 	}
-	err_dec_n, n := decodeInt(n_b)
-	if err_dec_n {
+	err_dec_m, m := decodeInt(m_b)
+	if err_dec_m || m < 0 || m > n {
 		return false
 	}
-	sigs := make([]cryptography.Signature, 0)
-	for i := int64(0); i < n; i++ {
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
 		err_sig, sig_b := vm.Pop(false)
 		if err_sig {
 			return false
 		}
-		signature, sig_dec_err := cryptography.DecodeSignature(sig_b)
-		if sig_dec_err != nil {
-			return false
-		}
-		sigs = append(sigs, signature)
+		sigs[i] = sig_b
 	}
 
 	// BIP 147 Requirement
 	err_bug, dummy := vm.Pop(false)
-	if err_bug || !isZero(dummy) {
+	if err_bug || len(dummy) != 0 {
 		return false
 	}
 
-	// Check signatures
-	for _, signature := range sigs {
-		pks_left := len(pks)
-		for idx := 0; idx < pks_left; idx++ {
-			if signature.VerifySignature(pks[idx], vm.Transaction) {
-				pks = append(pks[:idx], pks[idx+1:]...)
-				continue
-			}
+	// Each signature must match a later public key than the one before it
+	success := true
+	for len(sigs) > 0 {
+		if len(pks) < len(sigs) {
+			success = false
+			break
 		}
-		return false
+		signature, sig_dec_err := cryptography.DecodeSignature(sigs[0])
+		pubKey, pk_dec_err := decodePublicKey(pks[0])
+		if sig_dec_err == nil && pk_dec_err == nil && signature.VerifySignature(pubKey, vm.Transaction) {
+			sigs = sigs[1:]
+		}
+		pks = pks[1:]
 	}
 
+	if success {
+		vm.Push([]byte{0x01}, false)
+	} else {
+		vm.Push([]byte{}, false)
+	}
 	return true
 }
 
+// OP_CHECKMULTISIGVERIFY Same as OP_CHECKMULTISIG, then OP_VERIFY
 func OP_CHECKMULTISIGVERIFY(vm *VM) bool {
-	err1 := OP_CHECKMULTISIG(vm)
-	if err1 {
+	if !OP_CHECKMULTISIG(vm) {
 		return false
 	}
+	return OP_VERIFY(vm)
+}
 
-	err2 := OP_VERIFY(vm)
-	return !err2
-}
\ No newline at end of file
+func decodePublicKey(b []byte) (cryptography.PublicKey, error) {
+	if len(b) == 65 {
+		return cryptography.DecodePublicKey(b)
+	}
+	return cryptography.DecodePublicKeyCompressed(b)
+}
@@ -1,5 +1,13 @@
 package script
 
+import (
+	"encoding/binary"
+)
+
+var op_pushdata1 byte = 0x4c
+var op_pushdata2 byte = 0x4d
+var op_pushdata4 byte = 0x4e
+
 var op_if byte = 0x63
 var op_notif byte = 0x64
 var op_else byte = 0x67
@@ -22,26 +30,40 @@ func parseNext(scriptBytes []byte, vm *VM) (err bool, isOpCode bool, selected []
 	}
 
 	// Data or Opcode
-	err = false
-	isOpCode, selected, remainingBytes = parseStatement(scriptBytes)
+	err, isOpCode, selected, remainingBytes = parseStatement(scriptBytes)
 	return
 }
 
-func parseStatement(scriptBytes []byte) (isOpCode bool, statement []byte, remainingBytes []byte) {
+func parseStatement(scriptBytes []byte) (err bool, isOpCode bool, statement []byte, remainingBytes []byte) {
 	first := scriptBytes[0]
 
-	// Data
+	// Data, either the length itself or a PUSHDATA opcode followed by a little-endian length
+	length, header := -1, 1
 	if first <= 0x4b && first >= 0x01 {
-		length := int(first)
-		return false, scriptBytes[1 : length+1], scriptBytes[length+1:]
+		length = int(first)
+	} else if first == op_pushdata1 && len(scriptBytes) >= 2 {
+		length, header = int(scriptBytes[1]), 2
+	} else if first == op_pushdata2 && len(scriptBytes) >= 3 {
+		length, header = int(binary.LittleEndian.Uint16(scriptBytes[1:3])), 3
+	} else if first == op_pushdata4 && len(scriptBytes) >= 5 {
+		length, header = int(binary.LittleEndian.Uint32(scriptBytes[1:5])), 5
+	} else if first == op_pushdata1 || first == op_pushdata2 || first == op_pushdata4 {
+		return true, false, nil, nil
+	}
+
+	if length >= 0 {
+		if len(scriptBytes) < header+length {
+			return true, false, nil, nil
+		}
+		return false, false, scriptBytes[header : header+length], scriptBytes[header+length:]
 	}
 
 	// Opcode
-	return true, []byte{first}, scriptBytes[1:]
+	return false, true, []byte{first}, scriptBytes[1:]
 }
 
 func trimControlFlow(scriptBytes []byte, vm *VM) (err bool, trimmed []byte) {
-	beginsWithOp, op, scriptBytes := parseStatement(scriptBytes)
+	_, beginsWithOp, op, scriptBytes := parseStatement(scriptBytes)
 	if !beginsWithOp || !(op[0] == op_if || op[0] == op_notif) || len(vm.Stack) == 0 {
 		return false, nil
 	}
@@ -51,9 +73,20 @@ func trimControlFlow(scriptBytes []byte, vm *VM) (err bool, trimmed []byte) {
 	in_false_branch := false
 	true_branch, false_branch := make([]byte, 0), make([]byte, 0)
 	for {
-		var is_op bool
+		if len(scriptBytes) == 0 {
+			// No matching OP_ENDIF
+			return true, nil
+		}
+
+		var parse_err, is_op bool
 		var data []byte
-		is_op, data, scriptBytes = parseStatement(scriptBytes)
+		statement := scriptBytes
+		parse_err, is_op, data, scriptBytes = parseStatement(scriptBytes)
+		if parse_err {
+			return true, nil
+		}
+		// Keep the push prefix when copying into a branch
+		statement = statement[:len(statement)-len(scriptBytes)]
 
 		if is_op {
 			op_code := data[0]
@@ -81,9 +114,9 @@ func trimControlFlow(scriptBytes []byte, vm *VM) (err bool, trimmed []byte) {
 		}
 
 		if in_false_branch {
-			false_branch = append(false_branch, data...)
+			false_branch = append(false_branch, statement...)
 		} else {
-			true_branch = append(true_branch, data...)
+			true_branch = append(true_branch, statement...)
 		}
 	}
 
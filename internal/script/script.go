@@ -111,7 +111,7 @@ var operations = map[byte]func(*VM) bool{
 	0xab: OP_CODESEPERATOR,
 	0xac: OP_CHECKSIG,
 	0xad: OP_CHECKSIGVERIFY,
-	0xae: OP_CHECKMULTISIG, // Needs testing
+	0xae: OP_CHECKMULTISIG,
 	0xaf: OP_CHECKMULTISIGVERIFY,
 
 	// LOCKTIME
@@ -143,15 +143,41 @@ func (src *Script) AppendOpCode(op byte) {
 	src.data = append(src.data, op)
 }
 
-// AppendData for arbitrary bytes
+// AppendData for arbitrary bytes, using the smallest push opcode for the length
 func (src *Script) AppendData(b []byte) {
-	src.data = append(src.data, byte(len(b)))
+	switch {
+	case len(b) <= 0x4b:
+		src.data = append(src.data, byte(len(b)))
+	case len(b) <= 0xff:
+		src.data = append(src.data, op_pushdata1, byte(len(b)))
+	case len(b) <= 0xffff:
+		src.data = append(src.data, op_pushdata2, byte(len(b)), byte(len(b) >> 8))
+	default:
+		src.data = append(src.data, op_pushdata4, byte(len(b)), byte(len(b) >> 8), byte(len(b) >> 16), byte(len(b) >> 24))
+	}
 	src.data = append(src.data, b...)
 }
 
 // Execute the script, returns success/failure
 func (src *Script) Execute(transactionEncoded []byte) bool {
 	vm := NewVM(transactionEncoded)
+	if !vm.Run(src) {
+		return false
+	}
+
+	// Final result of script
+	err, top := vm.Pop(false)
+	if vm.Trace {
+		fmt.Printf("%x \n", top)
+	}
+	if err || !isTruthy(top) {
+		return false
+	}
+	return true
+}
+
+// Run executes a script against the current stacks, so scripts can be chained (scriptSig then scriptPubKey)
+func (vm *VM) Run(src *Script) bool {
 	scriptBytes := src.data
 
 	// Sequentially execute script
@@ -167,31 +193,44 @@ func (src *Script) Execute(transactionEncoded []byte) bool {
 		if parserErr {
 			return false
 		}
+		if selected == nil && !isOp {
+			// Control flow left nothing to run
+			continue
+		}
 
-		if isOp {
-			fmt.Printf("Stack %x Op:%x(%v) Remaining Script Bytes: [%x] \n", vm.Stack, selected, retrieveOpName(selected[0]), scriptBytes)
-		} else {
-			fmt.Printf("Stack %x Push:%x Script Bytes [%x] \n", vm.Stack, selected, scriptBytes)
+		if vm.Trace {
+			if isOp {
+				fmt.Printf("Stack %x Op:%x(%v) Remaining Script Bytes: [%x] \n", vm.Stack, selected, retrieveOpName(selected[0]), scriptBytes)
+			} else {
+				fmt.Printf("Stack %x Push:%x Script Bytes [%x] \n", vm.Stack, selected, scriptBytes)
+			}
 		}
 
 		if isOp {
-			success := operations[selected[0]](vm)
+			op, known := operations[selected[0]]
+			if !known {
+				return false
+			}
+			success := op(vm)
 			if !success {
-				fmt.Printf("Failed on requested OP %x, is it disabled? \n", selected[0])
+				if vm.Trace {
+					fmt.Printf("Failed on requested OP %x, is it disabled? \n", selected[0])
+				}
 				return false
 			}
 		} else {
 			vm.Push(selected, false)
 		}
 	}
+	return true
+}
 
-	// Final result of script
-	err, top := vm.Pop(false)
-	fmt.Printf("%x \n", top)
-	if err || len(top) == 0 || (len(top) == 1 && top[0] == 0x00) {
+// Succeeded reports whether the top of the stack is truthy, the result of a finished script
+func (vm *VM) Succeeded() bool {
+	if len(vm.Stack) == 0 {
 		return false
 	}
-	return true
+	return isTruthy(vm.Stack[len(vm.Stack)-1])
 }
 
 // Encode returns script as bytes
@@ -235,10 +274,13 @@ func (src *Script) Print() {
 			fmt.Println(line, "OP_NOTIF")
 			scriptBytes = scriptBytes[1:]
 		} else {
-			var isOp bool
+			var parserErr, isOp bool
 			var selected []byte
-			_, isOp, selected, scriptBytes = parseNext(scriptBytes, nil)
-			if isOp {
+			parserErr, isOp, selected, scriptBytes = parseNext(scriptBytes, nil)
+			if parserErr {
+				fmt.Println(line, "INVALID PUSH")
+				break
+			} else if isOp {
 				fmt.Println(line, retrieveOpName(selected[0]))
 			} else {
 				fmt.Printf("%v %x \n", line, selected)
@@ -1,7 +1,12 @@
 package script
 
 import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
 	"testing"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
 )
 
 func TestArithmetic(t *testing.T) {
@@ -67,3 +72,86 @@ func TestNestedControlFlow(t *testing.T) {
 		t.Errorf("Should return true, got %v \n", result)
 	}
 }
+
+func TestPayToAddress(t *testing.T) {
+	cases := map[string]string{
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa": "76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac",
+		"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy": "a914b472a266d0bd89c13706a4132ccfb16f7c3b9fcb87",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4": "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+	}
+	for address, expected := range cases {
+		script, err := PayToAddress(address, chainparams.MainNet())
+		if err != nil {
+			t.Errorf("Failed on %s: %v", address, err)
+			continue
+		}
+		if hex.EncodeToString(script.Encode()) != expected {
+			t.Errorf("Wrong locking script for %s: %x", address, script.Encode())
+		}
+	}
+
+	if _, err := PayToAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", chainparams.TestNet()); err != ErrWrongNetwork {
+		t.Errorf("Expected mainnet address to be rejected on testnet, got %v", err)
+	}
+	if _, err := PayToAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", chainparams.RegTest()); err == nil {
+		t.Error("Expected mainnet segwit address to be rejected on regtest")
+	}
+}
+
+func TestCheckMultisig(t *testing.T) {
+	tx := []byte("transaction")
+	secretKeys, pubKeys := make([]*big.Int, 3), make([][]byte, 3)
+	for i := range secretKeys {
+		var pk cryptography.PublicKey
+		secretKeys[i], pk = cryptography.RandomKeyPair()
+		pubKeys[i] = pk.EncodeCompressed()
+	}
+	sign := func(i int) []byte {
+		return cryptography.SignMessage(secretKeys[i], tx).Encode()
+	}
+
+	cases := []struct {
+		sigs [][]byte
+		valid bool
+	}{
+		{[][]byte{sign(0), sign(1)}, true},
+		{[][]byte{sign(0), sign(2)}, true},
+		{[][]byte{sign(2), sign(0)}, false}, // Out of order
+		{[][]byte{sign(1), sign(1)}, false}, // Same key twice
+	}
+	for i, c := range cases {
+		src := NewScript()
+		src.AppendOpCode(0x00) // Dummy
+		for _, sig := range c.sigs {
+			src.AppendData(sig)
+		}
+		src.Concat(Multisig(2, pubKeys))
+
+		if result := src.Execute(tx); result != c.valid {
+			t.Errorf("Case %v should return %v, got %v", i, c.valid, result)
+		}
+	}
+
+	m, parsed, ok := ParseMultisig(Multisig(2, pubKeys).Encode())
+	if !ok || m != 2 || len(parsed) != 3 || !bytes.Equal(parsed[2], pubKeys[2]) {
+		t.Errorf("Failed to parse multisig script")
+	}
+}
+
+func TestPushData(t *testing.T) {
+	for _, size := range []int{0x4b, 0x4c, 0xff, 0x100, 0x208} {
+		data := bytes.Repeat([]byte{0xab}, size)
+		src := NewScript()
+		src.AppendData(data)
+
+		items, ok := PushedData(src.Encode())
+		if !ok || len(items) != 1 || !bytes.Equal(items[0], data) {
+			t.Errorf("Push of %v bytes did not round trip", size)
+		}
+	}
+
+	if _, ok := PushedData([]byte{0x4d, 0xff}); ok {
+		t.Error("Truncated PUSHDATA2 should be rejected")
+	}
+}
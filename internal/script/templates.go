@@ -1,5 +1,23 @@
 package script
 
+import (
+	"errors"
+	"strings"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+)
+
+// ErrWrongNetwork when an address does not belong to the selected network
+var ErrWrongNetwork = errors.New("Address is for a different network")
+
+// P2PK (Pay to Public Key) generates the locking script of early coinbases, checking a signature against the key itself
+func P2PK(pubKey []byte) *Script {
+	script := NewScript()
+	script.AppendData(pubKey)
+	script.AppendOpCode(0xac)
+	return script
+}
+
 // P2PKH (Pay to Public Key Hash) generates the boilerplate fund locking script
 func P2PKH(address []byte) *Script {
 	script := NewScript()
@@ -9,4 +27,116 @@ func P2PKH(address []byte) *Script {
 	script.AppendOpCode(0x88)
 	script.AppendOpCode(0xac)
 	return script
-}
\ No newline at end of file
+}
+
+// P2SH (Pay to Script Hash) generates the locking script for the hash of a redeem script
+func P2SH(scriptHash []byte) *Script {
+	script := NewScript()
+	script.AppendOpCode(0xa9)
+	script.AppendData(scriptHash)
+	script.AppendOpCode(0x87)
+	return script
+}
+
+// WitnessProgram generates a native segwit locking script (P2WPKH, P2WSH, P2TR...)
+func WitnessProgram(version byte, program []byte) *Script {
+	script := NewScript()
+	if version == 0 {
+		script.AppendOpCode(0x00)
+	} else {
+		script.AppendOpCode(0x50 + version)
+	}
+	script.AppendData(program)
+	return script
+}
+
+// PayToAddress decodes an address on the given network and generates its locking script
+func PayToAddress(address string, params *chainparams.Params) (*Script, error) {
+	if strings.HasPrefix(strings.ToLower(address), params.Bech32HRPSegwit + "1") {
+		version, program, err := cryptography.DecodeSegwitAddress(params.Bech32HRPSegwit, strings.ToLower(address))
+		if err != nil {
+			return nil, err
+		}
+		return WitnessProgram(version, program), nil
+	}
+
+	version, hash, err := cryptography.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case params.PubKeyHashAddrID:
+		return P2PKH(hash), nil
+	case params.ScriptHashAddrID:
+		return P2SH(hash), nil
+	}
+	return nil, ErrWrongNetwork
+}
+
+// Multisig generates an m of n bare multisig script, also used as a P2SH or P2WSH redeem script
+func Multisig(m int, pubKeys [][]byte) *Script {
+	script := NewScript()
+	script.AppendOpCode(0x50 + byte(m))
+	for _, pk := range pubKeys {
+		script.AppendData(pk)
+	}
+	script.AppendOpCode(0x50 + byte(len(pubKeys)))
+	script.AppendOpCode(0xae)
+	return script
+}
+
+// ParseMultisig recovers m and the public keys of a script made by Multisig
+func ParseMultisig(redeemScript []byte) (m int, pubKeys [][]byte, ok bool) {
+	if len(redeemScript) < 3 || redeemScript[len(redeemScript)-1] != 0xae {
+		return 0, nil, false
+	}
+	m, n := int(redeemScript[0]) - 0x50, int(redeemScript[len(redeemScript)-2]) - 0x50
+	if m < 1 || m > 16 || n < m || n > 16 {
+		return 0, nil, false
+	}
+
+	pubKeys, pushOnly := PushedData(redeemScript[1:len(redeemScript)-2])
+	if !pushOnly || len(pubKeys) != n {
+		return 0, nil, false
+	}
+	return m, pubKeys, true
+}
+
+// IsP2SH reports whether a locking script pays to a script hash
+func IsP2SH(scriptPubKey []byte) bool {
+	return len(scriptPubKey) == 23 && scriptPubKey[0] == 0xa9 && scriptPubKey[1] == 0x14 && scriptPubKey[22] == 0x87
+}
+
+// ParseWitnessProgram returns the version and program of a native segwit locking script
+func ParseWitnessProgram(scriptPubKey []byte) (version byte, program []byte, ok bool) {
+	if len(scriptPubKey) < 4 || len(scriptPubKey) > 42 || int(scriptPubKey[1]) != len(scriptPubKey)-2 {
+		return 0, nil, false
+	}
+	switch op := scriptPubKey[0]; {
+	case op == 0x00:
+		version = 0
+	case op >= 0x51 && op <= 0x60:
+		version = op - 0x50
+	default:
+		return 0, nil, false
+	}
+	return version, scriptPubKey[2:], true
+}
+
+// PushedData returns every item pushed by a push only script such as a scriptSig, false if it contains other opcodes
+func PushedData(scriptBytes []byte) ([][]byte, bool) {
+	items := make([][]byte, 0)
+	for len(scriptBytes) > 0 {
+		if scriptBytes[0] == 0x00 {
+			items, scriptBytes = append(items, []byte{}), scriptBytes[1:]
+			continue
+		}
+
+		err, isOp, data, remaining := parseStatement(scriptBytes)
+		if err || isOp {
+			return nil, false
+		}
+		items, scriptBytes = append(items, data), remaining
+	}
+	return items, true
+}
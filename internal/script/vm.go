@@ -5,6 +5,7 @@ type VM struct {
 	Stack [][]byte
 	AltStack [][]byte
 	Transaction []byte // Required for operations dependent on the transaction
+	Trace bool // Print each step of execution
 }
 
 // NewVM creates a new execution environment
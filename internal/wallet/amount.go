@@ -0,0 +1,52 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"github.com/harveynw/blokechain/internal/chain"
+)
+
+// SatoshisPerBitcoin is the number of satoshis in one bitcoin
+const SatoshisPerBitcoin = 100000000
+
+// ErrInvalidAmount when an amount is not a positive number of bitcoin with at most 8 decimals, or exceeds chain.MaxMoney
+var ErrInvalidAmount = errors.New("Invalid amount")
+
+// ParseAmount reads a decimal bitcoin amount such as "0.015" into satoshis, without going through floating point
+func ParseAmount(s string) (uint64, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 2)
+	whole, fraction := parts[0], ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if (whole == "" && fraction == "") || len(fraction) > 8 || strings.ContainsAny(whole + fraction, "+-") {
+		return 0, ErrInvalidAmount
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	fraction += strings.Repeat("0", 8 - len(fraction))
+
+	btc, err := strconv.ParseUint(whole, 10, 64)
+	if err != nil || btc > 21000000 {
+		return 0, ErrInvalidAmount
+	}
+	sats, err := strconv.ParseUint(fraction, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+
+	// The whole part alone would let 21000000.5 through
+	total := btc * SatoshisPerBitcoin + sats
+	if total > chain.MaxMoney {
+		return 0, ErrInvalidAmount
+	}
+	return total, nil
+}
+
+// FormatAmount prints satoshis as bitcoin with 8 decimals
+func FormatAmount(sats uint64) string {
+	return fmt.Sprintf("%d.%08d", sats / SatoshisPerBitcoin, sats % SatoshisPerBitcoin)
+}
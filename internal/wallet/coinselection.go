@@ -0,0 +1,427 @@
+package wallet
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// Weight units of the parts of a transaction, a virtual byte is 4 weight units
+const (
+	txOverheadWeight = 4 * (4 + 1 + 1 + 4) + 2 // Version, input and output counts, locktime, segwit marker
+	inputBaseWeight = 4 * (32 + 4 + 1 + 4) // Outpoint, scriptSig length, sequence
+)
+
+// DustRelayFeeRate is the feerate at which an output costs more to spend than it holds
+const DustRelayFeeRate FeeRate = 3000
+
+// bnbMaxTries bounds the branch and bound search
+const bnbMaxTries = 100000
+
+// ErrInsufficientFunds when the UTXOs cannot pay for the target and fees
+var ErrInsufficientFunds = errors.New("Insufficient funds")
+// ErrUnknownScript when a UTXO's locking script is not one whose spending size can be estimated
+var ErrUnknownScript = errors.New("Cannot estimate the size of spending the script")
+// ErrNoSolution when an algorithm finds no selection, another may still succeed
+var ErrNoSolution = errors.New("No coin selection found")
+
+// FeeRate in satoshis per 1000 virtual bytes
+type FeeRate uint64
+
+// Fee for weight units at the rate, rounded up to whole virtual bytes so the parts of a transaction never sum to less than its vsize pays
+func (rate FeeRate) Fee(weight int) uint64 {
+	vbytes := uint64(weight + 3) / 4
+	return (uint64(rate) * vbytes + 999) / 1000
+}
+
+// UTXO is an unspent output that can fund a transaction
+type UTXO struct {
+	TxID []byte // Internal byte order, as returned by chain.Transaction.ID
+	Index uint32
+	Amount uint64 // Satoshis
+	Script []byte // Locking script
+	Height int32 `json:",omitempty"` // Block the output was mined in, zero while unconfirmed
+	Coinbase bool `json:",omitempty"`
+	SpentBy []byte `json:",omitempty"` // Id of an unconfirmed wallet payment spending it
+}
+
+// SelectionParams describes the payment coins are selected for
+type SelectionParams struct {
+	Target uint64 // Sum of the recipient outputs
+	BaseWeight int // Weight of the transaction without inputs or change, see BaseWeight
+	FeeRate FeeRate
+	LongTermFeeRate FeeRate // Expected future feerate, spending more inputs now is wasteful when FeeRate is above it
+	ChangeScript []byte // Locking script of the change output
+}
+
+// Selection is the chosen inputs and the change left over, Fee is everything not paid to the target or change
+type Selection struct {
+	Inputs []UTXO
+	Fee uint64
+	Change uint64 // Zero when changeless
+	Waste int64
+	Algorithm string
+}
+
+// candidate is a UTXO with its cost of spending at the selection's feerates
+type candidate struct {
+	utxo UTXO
+	effective int64 // Amount less the fee to spend it
+	fee, longTermFee uint64
+}
+
+// BaseWeight is the weight of a transaction with the given output scripts and no inputs
+func BaseWeight(outputScripts ...[]byte) int {
+	weight := txOverheadWeight
+	for _, lock := range outputScripts {
+		weight += outputWeight(lock)
+	}
+	return weight
+}
+
+// InputWeight estimates the weight of an input spending a P2PKH, P2WPKH, P2SH-P2WPKH or taproot key path output
+func InputWeight(lock []byte) (int, bool) {
+	version, program, isWitness := script.ParseWitnessProgram(lock)
+	switch {
+	case isWitness && version == 0 && len(program) == 20:
+		return inputBaseWeight + (1 + 1 + 72 + 1 + 33), true // Signature and public key
+	case isWitness && version == 1 && len(program) == 32:
+		return inputBaseWeight + (1 + 1 + 64), true // Schnorr signature
+	case script.IsP2SH(lock):
+		return inputBaseWeight + 4 * 23 + (1 + 1 + 72 + 1 + 33), true // Nested P2WPKH program and witness
+	case len(lock) == 25 && lock[0] == 0x76 && lock[1] == 0xa9:
+		return inputBaseWeight + 4 * (1 + 72 + 1 + 33), true
+	}
+	return 0, false
+}
+
+// DustThreshold is the smallest amount an output with the locking script may hold to be relayed
+func DustThreshold(lock []byte) uint64 {
+	spendSize := 32 + 4 + 1 + 107 + 4 // Legacy input
+	if _, _, isWitness := script.ParseWitnessProgram(lock); isWitness {
+		spendSize = 32 + 4 + 1 + 107 / 4 + 4
+	}
+	return DustRelayFeeRate.Fee(4 * (outputWeight(lock) / 4 + spendSize))
+}
+
+// SelectCoins chooses inputs for the payment, changeless with branch and bound if possible and otherwise the least wasteful of knapsack and single random draw
+func SelectCoins(utxos []UTXO, p SelectionParams, rng *rand.Rand) (*Selection, error) {
+	candidates, err := newCandidates(utxos, p)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, c := range candidates {
+		total += c.effective
+	}
+	if total < p.nonChangeTarget() {
+		return nil, ErrInsufficientFunds
+	}
+
+	if s, err := selectBnB(candidates, p); err == nil {
+		return s, nil
+	}
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	var best *Selection
+	for _, s := range []*Selection{orNil(selectKnapsack(candidates, p, rng)), orNil(selectSRD(candidates, p, rng))} {
+		if s != nil && (best == nil || s.Waste < best.Waste) {
+			best = s
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	return selectLargestFirst(candidates, p)
+}
+
+// SelectBnB searches for a changeless selection whose excess is below the cost of making change
+func SelectBnB(utxos []UTXO, p SelectionParams) (*Selection, error) {
+	candidates, err := newCandidates(utxos, p)
+	if err != nil {
+		return nil, err
+	}
+	return selectBnB(candidates, p)
+}
+
+// SelectKnapsack picks the random subset closest to the target plus change
+func SelectKnapsack(utxos []UTXO, p SelectionParams, rng *rand.Rand) (*Selection, error) {
+	candidates, err := newCandidates(utxos, p)
+	if err != nil {
+		return nil, err
+	}
+	return selectKnapsack(candidates, p, rng)
+}
+
+// SelectLargestFirst adds the largest UTXOs until the target and change are covered
+func SelectLargestFirst(utxos []UTXO, p SelectionParams) (*Selection, error) {
+	candidates, err := newCandidates(utxos, p)
+	if err != nil {
+		return nil, err
+	}
+	return selectLargestFirst(candidates, p)
+}
+
+// SelectSRD adds UTXOs in random order until the target and change are covered
+func SelectSRD(utxos []UTXO, p SelectionParams, rng *rand.Rand) (*Selection, error) {
+	candidates, err := newCandidates(utxos, p)
+	if err != nil {
+		return nil, err
+	}
+	return selectSRD(candidates, p, rng)
+}
+
+func selectBnB(candidates []candidate, p SelectionParams) (*Selection, error) {
+	sorted := append([]candidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].effective > sorted[j].effective })
+
+	target, window := p.nonChangeTarget(), int64(p.costOfChange())
+	var available int64
+	for _, c := range sorted {
+		available += c.effective
+	}
+
+	// included[i] is the decision for sorted[i], the search walks depth first including before excluding
+	included, best := make([]bool, 0, len(sorted)), []bool(nil)
+	var value, waste int64
+	bestWaste := int64(1) << 62
+	for tries := 0; tries < bnbMaxTries; tries++ {
+		backtrack := false
+		switch {
+		case value + available < target || value > target + window || (waste > bestWaste && p.FeeRate > p.LongTermFeeRate):
+			backtrack = true
+		case value >= target:
+			if waste + value - target <= bestWaste {
+				best, bestWaste = append([]bool{}, included...), waste + value - target
+			}
+			backtrack = true
+		}
+
+		if backtrack {
+			// Undo exclusions, then exclude the last included UTXO instead
+			for len(included) > 0 && !included[len(included)-1] {
+				included = included[:len(included)-1]
+				available += sorted[len(included)].effective
+			}
+			if len(included) == 0 {
+				break
+			}
+			c := sorted[len(included)-1]
+			included[len(included)-1] = false
+			value -= c.effective
+			waste -= int64(c.fee) - int64(c.longTermFee)
+			continue
+		}
+
+		c := sorted[len(included)]
+		available -= c.effective
+		// Including a UTXO equal to one just excluded would only repeat that branch
+		if n := len(included); n > 0 && !included[n-1] && c.effective == sorted[n-1].effective && c.fee == sorted[n-1].fee {
+			included = append(included, false)
+		} else {
+			included = append(included, true)
+			value += c.effective
+			waste += int64(c.fee) - int64(c.longTermFee)
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoSolution
+	}
+	chosen := make([]candidate, 0)
+	for i, in := range best {
+		if in {
+			chosen = append(chosen, sorted[i])
+		}
+	}
+	return p.finish(chosen, false, "bnb"), nil
+}
+
+func selectKnapsack(candidates []candidate, p SelectionParams, rng *rand.Rand) (*Selection, error) {
+	shuffled := shuffle(candidates, rng)
+	// An exact match needs no change, otherwise aim for change that pays its own fee and is not dust
+	target, minChange := p.nonChangeTarget(), int64(p.changeFee() + DustThreshold(p.ChangeScript))
+
+	smaller := make([]candidate, 0)
+	var lowestLarger *candidate
+	var total int64
+	for i, c := range shuffled {
+		switch {
+		case c.effective == target:
+			return p.finish([]candidate{c}, true, "knapsack"), nil
+		case c.effective < target + minChange:
+			smaller = append(smaller, c)
+			total += c.effective
+		case lowestLarger == nil || c.effective < lowestLarger.effective:
+			lowestLarger = &shuffled[i]
+		}
+	}
+
+	if total == target {
+		return p.finish(smaller, true, "knapsack"), nil
+	}
+	if total < target {
+		if lowestLarger == nil {
+			return nil, ErrNoSolution
+		}
+		return p.finish([]candidate{*lowestLarger}, true, "knapsack"), nil
+	}
+
+	sort.SliceStable(smaller, func(i, j int) bool { return smaller[i].effective > smaller[j].effective })
+	best, bestSum := approximateBestSubset(smaller, total, target, rng)
+	if bestSum != target && total >= target + minChange {
+		best, bestSum = approximateBestSubset(smaller, total, target + minChange, rng)
+	}
+
+	// A single larger UTXO beats a subset that leaves dust change or overshoots it
+	if lowestLarger != nil && ((bestSum != target && bestSum < target + minChange) || lowestLarger.effective <= bestSum) {
+		return p.finish([]candidate{*lowestLarger}, true, "knapsack"), nil
+	}
+	chosen := make([]candidate, 0)
+	for i, in := range best {
+		if in {
+			chosen = append(chosen, smaller[i])
+		}
+	}
+	return p.finish(chosen, true, "knapsack"), nil
+}
+
+// approximateBestSubset randomly includes candidates, keeping the smallest sum reaching target
+func approximateBestSubset(candidates []candidate, total, target int64, rng *rand.Rand) ([]bool, int64) {
+	best, bestSum := make([]bool, len(candidates)), total
+	for i := range best {
+		best[i] = true
+	}
+
+	for rep := 0; rep < 1000 && bestSum != target; rep++ {
+		included, sum, reached := make([]bool, len(candidates)), int64(0), false
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i, c := range candidates {
+				// First pass is a coin flip, the second fills in with whatever was left out
+				if (pass == 0 && rng.Intn(2) == 1) || (pass == 1 && !included[i]) {
+					sum += c.effective
+					included[i] = true
+					if sum >= target {
+						reached = true
+						if sum < bestSum {
+							bestSum = sum
+							copy(best, included)
+						}
+						sum -= c.effective
+						included[i] = false
+					}
+				}
+			}
+		}
+	}
+	return best, bestSum
+}
+
+func selectLargestFirst(candidates []candidate, p SelectionParams) (*Selection, error) {
+	sorted := append([]candidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].effective > sorted[j].effective })
+	return p.accumulate(sorted, "largest-first")
+}
+
+func selectSRD(candidates []candidate, p SelectionParams, rng *rand.Rand) (*Selection, error) {
+	return p.accumulate(shuffle(candidates, rng), "srd")
+}
+
+// accumulate adds candidates in order until the target and change are covered, settling for changeless if they run out
+func (p SelectionParams) accumulate(ordered []candidate, algorithm string) (*Selection, error) {
+	target := p.nonChangeTarget() + int64(p.changeFee() + DustThreshold(p.ChangeScript))
+	var value int64
+	for i, c := range ordered {
+		value += c.effective
+		if value >= target {
+			return p.finish(ordered[:i+1], true, algorithm), nil
+		}
+	}
+	if value >= p.nonChangeTarget() {
+		return p.finish(ordered, true, algorithm), nil
+	}
+	return nil, ErrNoSolution
+}
+
+// finish works out the fee and change of the chosen candidates, change below the dust threshold goes to the fee
+func (p SelectionParams) finish(chosen []candidate, allowChange bool, algorithm string) *Selection {
+	s := &Selection{Inputs: make([]UTXO, len(chosen)), Algorithm: algorithm}
+	var amount uint64
+	var value int64
+	for i, c := range chosen {
+		s.Inputs[i] = c.utxo
+		amount += c.utxo.Amount
+		value += c.effective
+		s.Waste += int64(c.fee) - int64(c.longTermFee)
+	}
+
+	excess := value - p.nonChangeTarget()
+	if change := excess - int64(p.changeFee()); allowChange && change >= int64(DustThreshold(p.ChangeScript)) {
+		s.Change = uint64(change)
+		s.Waste += int64(p.costOfChange())
+	} else {
+		s.Waste += excess
+	}
+	s.Fee = amount - p.Target - s.Change
+	return s
+}
+
+func (p SelectionParams) nonChangeTarget() int64 {
+	return int64(p.Target + p.FeeRate.Fee(p.BaseWeight))
+}
+
+func (p SelectionParams) changeFee() uint64 {
+	return p.FeeRate.Fee(outputWeight(p.ChangeScript))
+}
+
+// costOfChange is the fee to create the change output now and spend it later
+func (p SelectionParams) costOfChange() uint64 {
+	spendWeight, ok := InputWeight(p.ChangeScript)
+	if !ok {
+		spendWeight, _ = InputWeight(script.P2PKH(make([]byte, 20)).Encode())
+	}
+	return p.changeFee() + p.LongTermFeeRate.Fee(spendWeight)
+}
+
+// newCandidates prices each UTXO, leaving out those that cost more to spend than they hold
+func newCandidates(utxos []UTXO, p SelectionParams) ([]candidate, error) {
+	candidates := make([]candidate, 0, len(utxos))
+	for _, utxo := range utxos {
+		weight, ok := InputWeight(utxo.Script)
+		if !ok {
+			return nil, ErrUnknownScript
+		}
+		c := candidate{utxo: utxo, fee: p.FeeRate.Fee(weight), longTermFee: p.LongTermFeeRate.Fee(weight)}
+		c.effective = int64(utxo.Amount) - int64(c.fee)
+		if c.effective > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates, nil
+}
+
+func outputWeight(lock []byte) int {
+	size := len(lock)
+	varint := 1
+	if size >= 0xfd {
+		varint = 3
+	}
+	return 4 * (8 + varint + size)
+}
+
+func shuffle(candidates []candidate, rng *rand.Rand) []candidate {
+	shuffled := append([]candidate{}, candidates...)
+	rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return shuffled
+}
+
+// orNil drops the error of an algorithm that found nothing
+func orNil(s *Selection, err error) *Selection {
+	if err != nil {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,243 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Scrypt cost, roughly 100ms and 32MB per derivation
+const scryptN, scryptR, scryptP = 1 << 15, 8, 1
+
+// ErrLocked when an operation needs the secret keys of an encrypted wallet that is locked
+var ErrLocked = errors.New("Wallet is locked")
+// ErrWrongPassphrase when a passphrase does not decrypt the wallet
+var ErrWrongPassphrase = errors.New("Wrong passphrase")
+// ErrAlreadyEncrypted when encrypting a wallet that already has a passphrase
+var ErrAlreadyEncrypted = errors.New("Wallet is already encrypted")
+// ErrNotEncrypted when changing the passphrase of a plaintext wallet
+var ErrNotEncrypted = errors.New("Wallet is not encrypted")
+// ErrEmptyPassphrase when encrypting with an empty passphrase
+var ErrEmptyPassphrase = errors.New("Passphrase must not be empty")
+// ErrUnsupportedEncryption when a wallet file names a key derivation function other than scrypt, or scrypt costs other than those it is written with
+var ErrUnsupportedEncryption = errors.New("Unsupported wallet encryption")
+
+// Encryption holds the encrypted key material of a wallet and how to derive its key from the passphrase
+type Encryption struct {
+	KDF string // Only scrypt
+	Salt []byte
+	N, R, P int
+	Nonce []byte
+	Ciphertext []byte // AES-256-GCM, authenticated with the network name
+}
+
+// secrets is everything encrypted at rest, the addresses' secret keys are in wallet order
+type secrets struct {
+	Mnemonic string
+	MasterKey string
+	SecretKeys []*big.Int
+}
+
+// IsEncrypted reports whether the wallet's keys are protected by a passphrase
+func (wallet *Wallet) IsEncrypted() bool {
+	return wallet.Encryption != nil
+}
+
+// IsLocked reports whether the secret keys are unavailable until Unlock
+func (wallet *Wallet) IsLocked() bool {
+	return wallet.unlocked() != nil
+}
+
+// Encrypt protects the wallet's keys with a passphrase and locks it
+func (wallet *Wallet) Encrypt(passphrase string) error {
+	if wallet.IsEncrypted() {
+		return ErrAlreadyEncrypted
+	}
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	enc, key, err := newEncryption(passphrase)
+	if err != nil {
+		return err
+	}
+	wallet.Encryption, wallet.key = enc, key
+	if err := wallet.Save(); err != nil {
+		wallet.Encryption, wallet.key = nil, nil
+		return err
+	}
+	wallet.Lock()
+	return nil
+}
+
+// Unlock decrypts the keys, they are available until timeout passes or Lock is called
+func (wallet *Wallet) Unlock(passphrase string, timeout time.Duration) error {
+	if !wallet.IsEncrypted() {
+		return ErrNotEncrypted
+	}
+
+	// Costs from a corrupt or tampered file could ask scrypt for terabytes
+	enc := wallet.Encryption
+	if enc.KDF != "scrypt" || enc.N != scryptN || enc.R != scryptR || enc.P != scryptP {
+		return ErrUnsupportedEncryption
+	}
+	key, err := scrypt.Key([]byte(passphrase), enc.Salt, enc.N, enc.R, enc.P, 32)
+	if err != nil {
+		return err
+	}
+	s, err := decryptSecrets(key, enc, wallet.Network)
+	if err != nil {
+		return err
+	}
+	if len(s.SecretKeys) > len(wallet.Addresses) {
+		return ErrWrongPassphrase
+	}
+
+	wallet.Mnemonic, wallet.MasterKey = s.Mnemonic, s.MasterKey
+	for i := range wallet.Addresses {
+		if i < len(s.SecretKeys) {
+			wallet.Addresses[i].SecretKey = s.SecretKeys[i]
+			continue
+		}
+		// Found by a scan while locked, derived again from the master key
+		secretKey, err := wallet.deriveSecret(wallet.Addresses[i].Path)
+		if err != nil {
+			wallet.Lock()
+			return err
+		}
+		wallet.Addresses[i].SecretKey = secretKey
+	}
+	if wallet.AccountKey == "" && wallet.MasterKey != "" {
+		if err := wallet.setAccountKey(); err != nil {
+			wallet.Lock()
+			return err
+		}
+	}
+	wallet.key = key
+	wallet.unlockedUntil = time.Now().Add(timeout)
+	return nil
+}
+
+// Lock forgets the decrypted keys of an encrypted wallet
+func (wallet *Wallet) Lock() {
+	if !wallet.IsEncrypted() {
+		return
+	}
+	for i := range wallet.Addresses {
+		if wallet.Addresses[i].SecretKey != nil {
+			wallet.Addresses[i].SecretKey.SetInt64(0)
+			wallet.Addresses[i].SecretKey = nil
+		}
+	}
+	for i := range wallet.key {
+		wallet.key[i] = 0
+	}
+	wallet.Mnemonic, wallet.MasterKey, wallet.key = "", "", nil
+}
+
+// ChangePassphrase re-encrypts the keys under a new passphrase, leaving the wallet locked
+func (wallet *Wallet) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if !wallet.IsEncrypted() {
+		return ErrNotEncrypted
+	}
+	if newPassphrase == "" {
+		return ErrEmptyPassphrase
+	}
+	if err := wallet.Unlock(oldPassphrase, time.Minute); err != nil {
+		return err
+	}
+	defer wallet.Lock()
+
+	enc, key, err := newEncryption(newPassphrase)
+	if err != nil {
+		return err
+	}
+	oldEnc, oldKey := wallet.Encryption, wallet.key
+	wallet.Encryption, wallet.key = enc, key
+	if err := wallet.Save(); err != nil {
+		wallet.Encryption, wallet.key = oldEnc, oldKey
+		return err
+	}
+	return nil
+}
+
+// unlocked checks the keys are available, locking the wallet if its timeout has passed
+func (wallet *Wallet) unlocked() error {
+	if !wallet.IsEncrypted() {
+		return nil
+	}
+	if wallet.key == nil || time.Now().After(wallet.unlockedUntil) {
+		wallet.Lock()
+		return ErrLocked
+	}
+	return nil
+}
+
+func newEncryption(passphrase string) (*Encryption, []byte, error) {
+	enc := &Encryption{KDF: "scrypt", Salt: make([]byte, 16), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return nil, nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), enc.Salt, enc.N, enc.R, enc.P, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, key, nil
+}
+
+// encryptSecrets seals the wallet's secrets with a fresh nonce
+func (wallet *Wallet) encryptSecrets() error {
+	s := secrets{Mnemonic: wallet.Mnemonic, MasterKey: wallet.MasterKey, SecretKeys: make([]*big.Int, len(wallet.Addresses))}
+	for i, addr := range wallet.Addresses {
+		s.SecretKeys[i] = addr.SecretKey
+	}
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(wallet.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wallet.Encryption.Nonce = nonce
+	wallet.Encryption.Ciphertext = gcm.Seal(nil, nonce, plaintext, []byte(wallet.Network))
+	return nil
+}
+
+func decryptSecrets(key []byte, enc *Encryption, network string) (*secrets, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.Nonce) != gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := gcm.Open(nil, enc.Nonce, enc.Ciphertext, []byte(network))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	s := &secrets{}
+	if err := json.Unmarshal(plaintext, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,103 @@
+package wallet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// DataDirEnv names the environment variable that overrides the default data directory
+const DataDirEnv = "BLOKECHAIN_DATADIR"
+// DefaultName is the wallet used when none is named
+const DefaultName = "default"
+
+// ErrInvalidWalletName when a wallet name is empty or not made of letters, digits, '-' and '_'
+var ErrInvalidWalletName = errors.New("Invalid wallet name")
+// ErrWalletNotFound when loading a wallet that has not been created
+var ErrWalletNotFound = errors.New("Wallet not found")
+
+var walletName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Location of a named wallet, <DataDir>[/<network>]/wallets/<Name>/wallet.json with mainnet at the top level
+type Location struct {
+	DataDir string
+	Name string
+	Params *chainparams.Params
+}
+
+// DefaultDataDir is $BLOKECHAIN_DATADIR, else $XDG_DATA_HOME/blokechain, else ~/.local/share/blokechain
+func DefaultDataDir() string {
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "blokechain")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "blokechain"
+	}
+	return filepath.Join(home, ".local", "share", "blokechain")
+}
+
+// NewLocation names a wallet on a network, an empty dataDir or name selects the default
+func NewLocation(dataDir, name string, params *chainparams.Params) (Location, error) {
+	if dataDir == "" {
+		dataDir = DefaultDataDir()
+	}
+	if name == "" {
+		name = DefaultName
+	}
+	loc := Location{DataDir: dataDir, Name: name, Params: params}
+	return loc, loc.validate()
+}
+
+// Folder holding the wallet file and its backups
+func (loc Location) Folder() string {
+	return filepath.Join(walletsFolder(loc.DataDir, loc.Params), loc.Name)
+}
+
+// File is the path of the wallet file
+func (loc Location) File() string {
+	return filepath.Join(loc.Folder(), "wallet.json")
+}
+
+// List returns the names of the wallets created on a network, sorted
+func List(dataDir string, params *chainparams.Params) ([]string, error) {
+	entries, err := ioutil.ReadDir(walletsFolder(dataDir, params))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		loc := Location{DataDir: dataDir, Name: entry.Name(), Params: params}
+		if entry.IsDir() && loc.validate() == nil && Exists(loc) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (loc Location) validate() error {
+	if !walletName.MatchString(loc.Name) {
+		return ErrInvalidWalletName
+	}
+	return nil
+}
+
+// walletsFolder keeps mainnet in the top level folder and other networks in a subfolder
+func walletsFolder(dataDir string, params *chainparams.Params) string {
+	if params.Name == chainparams.MainNet().Name {
+		return filepath.Join(dataDir, "wallets")
+	}
+	return filepath.Join(dataDir, params.Name, "wallets")
+}
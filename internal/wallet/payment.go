@@ -0,0 +1,187 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// MinRelayFeeRate is the lowest feerate nodes relay by default, 1 sat/vB
+const MinRelayFeeRate FeeRate = 1000
+// LongTermFeeRate is the feerate coin selection expects to pay for spending change later
+const LongTermFeeRate FeeRate = 10000
+
+// ErrFeeRateTooLow when a payment would pay below the minimum relay feerate
+var ErrFeeRateTooLow = errors.New("Feerate below the minimum relay feerate of 1 sat/vB")
+// ErrDustOutput when a payment is too small for nodes to relay
+var ErrDustOutput = errors.New("Amount is below the dust threshold")
+// ErrPaymentCommitted when committing a payment twice or to a different wallet
+var ErrPaymentCommitted = errors.New("Payment already committed or not from this wallet")
+// ErrPaymentNotFound when abandoning a transaction that is not an unconfirmed payment of the wallet
+var ErrPaymentNotFound = errors.New("No unconfirmed payment with that txid")
+
+// Payment is a signed transaction made by CreatePayment, the wallet is unchanged until CommitPayment
+type Payment struct {
+	Raw []byte // Serialized transaction
+	TxID string // Display form
+	Address string
+	Amount uint64
+	Fee uint64
+	VSize int
+	Change uint64
+	ChangeAddress string // Empty when changeless
+	Inputs []UTXO
+
+	id []byte
+	changeKey *Address
+	changeIndex uint32
+	changeVout uint32
+	wallet *Wallet
+}
+
+// FeeRate actually paid, in satoshis per 1000 virtual bytes
+func (p *Payment) FeeRate() FeeRate {
+	return FeeRate(p.Fee * 1000 / uint64(p.VSize))
+}
+
+// CreatePayment selects coins for sending amount satoshis to address, sending change to a fresh address, and signs the transaction
+func (wallet *Wallet) CreatePayment(address string, amount uint64, feeRate FeeRate) (*Payment, error) {
+	if err := wallet.unlocked(); err != nil {
+		return nil, err
+	}
+	if feeRate < MinRelayFeeRate {
+		return nil, ErrFeeRateTooLow
+	}
+	params := wallet.location.Params
+	dest, err := script.PayToAddress(address, params)
+	if err != nil {
+		return nil, err
+	}
+	if amount < DustThreshold(dest.Encode()) {
+		return nil, ErrDustOutput
+	}
+
+	changeKey, changeIndex, err := wallet.nextChangeKey()
+	if err != nil {
+		return nil, err
+	}
+	changeScript := script.WitnessProgram(0, changeKey.PublicKey.HashEncode()).Encode()
+
+	selection, err := SelectCoins(wallet.spendable(), SelectionParams{
+		Target: amount,
+		BaseWeight: BaseWeight(dest.Encode()),
+		FeeRate: feeRate,
+		LongTermFeeRate: LongTermFeeRate,
+		ChangeScript: changeScript,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	b := chain.NewBuilder(params)
+	for _, in := range selection.Inputs {
+		if _, err := b.AddInput(in.TxID, in.Index, in.Script, in.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	// Change goes first or last at random, so its position does not give it away
+	p := &Payment{Address: address, Amount: amount, Fee: selection.Fee, Change: selection.Change, Inputs: selection.Inputs, wallet: wallet}
+	changeFirst := selection.Change > 0 && rand.Intn(2) == 0
+	if changeFirst {
+		b.AddOutputScript(changeScript, selection.Change)
+	}
+	b.AddOutputScript(dest.Encode(), amount)
+	if selection.Change > 0 && !changeFirst {
+		b.AddOutputScript(changeScript, selection.Change)
+		p.changeVout = 1
+	}
+	if selection.Change > 0 {
+		p.ChangeAddress = changeKey.PublicKey.ToSegwitAddress(params)
+		p.changeKey, p.changeIndex = &changeKey, changeIndex
+	}
+
+	if err := wallet.SignTransaction(b); err != nil {
+		return nil, err
+	}
+	raw, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	tx := b.Transaction()
+	p.Raw, p.id, p.VSize = raw, tx.ID(), tx.VSize()
+	p.TxID = chain.HashString(p.id)
+	return p, nil
+}
+
+// CommitPayment records a payment as sent, keeping its change address and reserving its inputs until a scan sees it mined
+func (wallet *Wallet) CommitPayment(p *Payment) error {
+	if p.wallet != wallet {
+		return ErrPaymentCommitted
+	}
+	if err := wallet.unlocked(); err != nil {
+		return err
+	}
+
+	var sent uint64
+	for i, utxo := range wallet.UTXOs {
+		if spentBy(utxo, p.Inputs) {
+			wallet.UTXOs[i].SpentBy = p.id
+			sent += utxo.Amount
+		}
+	}
+	if p.changeKey != nil {
+		changeKey := *p.changeKey
+		wallet.Addresses = append(wallet.Addresses, changeKey)
+		if wallet.MasterKey != "" {
+			wallet.NextChangeIndex = p.changeIndex + 1
+		}
+		lock := script.WitnessProgram(0, changeKey.PublicKey.HashEncode()).Encode()
+		wallet.UTXOs = append(wallet.UTXOs, UTXO{TxID: p.id, Index: p.changeVout, Amount: p.Change, Script: lock})
+	}
+	wallet.recordTx(TxRecord{TxID: p.id, Received: p.Change, Sent: sent})
+	p.wallet = nil
+	return wallet.Save()
+}
+
+// AbandonPayment releases the inputs of an unconfirmed payment that will not be mined, because it was never broadcast or was dropped, and forgets its change
+func (wallet *Wallet) AbandonPayment(txID string) error {
+	id, err := chain.ParseHash(txID)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, record := range wallet.History {
+		found = found || (record.Height == 0 && bytes.Equal(record.TxID, id))
+	}
+	if !found {
+		return ErrPaymentNotFound
+	}
+
+	// Should it be mined after all, a scan finds it as the change address is kept
+	wallet.dropPayment(id, wallet.pendingSpends())
+	return wallet.Save()
+}
+
+// nextChangeKey is the next key on the change chain, or a random key for wallets without a seed, it is not added to the wallet
+func (wallet *Wallet) nextChangeKey() (Address, uint32, error) {
+	if wallet.MasterKey == "" {
+		secretKey, pubKey := cryptography.RandomKeyPair()
+		return Address{PublicKey: pubKey, SecretKey: secretKey, Change: true}, 0, nil
+	}
+	addr, index, err := wallet.deriveKey(ChangePath(wallet.location.Params), wallet.NextChangeIndex)
+	addr.Change = true
+	return addr, index, err
+}
+
+func spentBy(utxo UTXO, inputs []UTXO) bool {
+	for _, in := range inputs {
+		if in.Index == utxo.Index && bytes.Equal(in.TxID, utxo.TxID) {
+			return true
+		}
+	}
+	return false
+}
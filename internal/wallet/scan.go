@@ -0,0 +1,559 @@
+package wallet
+
+import (
+	"bytes"
+	"time"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
+)
+
+// scanSaveInterval is how many blocks are scanned between saves, so an interrupted scan resumes near where it stopped
+const scanSaveInterval = 1000
+// GapLimit is how many keys past the last one handed out a scan watches on each BIP84 chain
+const GapLimit = 20
+// reorgDepth is how many recently scanned blocks are remembered, a reorg deeper than this rescans from the birth height
+const reorgDepth = 100
+// maxFutureBlockTime is how far ahead of the clock of the node that mined it a block's timestamp may be
+const maxFutureBlockTime = 2 * time.Hour
+
+// BlockSource serves the blocks of the best chain and the transactions waiting to be mined, from a local block store or a node
+type BlockSource interface {
+	BestHeight() (int32, error)
+	BlockHash(height int32) ([]byte, error) // Internal byte order
+	BlockHeader(hash []byte) (*chain.BlockHeader, error)
+	Block(hash []byte) (chain.Block, error)
+	Mempool() ([][]byte, error) // Transaction ids, internal byte order
+	Transaction(id []byte) (chain.Transaction, error)
+}
+
+// ScannedBlock is a recently scanned block and the wallet's UTXOs it spent, enough to disconnect it on a reorg
+type ScannedBlock struct {
+	Height int32
+	Hash []byte // Internal byte order
+	Spent []UTXO `json:",omitempty"`
+}
+
+// TxRecord is a transaction that paid to or spent from the wallet
+type TxRecord struct {
+	TxID []byte // Internal byte order
+	Height int32 `json:",omitempty"` // Zero while unconfirmed
+	Received uint64 // Paid to the wallet's scripts, including change
+	Sent uint64 // Spent from the wallet's UTXOs
+}
+
+// Balance of coins in satoshis, Immature is coinbase output that cannot be spent yet
+type Balance struct {
+	Confirmed uint64
+	Unconfirmed uint64 // Not yet mined, the change of the wallet's own payments and incoming payments seen in the mempool
+	Immature uint64
+}
+
+// Scan brings the UTXOs and history up to date with the source's best chain and mempool, disconnecting the blocks after the fork if the last scanned block was reorganised away
+func (wallet *Wallet) Scan(src BlockSource) (int, error) {
+	best, err := src.BestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	pending := wallet.pendingSpends()
+	if wallet.ScanHash != nil {
+		hash, err := src.BlockHash(wallet.ScanHeight)
+		if wallet.ScanHeight > best || err != nil || !bytes.Equal(hash, wallet.ScanHash) {
+			if err := wallet.rewind(src, best); err != nil {
+				return 0, err
+			}
+		}
+	}
+	start := wallet.ScanHeight + 1
+	if wallet.ScanHash == nil {
+		if err := wallet.findBirthHeight(src, best); err != nil {
+			return 0, err
+		}
+		start = wallet.BirthHeight
+	}
+
+	scripts := wallet.scripts()
+	ahead, err := wallet.lookahead()
+	if err != nil {
+		return 0, err
+	}
+	scanned := 0
+	for height := start; height <= best; height++ {
+		hash, err := src.BlockHash(height)
+		if err != nil {
+			return scanned, err
+		}
+		block, err := src.Block(hash)
+		if err != nil {
+			return scanned, err
+		}
+
+		// Using a lookahead key moves the window on, which may reach more of the block's outputs
+		for {
+			used, err := wallet.useLookahead(block, ahead)
+			if err != nil {
+				return scanned, err
+			}
+			if !used {
+				break
+			}
+			if ahead, err = wallet.lookahead(); err != nil {
+				return scanned, err
+			}
+			scripts = wallet.scripts()
+		}
+		spent := wallet.connectBlock(block, height, scripts, pending)
+		wallet.ScanHeight, wallet.ScanHash = height, hash
+		wallet.Recent = append(wallet.Recent, ScannedBlock{Height: height, Hash: hash, Spent: spent})
+		if len(wallet.Recent) > reorgDepth {
+			wallet.Recent = wallet.Recent[len(wallet.Recent) - reorgDepth:]
+		}
+		scanned++
+
+		if scanned % scanSaveInterval == 0 {
+			if err := wallet.Save(); err != nil {
+				return scanned, err
+			}
+		}
+	}
+
+	// Payments not yet mined keep their inputs reserved
+	for i, utxo := range wallet.UTXOs {
+		if spender, ok := pending[outpointKey(utxo.TxID, utxo.Index)]; ok {
+			wallet.UTXOs[i].SpentBy = spender
+		}
+	}
+	if err := wallet.scanMempool(src, wallet.scripts()); err != nil {
+		return scanned, err
+	}
+	return scanned, wallet.Save()
+}
+
+// scanMempool records the unconfirmed transactions paying to or spending from the wallet, forgetting incoming payments that left the mempool without being mined
+func (wallet *Wallet) scanMempool(src BlockSource, scripts map[string]string) error {
+	ids, err := src.Mempool()
+	if err != nil {
+		return err
+	}
+	inMempool := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		inMempool[string(id)] = true
+	}
+
+	// Replaced or evicted, while the wallet's own payments stay reserved until abandoned or conflicted
+	for _, record := range append([]TxRecord{}, wallet.History...) {
+		if record.Height == 0 && record.Sent == 0 && !inMempool[string(record.TxID)] {
+			wallet.dropPayment(record.TxID, wallet.pendingSpends())
+		}
+	}
+	known := make(map[string]bool)
+	for _, record := range wallet.History {
+		if record.Height == 0 {
+			known[string(record.TxID)] = true
+		}
+	}
+
+	txs := make([]chain.Transaction, 0)
+	for _, id := range ids {
+		if known[string(id)] {
+			continue
+		}
+		tx, err := src.Transaction(id)
+		if err != nil {
+			continue // Mined or evicted since the mempool was listed
+		}
+		txs = append(txs, tx)
+	}
+
+	// All outputs before any input, so a spend of another unconfirmed transaction is seen whatever the mempool's order
+	received := make([]uint64, len(txs))
+	for i, tx := range txs {
+		for vout, out := range tx.Outputs() {
+			if _, ours := scripts[string(out.ScriptPubKey())]; !ours {
+				continue
+			}
+			received[i] += out.Amount()
+			wallet.UTXOs = append(wallet.UTXOs, UTXO{TxID: tx.ID(), Index: uint32(vout), Amount: out.Amount(), Script: out.ScriptPubKey()})
+		}
+	}
+	for i, tx := range txs {
+		var sent uint64
+		id := tx.ID()
+		for _, in := range tx.Inputs() {
+			prevTxID, prevIndex := in.PrevOutpoint()
+			for j, utxo := range wallet.UTXOs {
+				if utxo.SpentBy == nil && utxo.Index == prevIndex && bytes.Equal(utxo.TxID, prevTxID) {
+					wallet.UTXOs[j].SpentBy = id
+					sent += utxo.Amount
+				}
+			}
+		}
+		if sent > 0 || received[i] > 0 {
+			wallet.recordTx(TxRecord{TxID: id, Received: received[i], Sent: sent})
+		}
+	}
+	return nil
+}
+
+// rewind disconnects the scanned blocks after the last one still in the source's best chain, resetting the scan if none of the recent blocks are
+func (wallet *Wallet) rewind(src BlockSource, best int32) error {
+	for i := len(wallet.Recent) - 1; i >= 0; i-- {
+		fork := wallet.Recent[i]
+		if fork.Height > best {
+			continue
+		}
+		hash, err := src.BlockHash(fork.Height)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(hash, fork.Hash) {
+			wallet.disconnect(i)
+			return nil
+		}
+	}
+	wallet.resetScan()
+	return nil
+}
+
+// disconnect undoes the recent blocks after Recent[fork], restoring the UTXOs they spent and forgetting what they paid
+func (wallet *Wallet) disconnect(fork int) {
+	for _, block := range wallet.Recent[fork+1:] {
+		for _, utxo := range block.Spent {
+			utxo.SpentBy = nil // The spend is gone with the block
+			wallet.UTXOs = append(wallet.UTXOs, utxo)
+		}
+	}
+
+	// Outputs created and spent in the blocks were restored above, so filter after
+	height := wallet.Recent[fork].Height
+	utxos := make([]UTXO, 0, len(wallet.UTXOs))
+	for _, utxo := range wallet.UTXOs {
+		if utxo.Height <= height {
+			utxos = append(utxos, utxo)
+		}
+	}
+	history := make([]TxRecord, 0, len(wallet.History))
+	for _, record := range wallet.History {
+		if record.Height <= height {
+			history = append(history, record)
+		}
+	}
+	wallet.UTXOs, wallet.History = utxos, history
+	wallet.ScanHeight, wallet.ScanHash = height, wallet.Recent[fork].Hash
+	wallet.Recent = wallet.Recent[:fork+1]
+}
+
+// findBirthHeight sets the birth height to the first block timed after the birthday, less maxFutureBlockTime as block times can run ahead
+func (wallet *Wallet) findBirthHeight(src BlockSource, best int32) error {
+	if wallet.Birthday == 0 || wallet.BirthHeight != 0 {
+		return nil
+	}
+	earliest := wallet.Birthday - int64(maxFutureBlockTime / time.Second)
+
+	// Block times are not strictly increasing, but near enough for the window above to cover
+	low, high := int32(0), best + 1
+	for low < high {
+		mid := low + (high - low) / 2
+		hash, err := src.BlockHash(mid)
+		if err != nil {
+			return err
+		}
+		header, err := src.BlockHeader(hash)
+		if err != nil {
+			return err
+		}
+		if int64(header.Time) < earliest {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	wallet.BirthHeight = low
+	return nil
+}
+
+// Balances per address, in the address format of the script each UTXO is locked to
+func (wallet *Wallet) Balances() map[string]Balance {
+	scripts := wallet.scripts()
+	balances := make(map[string]Balance)
+	for _, utxo := range wallet.UTXOs {
+		address := scripts[string(utxo.Script)]
+		balances[address] = wallet.addBalance(balances[address], utxo)
+	}
+	return balances
+}
+
+// TotalBalance of the whole wallet
+func (wallet *Wallet) TotalBalance() Balance {
+	var total Balance
+	for _, utxo := range wallet.UTXOs {
+		total = wallet.addBalance(total, utxo)
+	}
+	return total
+}
+
+func (wallet *Wallet) addBalance(b Balance, utxo UTXO) Balance {
+	switch {
+	case utxo.SpentBy != nil:
+	case utxo.Height == 0:
+		b.Unconfirmed += utxo.Amount
+	case wallet.isImmature(utxo):
+		b.Immature += utxo.Amount
+	default:
+		b.Confirmed += utxo.Amount
+	}
+	return b
+}
+
+// spendable are the UTXOs payments may use, own unconfirmed change included but not incoming payments until mined
+func (wallet *Wallet) spendable() []UTXO {
+	payments := make(map[string]bool)
+	for _, record := range wallet.History {
+		if record.Height == 0 && record.Sent > 0 {
+			payments[string(record.TxID)] = true
+		}
+	}
+	utxos := make([]UTXO, 0, len(wallet.UTXOs))
+	for _, utxo := range wallet.UTXOs {
+		if utxo.Height == 0 && !payments[string(utxo.TxID)] {
+			continue
+		}
+		if utxo.SpentBy == nil && !wallet.isImmature(utxo) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// isImmature reports whether a coinbase output is still within its maturity period at the scanned height
+func (wallet *Wallet) isImmature(utxo UTXO) bool {
+	if !utxo.Coinbase {
+		return false
+	}
+	depth := wallet.ScanHeight - utxo.Height + 1
+	return utxo.Height == 0 || depth <= wallet.location.Params.CoinbaseMaturity
+}
+
+// connectBlock removes the UTXOs the block's transactions spend and adds those paying the wallet, dropping payments they conflict with, and returns the UTXOs spent
+func (wallet *Wallet) connectBlock(block chain.Block, height int32, scripts map[string]string, pending map[string][]byte) []UTXO {
+	var spent []UTXO
+	for _, tx := range block.Transactions() {
+		var sent, received uint64
+		id := tx.ID()
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs() {
+				prevTxID, prevIndex := in.PrevOutpoint()
+				if spender, ok := pending[outpointKey(prevTxID, prevIndex)]; ok && !bytes.Equal(spender, id) {
+					wallet.dropPayment(spender, pending) // Can never be mined now
+				}
+				if utxo, ok := wallet.removeUTXO(prevTxID, prevIndex); ok {
+					sent += utxo.Amount
+					spent = append(spent, utxo)
+				}
+			}
+		}
+
+		for vout, out := range tx.Outputs() {
+			if _, ours := scripts[string(out.ScriptPubKey())]; !ours {
+				continue
+			}
+			received += out.Amount()
+			wallet.removeUTXO(id, uint32(vout)) // Confirms unconfirmed change
+			wallet.UTXOs = append(wallet.UTXOs, UTXO{
+				TxID: id,
+				Index: uint32(vout),
+				Amount: out.Amount(),
+				Script: out.ScriptPubKey(),
+				Height: height,
+				Coinbase: tx.IsCoinbase(),
+			})
+		}
+
+		if sent > 0 || received > 0 {
+			wallet.recordTx(TxRecord{TxID: id, Height: height, Received: received, Sent: sent})
+		}
+	}
+	return spent
+}
+
+// recordTx adds to the history, replacing the unconfirmed record of the same transaction
+func (wallet *Wallet) recordTx(record TxRecord) {
+	for i, existing := range wallet.History {
+		if bytes.Equal(existing.TxID, record.TxID) {
+			wallet.History[i] = record
+			return
+		}
+	}
+	wallet.History = append(wallet.History, record)
+}
+
+func (wallet *Wallet) removeUTXO(txID []byte, index uint32) (UTXO, bool) {
+	for i, utxo := range wallet.UTXOs {
+		if utxo.Index == index && bytes.Equal(utxo.TxID, txID) {
+			wallet.UTXOs = append(wallet.UTXOs[:i], wallet.UTXOs[i+1:]...)
+			return utxo, true
+		}
+	}
+	return UTXO{}, false
+}
+
+// resetScan forgets everything learnt from blocks, keeping unconfirmed payments
+func (wallet *Wallet) resetScan() {
+	utxos := make([]UTXO, 0)
+	for _, utxo := range wallet.UTXOs {
+		if utxo.Height == 0 {
+			utxos = append(utxos, utxo)
+		}
+	}
+	history := make([]TxRecord, 0)
+	for _, record := range wallet.History {
+		if record.Height == 0 {
+			history = append(history, record)
+		}
+	}
+	wallet.UTXOs, wallet.History = utxos, history
+	wallet.ScanHeight, wallet.ScanHash, wallet.Recent = 0, nil, nil
+}
+
+// pendingSpends maps the outpoints reserved by unconfirmed payments to the payment's id
+func (wallet *Wallet) pendingSpends() map[string][]byte {
+	pending := make(map[string][]byte)
+	for _, utxo := range wallet.UTXOs {
+		if utxo.SpentBy != nil {
+			pending[outpointKey(utxo.TxID, utxo.Index)] = utxo.SpentBy
+		}
+	}
+	return pending
+}
+
+// dropPayment forgets an unconfirmed payment, releasing its inputs and dropping its change along with any payment spending that
+func (wallet *Wallet) dropPayment(id []byte, pending map[string][]byte) {
+	for key, spender := range pending {
+		if bytes.Equal(spender, id) {
+			delete(pending, key)
+		}
+	}
+
+	utxos := make([]UTXO, 0, len(wallet.UTXOs))
+	dependents := make([][]byte, 0)
+	for _, utxo := range wallet.UTXOs {
+		if bytes.Equal(utxo.SpentBy, id) {
+			utxo.SpentBy = nil
+		}
+		if utxo.Height == 0 && bytes.Equal(utxo.TxID, id) {
+			if utxo.SpentBy != nil {
+				dependents = append(dependents, utxo.SpentBy)
+			}
+			continue
+		}
+		utxos = append(utxos, utxo)
+	}
+	history := make([]TxRecord, 0, len(wallet.History))
+	for _, record := range wallet.History {
+		if record.Height != 0 || !bytes.Equal(record.TxID, id) {
+			history = append(history, record)
+		}
+	}
+	wallet.UTXOs, wallet.History = utxos, history
+
+	for _, dependent := range dependents {
+		wallet.dropPayment(dependent, pending)
+	}
+}
+
+// scripts maps every locking script the wallet's keys can spend to its address
+func (wallet *Wallet) scripts() map[string]string {
+	scripts := make(map[string]string)
+	for _, addr := range wallet.Addresses {
+		for lock, address := range keyScripts(addr.PublicKey, wallet.location.Params) {
+			scripts[lock] = address
+		}
+	}
+	return scripts
+}
+
+// keyScripts maps the P2PKH, P2WPKH, P2SH-P2WPKH and taproot locking scripts of a key to their addresses
+func keyScripts(pk cryptography.PublicKey, params *chainparams.Params) map[string]string {
+	hash := pk.HashEncode()
+	nested := script.WitnessProgram(0, hash).Encode()
+
+	scripts := make(map[string]string)
+	scripts[string(script.P2PKH(hash).Encode())] = pk.ToAddress(params)
+	scripts[string(nested)] = pk.ToSegwitAddress(params)
+	scripts[string(script.P2SH(cryptography.Hash160(nested)).Encode())] = cryptography.Base58CheckEncode(params.ScriptHashAddrID, cryptography.Hash160(nested))
+	if outputKey, err := cryptography.TaprootOutputKey(pk, nil); err == nil {
+		scripts[string(script.WitnessProgram(1, outputKey).Encode())] = pk.ToTaprootAddress(params)
+	}
+	return scripts
+}
+
+// lookaheadKey is the position of a key the wallet has not handed out yet
+type lookaheadKey struct {
+	change bool
+	index uint32
+}
+
+// lookahead maps the locking scripts of the next GapLimit keys on the receive and change chains to their position, empty without a seed
+func (wallet *Wallet) lookahead() (map[string]lookaheadKey, error) {
+	ahead := make(map[string]lookaheadKey)
+	if wallet.MasterKey == "" && wallet.AccountKey == "" {
+		return ahead, nil
+	}
+	for _, change := range []bool{false, true} {
+		path, next := wallet.hdChain(change)
+		parent, err := wallet.chainKey(path)
+		if err != nil {
+			return nil, err
+		}
+		for index, n := *next, 0; n < GapLimit; index, n = index + 1, n + 1 {
+			addr, i, err := deriveChild(parent, path, index)
+			if err != nil {
+				return nil, err
+			}
+			index = i
+			for lock := range keyScripts(addr.PublicKey, wallet.location.Params) {
+				ahead[lock] = lookaheadKey{change: change, index: index}
+			}
+		}
+	}
+	return ahead, nil
+}
+
+// useLookahead adds the keys up to and including any lookahead key the block pays, reporting whether it added any
+func (wallet *Wallet) useLookahead(block chain.Block, ahead map[string]lookaheadKey) (bool, error) {
+	used := false
+	for _, tx := range block.Transactions() {
+		for _, out := range tx.Outputs() {
+			key, ok := ahead[string(out.ScriptPubKey())]
+			if !ok {
+				continue
+			}
+			path, next := wallet.hdChain(key.change)
+			for *next <= key.index {
+				addr, index, err := wallet.deriveKey(path, *next)
+				if err != nil {
+					return used, err
+				}
+				addr.Change = key.change
+				wallet.Addresses = append(wallet.Addresses, addr)
+				*next = index + 1
+				used = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// hdChain is the derivation path of the receive or change chain and the index of its next key
+func (wallet *Wallet) hdChain(change bool) ([]uint32, *uint32) {
+	if change {
+		return ChangePath(wallet.location.Params), &wallet.NextChangeIndex
+	}
+	return ReceivePath(wallet.location.Params), &wallet.NextIndex
+}
+
+func outpointKey(txID []byte, index uint32) string {
+	return string(append(append([]byte{}, txID...), byte(index), byte(index >> 8), byte(index >> 16), byte(index >> 24)))
+}
@@ -0,0 +1,113 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/harveynw/blokechain/internal/chainparams"
+)
+
+// walletVersion is the file schema written by Save, Load migrates older files up to it
+const walletVersion = 1
+
+// ErrCorruptWallet when a wallet file cannot be parsed
+var ErrCorruptWallet = errors.New("Wallet file is corrupted")
+// ErrUnsupportedVersion when a wallet file was written by a newer version of the software
+var ErrUnsupportedVersion = errors.New("Wallet file version is newer than supported")
+// ErrWrongNetwork when a wallet file belongs to a different network
+var ErrWrongNetwork = errors.New("Wallet belongs to a different network")
+
+// migrations[v] upgrades the fields of a version v wallet file to version v+1
+var migrations = []func(fields map[string]json.RawMessage) error{
+	// 0 to 1, unversioned files created before networks were recorded are mainnet
+	func(fields map[string]json.RawMessage) error {
+		if network, ok := fields["Network"]; !ok || string(network) == `""` {
+			fields["Network"], _ = json.Marshal(chainparams.MainNet().Name)
+		}
+		return nil
+	},
+}
+
+// decodeWallet parses a wallet file, migrating it to the current version, and returns the version it was stored as
+func decodeWallet(data []byte) (*Wallet, int, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrCorruptWallet, err)
+	}
+
+	version := 0
+	if raw, ok := fields["Version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil || version < 0 {
+			return nil, 0, fmt.Errorf("%w: invalid version %s", ErrCorruptWallet, raw)
+		}
+	}
+	if version > walletVersion {
+		return nil, 0, fmt.Errorf("%w (version %v)", ErrUnsupportedVersion, version)
+	}
+
+	for v := version; v < walletVersion; v++ {
+		if err := migrations[v](fields); err != nil {
+			return nil, 0, fmt.Errorf("Migrating wallet from version %v: %w", v, err)
+		}
+	}
+	fields["Version"], _ = json.Marshal(walletVersion)
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := &Wallet{}
+	if err := json.Unmarshal(migrated, w); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrCorruptWallet, err)
+	}
+	for _, addr := range w.Addresses {
+		if addr.SecretKey == nil && w.Encryption == nil {
+			return nil, 0, fmt.Errorf("%w: address without a secret key", ErrCorruptWallet)
+		}
+	}
+	return w, version, nil
+}
+
+// backupWallet keeps a copy of the wallet file as it was before a migration
+func backupWallet(loc Location, data []byte, version int) (string, error) {
+	name := fmt.Sprintf("wallet.v%d.%d.bak", version, time.Now().Unix())
+	path := filepath.Join(loc.Folder(), name)
+	return path, writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place, so a crash never leaves a partial file
+func writeFileAtomic(path string, data []byte) error {
+	folder := filepath.Dir(path)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return err
+	}
+	// Tighten folders created by older versions with 0777
+	os.Chmod(folder, 0700)
+
+	tmp, err := ioutil.TempFile(folder, filepath.Base(path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
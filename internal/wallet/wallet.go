@@ -1,98 +1,498 @@
 package wallet
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
+	"strings"
+	"time"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
 	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
 )
 
-// Wallet for holding multiple key pairs
+// Wallet for holding multiple key pairs on a single network
 type Wallet struct {
+	Version int
+	Network string
 	Addresses []Address
+	Mnemonic string `json:",omitempty"` // BIP39 backup phrase of the master key
+	MasterKey string `json:",omitempty"` // Extended private key, new addresses are derived from it when set
+	AccountKey string `json:",omitempty"` // Extended public key of the BIP84 account, kept in the clear so scans can look ahead while locked
+	NextIndex uint32 `json:",omitempty"`
+	NextChangeIndex uint32 `json:",omitempty"`
+	UTXOs []UTXO `json:",omitempty"` // Outputs the wallet can spend
+	History []TxRecord `json:",omitempty"`
+	ScanHeight int32 `json:",omitempty"` // Last block scanned for UTXOs
+	ScanHash []byte `json:",omitempty"`
+	Recent []ScannedBlock `json:",omitempty"` // Last blocks scanned, so a reorg only disconnects those after the fork
+	Birthday int64 `json:",omitempty"` // Unix time the wallet was created, zero if it may have been used from genesis
+	BirthHeight int32 `json:",omitempty"` // First block scanned, found from Birthday or given at restore
+	Encryption *Encryption `json:",omitempty"` // Set when the secrets above are encrypted at rest
+
+	location Location
+	key []byte // Encryption key while unlocked
+	unlockedUntil time.Time
 }
 
 // Address for a holding a ECDSA public key, private key pair
 type Address struct {
 	PublicKey cryptography.PublicKey
-	SecretKey *big.Int
+	SecretKey *big.Int `json:",omitempty"` // Nil while an encrypted wallet is locked
+	Path string `json:",omitempty"` // Derivation path, empty for random keys
+	Change bool `json:",omitempty"` // Receives the change of the wallet's own payments
 }
 
-// Save marshals wallet to file
-func (wallet *Wallet) Save() {
-	data, marshalErr := json.MarshalIndent(wallet, "", "   ")
-	if marshalErr != nil {
-		panic(marshalErr)
+// Save atomically writes the wallet, readable by the owner only and with the secrets sealed if it is encrypted
+func (wallet *Wallet) Save() error {
+	wallet.Version = walletVersion
+	stored := *wallet
+	if wallet.IsEncrypted() {
+		if wallet.key != nil {
+			if err := wallet.encryptSecrets(); err != nil {
+				return err
+			}
+		}
+		stored.Mnemonic, stored.MasterKey = "", ""
+		stored.Addresses = make([]Address, len(wallet.Addresses))
+		for i, addr := range wallet.Addresses {
+			addr.SecretKey = nil
+			stored.Addresses[i] = addr
+		}
+	}
+
+	data, err := json.MarshalIndent(&stored, "", "   ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(wallet.location.File(), data)
+}
+
+// ErrWalletExists when creating or restoring over an existing wallet file
+var ErrWalletExists = errors.New("Wallet already exists")
+// ErrAddressNotFound when an address does not belong to the wallet
+var ErrAddressNotFound = errors.New("Address not in wallet")
+// ErrKeyExists when importing a key the wallet already holds
+var ErrKeyExists = errors.New("Key already in wallet")
+// ErrNegativeHeight when a block height is below zero
+var ErrNegativeHeight = errors.New("Block height must not be negative")
+// ErrUncompressedKey when importing a key whose addresses use the uncompressed public key
+var ErrUncompressedKey = errors.New("Uncompressed keys are not supported")
+
+// Load unmarshals the Wallet at loc after retrieval from file
+func Load(loc Location) (*Wallet, error) {
+	if err := loc.validate(); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(loc.File())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", ErrWalletNotFound, loc.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	params := loc.Params
+
+	w, version, err := decodeWallet(data)
+	if err != nil {
+		return nil, err
+	}
+	if w.Network != params.Name {
+		return nil, fmt.Errorf("%w: %v, not %v", ErrWrongNetwork, w.Network, params.Name)
 	}
+	w.location = loc
 
-	writeErr := ioutil.WriteFile(getWalletFile(), data, 0777)
-	if writeErr != nil {
-		panic(writeErr)
+	// Upgrade the file, keeping the original in case the migration loses something
+	if version < walletVersion {
+		if _, err := backupWallet(loc, data, version); err != nil {
+			return nil, err
+		}
+		if err := w.Save(); err != nil {
+			return nil, err
+		}
 	}
+
+	return w, nil
+}
+
+// Exists reports whether a wallet file has been created at loc
+func Exists(loc Location) bool {
+	_, err := os.Stat(loc.File())
+	return err == nil
 }
 
-// Load unmarshals the Wallet after retrieval from file
-func Load() *Wallet {
-	data, err := getWalletData()
-	
+// Create makes a new HD wallet from a freshly generated 12 or 24 word mnemonic
+func Create(loc Location, words int) (*Wallet, error) {
+	entropy, err := cryptography.NewEntropy(words / 3 * 32)
+	if err != nil {
+		return nil, err
+	}
+	mnemonic, err := cryptography.NewMnemonic(entropy)
+	if err != nil {
+		return nil, err
+	}
+	w, err := Restore(loc, mnemonic, "")
 	if err != nil {
-		w := &Wallet{Addresses: make([]Address, 0)}
-		w.Save()
+		return nil, err
+	}
 
-		return w
+	// Nothing can have paid a fresh mnemonic, so scans skip the blocks before it
+	w.Birthday = time.Now().Unix()
+	if err := w.Save(); err != nil {
+		return nil, err
 	}
+	return w, nil
+}
 
-	w := &Wallet{}
-	marshalErr := json.Unmarshal(data, w)
+// Restore recreates an HD wallet from a mnemonic and optional BIP39 passphrase
+func Restore(loc Location, mnemonic, passphrase string) (*Wallet, error) {
+	if err := loc.validate(); err != nil {
+		return nil, err
+	}
+	if Exists(loc) {
+		return nil, ErrWalletExists
+	}
+	seed, err := cryptography.MnemonicToSeed(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
 
-	if marshalErr != nil {
-		panic(fmt.Errorf("%v", marshalErr))
+	w := &Wallet{Network: loc.Params.Name, Addresses: make([]Address, 0), location: loc}
+	w.Mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	if err := w.SetSeed(seed); err != nil {
+		return nil, err
 	}
+	return w, nil
+}
 
-	return w
+// SetBirthHeight starts scans from a block known to be before the wallet's first use, rescanning from it
+func (wallet *Wallet) SetBirthHeight(height int32) error {
+	if height < 0 {
+		return ErrNegativeHeight
+	}
+	wallet.Birthday, wallet.BirthHeight = 0, height
+	wallet.resetScan()
+	return wallet.Save()
 }
 
 // Add adds a new keypair to the wallet and saves it
-func (wallet *Wallet) Add(pubKey cryptography.PublicKey, secretKey *big.Int) {
+func (wallet *Wallet) Add(pubKey cryptography.PublicKey, secretKey *big.Int) error {
+	if err := wallet.unlocked(); err != nil {
+		return err
+	}
 	addr := Address{PublicKey: pubKey, SecretKey: secretKey}
 	wallet.Addresses = append(wallet.Addresses, addr)
-	wallet.Save()
+	return wallet.Save()
 }
 
-// GenerateNew creates a new keypair and saves it
-func (wallet *Wallet) GenerateNew() string {
+// GenerateNew creates a new keypair, saves it and returns its native segwit address
+func (wallet *Wallet) GenerateNew() (string, error) {
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	if wallet.MasterKey != "" {
+		return wallet.deriveNext()
+	}
+
 	secretKey, pubKey := cryptography.RandomKeyPair()
-	wallet.Add(pubKey, secretKey)
-	return pubKey.ToAddress()
+	if err := wallet.Add(pubKey, secretKey); err != nil {
+		return "", err
+	}
+	return pubKey.ToSegwitAddress(wallet.location.Params), nil
+}
+
+// ImportWIF adds the key of a Wallet Import Format string, returning its native segwit address, the next scan starts again from genesis as the key may have been paid at any height
+func (wallet *Wallet) ImportWIF(wif string) (string, error) {
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	secretKey, compressed, err := cryptography.DecodeWIF(wif, wallet.location.Params)
+	if err != nil {
+		return "", err
+	}
+	if !compressed {
+		return "", ErrUncompressedKey
+	}
+
+	pubKey := cryptography.PublicKeyFromSecretKey(secretKey)
+	if _, err := wallet.Find(pubKey.ToSegwitAddress(wallet.location.Params)); err == nil {
+		return "", ErrKeyExists
+	}
+
+	// Coins paid to the key below the scanned height or before the birthday would never be found otherwise
+	wallet.Birthday, wallet.BirthHeight = 0, 0
+	wallet.resetScan()
+	if err := wallet.Add(pubKey, secretKey); err != nil {
+		return "", err
+	}
+	return pubKey.ToSegwitAddress(wallet.location.Params), nil
+}
+
+// ExportWIF gives the Wallet Import Format of the key behind an address
+func (wallet *Wallet) ExportWIF(address string) (string, error) {
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	addr, err := wallet.Find(address)
+	if err != nil {
+		return "", err
+	}
+	return cryptography.EncodeWIF(addr.SecretKey, true, wallet.location.Params), nil
+}
+
+// SignMessage signs a message with the key of a legacy P2PKH address, Bitcoin Core signmessage style
+func (wallet *Wallet) SignMessage(address, message string) (string, error) {
+	if version, _, err := cryptography.DecodeAddress(address); err != nil || version != wallet.location.Params.PubKeyHashAddrID {
+		return "", cryptography.ErrNotPubKeyHashAddress
+	}
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	addr, err := wallet.Find(address)
+	if err != nil {
+		return "", err
+	}
+	return cryptography.SignBitcoinMessage(addr.SecretKey, message), nil
+}
+
+// SignMessageBIP322 proves control of a legacy, native segwit or taproot address of the wallet with a BIP322 proof
+func (wallet *Wallet) SignMessageBIP322(address, message string) (string, error) {
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	addr, err := wallet.Find(address)
+	if err != nil {
+		return "", err
+	}
+	return chain.SignBIP322(address, message, addr.SecretKey, wallet.location.Params)
+}
+
+// SignMessageMultisig gives a BIP322 proof for a P2SH or P2WSH multisig address, the wallet must hold enough of its keys
+func (wallet *Wallet) SignMessageMultisig(address, message string, redeemScript []byte) (string, error) {
+	if err := wallet.unlocked(); err != nil {
+		return "", err
+	}
+	_, pubKeys, ok := script.ParseMultisig(redeemScript)
+	if !ok {
+		return "", chain.ErrUnsupportedAddress
+	}
+
+	secretKeys := make([]*big.Int, 0)
+	for _, pubKey := range pubKeys {
+		for _, addr := range wallet.Addresses {
+			if bytes.Equal(addr.PublicKey.EncodeCompressed(), pubKey) {
+				secretKeys = append(secretKeys, addr.SecretKey)
+			}
+		}
+	}
+	return chain.SignBIP322Multisig(address, message, redeemScript, secretKeys, wallet.location.Params)
+}
+
+// SignTransaction signs every input of a transaction being built, each must spend an output locked to one of the wallet's keys
+func (wallet *Wallet) SignTransaction(b *chain.Builder) error {
+	if err := wallet.unlocked(); err != nil {
+		return err
+	}
+	for i := 0; i < b.NumInputs(); i++ {
+		addr, err := wallet.findScript(b.PrevScript(i))
+		if err != nil {
+			return err
+		}
+		if err := b.SignInput(i, addr.SecretKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find looks up the keypair behind a native segwit, taproot or legacy address
+func (wallet *Wallet) Find(address string) (*Address, error) {
+	for i, addr := range wallet.Addresses {
+		pk := addr.PublicKey
+		if pk.ToSegwitAddress(wallet.location.Params) == address || pk.ToAddress(wallet.location.Params) == address || pk.ToTaprootAddress(wallet.location.Params) == address {
+			return &wallet.Addresses[i], nil
+		}
+	}
+	return nil, ErrAddressNotFound
+}
+
+// findScript looks up the keypair behind a P2PKH, P2WPKH, P2SH-P2WPKH or taproot locking script
+func (wallet *Wallet) findScript(lock []byte) (*Address, error) {
+	for i, addr := range wallet.Addresses {
+		hash := addr.PublicKey.HashEncode()
+		outputKey, err := cryptography.TaprootOutputKey(addr.PublicKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		nested := script.WitnessProgram(0, hash).Encode()
+		for _, candidate := range []*script.Script{script.P2PKH(hash), script.WitnessProgram(0, hash), script.P2SH(cryptography.Hash160(nested)), script.WitnessProgram(1, outputKey)} {
+			if bytes.Equal(candidate.Encode(), lock) {
+				return &wallet.Addresses[i], nil
+			}
+		}
+	}
+	return nil, ErrAddressNotFound
+}
+
+// SetSeed makes the wallet hierarchical deterministic, new addresses are then derived from the seed
+func (wallet *Wallet) SetSeed(seed []byte) error {
+	if err := wallet.unlocked(); err != nil {
+		return err
+	}
+	master, err := cryptography.NewMasterKey(seed, wallet.location.Params)
+	if err != nil {
+		return err
+	}
+
+	wallet.MasterKey = master.String()
+	wallet.NextIndex = 0
+	if err := wallet.setAccountKey(); err != nil {
+		return err
+	}
+	return wallet.Save()
+}
+
+// AccountPath is the BIP84 account m/84'/coin'/0' whose receive and change chains addresses are derived on
+func AccountPath(params *chainparams.Params) []uint32 {
+	h := cryptography.HardenedKeyStart
+	return []uint32{h + 84, h + params.HDCoinType, h + 0}
+}
+
+// ReceivePath is the BIP84 external chain m/84'/coin'/0'/0 that addresses are derived on
+func ReceivePath(params *chainparams.Params) []uint32 {
+	return append(AccountPath(params), 0)
+}
+
+// ChangePath is the BIP84 internal chain m/84'/coin'/0'/1 that change addresses are derived on
+func ChangePath(params *chainparams.Params) []uint32 {
+	return append(AccountPath(params), 1)
+}
+
+// setAccountKey records the account's extended public key from the master key
+func (wallet *Wallet) setAccountKey() error {
+	master, err := cryptography.ParseExtendedKey(wallet.MasterKey, wallet.location.Params)
+	if err != nil {
+		return err
+	}
+	account, err := master.Derive(AccountPath(wallet.location.Params))
+	if err != nil {
+		return err
+	}
+	wallet.AccountKey = account.Neuter(wallet.location.Params).String()
+	return nil
+}
+
+func (wallet *Wallet) deriveNext() (string, error) {
+	addr, index, err := wallet.deriveKey(ReceivePath(wallet.location.Params), wallet.NextIndex)
+	if err != nil {
+		return "", err
+	}
+	wallet.NextIndex = index + 1
+	wallet.Addresses = append(wallet.Addresses, addr)
+	if err := wallet.Save(); err != nil {
+		return "", err
+	}
+	return addr.PublicKey.ToSegwitAddress(wallet.location.Params), nil
+}
+
+// deriveKey derives the key at the first valid index from index onwards on the chain at path
+func (wallet *Wallet) deriveKey(path []uint32, index uint32) (Address, uint32, error) {
+	parent, err := wallet.chainKey(path)
+	if err != nil {
+		return Address{}, 0, err
+	}
+	return deriveChild(parent, path, index)
+}
+
+// chainKey is the extended key at path, public only if derived from the account key while the master key is locked away
+func (wallet *Wallet) chainKey(path []uint32) (*cryptography.ExtendedKey, error) {
+	if wallet.MasterKey != "" {
+		master, err := cryptography.ParseExtendedKey(wallet.MasterKey, wallet.location.Params)
+		if err != nil {
+			return nil, err
+		}
+		return master.Derive(path)
+	}
+
+	accountPath := AccountPath(wallet.location.Params)
+	if wallet.AccountKey == "" || !hasPathPrefix(path, accountPath) {
+		return nil, ErrLocked
+	}
+	account, err := cryptography.ParseExtendedKey(wallet.AccountKey, wallet.location.Params)
+	if err != nil {
+		return nil, err
+	}
+	return account.Derive(path[len(accountPath):])
+}
+
+// deriveChild derives the child of parent, the key at path, at the first valid index from index onwards
+func deriveChild(parent *cryptography.ExtendedKey, path []uint32, index uint32) (Address, uint32, error) {
+	for ; ; index++ {
+		key, err := parent.Child(index)
+		if err == cryptography.ErrInvalidChild {
+			continue // Astronomically unlikely, BIP32 says skip to the next index
+		}
+		if err != nil {
+			return Address{}, 0, err
+		}
+
+		secretKey, _ := key.SecretKey()
+		full := append(append([]uint32{}, path...), index)
+		return Address{PublicKey: key.PublicKey(), SecretKey: secretKey, Path: cryptography.FormatDerivationPath(full)}, index, nil
+	}
+}
+
+// deriveSecret derives the secret key of an address from its derivation path
+func (wallet *Wallet) deriveSecret(path string) (*big.Int, error) {
+	indexes, err := cryptography.ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wallet.chainKey(indexes)
+	if err != nil {
+		return nil, err
+	}
+	return key.SecretKey()
+}
+
+func hasPathPrefix(path, prefix []uint32) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
 }
 
-// ListAddresses returns a slice of the addresses in the wallet
+// ListAddresses returns a slice of the native segwit addresses in the wallet
 func (wallet *Wallet) ListAddresses() (addresses []string) {
 	addresses = make([]string, 0)
 	for _, addr := range wallet.Addresses {
-		addresses = append(addresses, addr.PublicKey.ToAddress())
+		addresses = append(addresses, addr.PublicKey.ToSegwitAddress(wallet.location.Params))
 	}
 	return
 }
 
 
-func getWalletData() ([]byte, error) {
-	if _, err := os.Stat(getWalletFolder()); os.IsNotExist(err) {
-		os.Mkdir(getWalletFolder(), 0777)
-	}
-	if _, err := os.Stat(getWalletFile()); os.IsNotExist(err) {
-		return nil, err
-	}
-	return ioutil.ReadFile(getWalletFile())
+// Params returns the network the wallet belongs to
+func (wallet *Wallet) Params() *chainparams.Params {
+	return wallet.location.Params
 }
 
-func getWalletFolder() string {
-	cwd, _ := os.Getwd()
-	return cwd + "/configs"
+// Name of the wallet within its data directory
+func (wallet *Wallet) Name() string {
+	return wallet.location.Name
 }
 
-func getWalletFile() string {
-	return getWalletFolder() + "/wallet.json"
-}
\ No newline at end of file
+// Path of the wallet file
+func (wallet *Wallet) Path() string {
+	return wallet.location.File()
+}
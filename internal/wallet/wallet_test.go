@@ -1,17 +1,887 @@
 package wallet
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"github.com/harveynw/blokechain/internal/chain"
+	"github.com/harveynw/blokechain/internal/chainparams"
+	"github.com/harveynw/blokechain/internal/cryptography"
+	"github.com/harveynw/blokechain/internal/script"
 )
 
 func TestLoading(t *testing.T) {
-	os.Chdir("../..")
-
-	wallet := Load()
+	params := chainparams.RegTest()
+	wallet, _ := Create(testLocation(t, params), 12)
 	for i := 0; i < 5; i++ {
 		wallet.GenerateNew()
 	}
-	fmt.Println(wallet.ListAddresses())
-}
\ No newline at end of file
+
+	// Distinct P2WPKH addresses of the wallet's network
+	addresses := wallet.ListAddresses()
+	if len(addresses) != 5 {
+		t.Fatalf("Expected 5 addresses, got %v", addresses)
+	}
+	seen := make(map[string]bool)
+	for _, addr := range addresses {
+		version, program, err := cryptography.DecodeSegwitAddress(params.Bech32HRPSegwit, addr)
+		if err != nil || version != 0 || len(program) != 20 || !strings.HasPrefix(addr, "bcrt1q") || seen[addr] {
+			t.Errorf("Address %s is not a new regtest P2WPKH address (%v)", addr, err)
+		}
+		seen[addr] = true
+	}
+}
+
+func TestHDAddresses(t *testing.T) {
+	loc := testLocation(t, chainparams.MainNet())
+
+	// BIP84 test vector, seed of "abandon abandon ... about"
+	seed, _ := hex.DecodeString("5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4")
+
+	wallet := &Wallet{Network: "mainnet", location: loc}
+	if err := wallet.SetSeed(seed); err != nil {
+		t.Fatalf("Failed to set seed %v", err)
+	}
+
+	expected := []string{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"}
+	for i, addr := range expected {
+		if generated, _ := wallet.GenerateNew(); generated != addr {
+			t.Errorf("Address %v should be %s, got %s", i, addr, generated)
+		}
+	}
+	if wallet.Addresses[1].Path != "m/84'/0'/0'/0/1" {
+		t.Errorf("Wrong derivation path %s", wallet.Addresses[1].Path)
+	}
+
+	// Derivation carries on from the saved index
+	reloaded, _ := Load(loc)
+	if reloaded.NextIndex != 2 || len(reloaded.Addresses) != 2 {
+		t.Errorf("Wallet state not saved, next index %v", reloaded.NextIndex)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	loc := testLocation(t, chainparams.MainNet())
+
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	wallet, err := Restore(loc, mnemonic, "")
+	if err != nil {
+		t.Fatalf("Failed restore %v", err)
+	}
+	if addr, _ := wallet.GenerateNew(); addr != "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu" {
+		t.Errorf("Restored wallet gave address %s", addr)
+	}
+	if _, err := Restore(loc, mnemonic, ""); err != ErrWalletExists {
+		t.Errorf("Expected restore over existing wallet to fail, got %v", err)
+	}
+
+	// New wallets are created from a fresh mnemonic
+	created, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	if len(strings.Fields(created.Mnemonic)) != 12 || created.MasterKey == "" {
+		t.Errorf("Wallet not created from a mnemonic")
+	}
+}
+
+func TestWIF(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.MainNet()), 12)
+	addr, err := wallet.ImportWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn")
+	if err != nil || addr != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Fatalf("Failed import, got %s (%v)", addr, err)
+	}
+	if _, err := wallet.ImportWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn"); err != ErrKeyExists {
+		t.Errorf("Expected duplicate import to fail, got %v", err)
+	}
+	if _, err := wallet.ImportWIF("5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAnchuDf"); err != ErrUncompressedKey {
+		t.Errorf("Expected uncompressed import to fail, got %v", err)
+	}
+
+	// Legacy and segwit addresses share the key
+	wif, err := wallet.ExportWIF("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH")
+	if err != nil || wif != "KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn" {
+		t.Errorf("Failed export (%v)", err)
+	}
+	if _, err := wallet.ExportWIF("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"); err != ErrAddressNotFound {
+		t.Errorf("Expected unknown address, got %v", err)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.MainNet()), 12)
+	wallet.ImportWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn")
+
+	sig, err := wallet.SignMessage("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", "Deposit address of customer 42")
+	if err != nil {
+		t.Fatalf("Failed to sign %v", err)
+	}
+	if valid, err := cryptography.VerifyBitcoinMessage("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", sig, "Deposit address of customer 42", wallet.Params()); !valid || err != nil {
+		t.Errorf("Signature did not verify (%v)", err)
+	}
+	if _, err := wallet.SignMessage("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", "Segwit"); err != cryptography.ErrNotPubKeyHashAddress {
+		t.Errorf("Expected segwit address to be rejected, got %v", err)
+	}
+}
+
+func TestSignMessageBIP322(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.MainNet()), 12)
+	wallet.ImportWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn")
+
+	// Taproot address of the same key
+	taproot := "bc1pmfr3p9j00pfxjh0zmgp99y8zftmd3s5pmedqhyptwy6lm87hf5sspknck9"
+	for _, address := range []string{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", taproot} {
+		proof, err := wallet.SignMessageBIP322(address, "Hello World")
+		if err != nil {
+			t.Fatalf("Failed to sign for %s (%v)", address, err)
+		}
+		if valid, err := chain.VerifyBIP322(address, "Hello World", proof, wallet.Params()); !valid || err != nil {
+			t.Errorf("Proof for %s did not verify (%v)", address, err)
+		}
+	}
+
+	// 1 of 2 multisig with a key the wallet does not hold
+	_, other := cryptography.RandomKeyPair()
+	redeemScript := script.Multisig(1, [][]byte{other.EncodeCompressed(), wallet.Addresses[0].PublicKey.EncodeCompressed()}).Encode()
+	address := cryptography.Base58CheckEncode(wallet.Params().ScriptHashAddrID, cryptography.Hash160(redeemScript))
+	proof, err := wallet.SignMessageMultisig(address, "Hello World", redeemScript)
+	if err != nil {
+		t.Fatalf("Failed to sign for multisig (%v)", err)
+	}
+	if valid, err := chain.VerifyBIP322(address, "Hello World", proof, wallet.Params()); !valid || err != nil {
+		t.Errorf("Multisig proof did not verify (%v)", err)
+	}
+}
+
+func TestSignTransaction(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	segwit, _ := wallet.GenerateNew()
+	taproot := wallet.Addresses[0].PublicKey.ToTaprootAddress(wallet.Params())
+
+	b := chain.NewBuilder(wallet.Params())
+	for i, address := range []string{segwit, taproot} {
+		lock, _ := script.PayToAddress(address, wallet.Params())
+		b.AddInput(cryptography.Hash256([]byte(address)), uint32(i), lock.Encode(), 50000)
+	}
+	b.AddOutput(segwit, 99000)
+	if err := wallet.SignTransaction(b); err != nil {
+		t.Fatalf("Failed to sign %v", err)
+	}
+	if _, err := b.Build(); err != nil {
+		t.Errorf("Signed transaction did not build (%v)", err)
+	}
+
+	// Inputs the wallet holds no key for
+	_, other := cryptography.RandomKeyPair()
+	b.AddInput(make([]byte, 32), 0, script.P2PKH(other.HashEncode()).Encode(), 1000)
+	if err := wallet.SignTransaction(b); err != ErrAddressNotFound {
+		t.Errorf("Expected a foreign input to be rejected, got %v", err)
+	}
+}
+
+func TestPayment(t *testing.T) {
+	loc := testLocation(t, chainparams.RegTest())
+	wallet, _ := Create(loc, 12)
+	receive, _ := wallet.GenerateNew()
+	lock, _ := script.PayToAddress(receive, wallet.Params())
+	for i, amount := range []uint64{50000000, 30000000} {
+		wallet.UTXOs = append(wallet.UTXOs, UTXO{TxID: cryptography.Hash256([]byte{byte(i)}), Index: uint32(i), Amount: amount, Script: lock.Encode(), Height: 1})
+	}
+	wallet.Save()
+
+	_, other := cryptography.RandomKeyPair()
+	to := other.ToTaprootAddress(wallet.Params())
+	p, err := wallet.CreatePayment(to, 60000000, 2000)
+	if err != nil {
+		t.Fatalf("Failed to create payment %v", err)
+	}
+	if p.Change == 0 || p.Amount + p.Change + p.Fee != 80000000 || p.FeeRate() < 2000 || len(p.Raw) < p.VSize {
+		t.Errorf("Unexpected payment %+v", p)
+	}
+
+	// Nothing changes until the payment is committed, a dry run can be repeated
+	again, _ := wallet.CreatePayment(to, 60000000, 2000)
+	if len(wallet.UTXOs) != 2 || wallet.NextChangeIndex != 0 || again.ChangeAddress != p.ChangeAddress {
+		t.Errorf("Creating a payment changed the wallet")
+	}
+
+	if err := wallet.CommitPayment(p); err != nil {
+		t.Fatalf("Failed to commit %v", err)
+	}
+	if err := wallet.CommitPayment(p); err != ErrPaymentCommitted {
+		t.Errorf("Expected second commit to fail, got %v", err)
+	}
+	reloaded, _ := Load(loc)
+	change, err := reloaded.Find(p.ChangeAddress)
+	if err != nil || !change.Change || change.Path != "m/84'/1'/0'/1/0" || reloaded.NextChangeIndex != 1 {
+		t.Errorf("Change address not kept (%v)", err)
+	}
+	if spendable := reloaded.spendable(); len(spendable) != 1 || spendable[0].Amount != p.Change || chain.HashString(spendable[0].TxID) != p.TxID {
+		t.Errorf("Spent UTXOs not replaced by change %+v", spendable)
+	}
+	if balance := reloaded.TotalBalance(); balance.Confirmed != 0 || balance.Unconfirmed != p.Change {
+		t.Errorf("Unexpected balance after payment %+v", balance)
+	}
+
+	if _, err := reloaded.CreatePayment(to, 60000000, 2000); err != ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds, got %v", err)
+	}
+	if _, err := reloaded.CreatePayment(to, 1000, 500); err != ErrFeeRateTooLow {
+		t.Errorf("Expected feerate too low, got %v", err)
+	}
+	if _, err := reloaded.CreatePayment(to, 100, 1000); err != ErrDustOutput {
+		t.Errorf("Expected dust, got %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	segwit, _ := wallet.GenerateNew()
+	taproot := wallet.Addresses[0].PublicKey.ToTaprootAddress(wallet.Params())
+	_, other := cryptography.RandomKeyPair()
+
+	src := &memorySource{}
+	src.add(payTo(t, wallet, true, other.ToSegwitAddress(wallet.Params()), 5000000000))
+	src.add(payTo(t, wallet, true, taproot, 5000000000))
+	src.add(payTo(t, wallet, false, segwit, 100000000))
+
+	if n, err := wallet.Scan(src); err != nil || n != 3 {
+		t.Fatalf("Scanned %v blocks (%v)", n, err)
+	}
+	balances := wallet.Balances()
+	if balances[segwit].Confirmed != 100000000 || balances[taproot].Immature != 5000000000 || len(wallet.History) != 2 {
+		t.Errorf("Unexpected balances %+v", balances)
+	}
+
+	// Coinbase matures after 100 more blocks
+	for i := 0; i < 100; i++ {
+		src.add()
+	}
+	if n, _ := wallet.Scan(src); n != 100 || wallet.TotalBalance().Confirmed != 5100000000 {
+		t.Errorf("Coinbase not matured, balance %+v", wallet.TotalBalance())
+	}
+
+	p, err := wallet.CreatePayment(other.ToSegwitAddress(wallet.Params()), 5050000000, 1000)
+	if err != nil {
+		t.Fatalf("Failed to create payment %v", err)
+	}
+	wallet.CommitPayment(p)
+	if balance := wallet.TotalBalance(); balance.Confirmed != 0 || balance.Unconfirmed != p.Change {
+		t.Errorf("Inputs not reserved %+v", balance)
+	}
+
+	// Mined, the change confirms
+	tx, _, _ := chain.DecodeNextTransaction(p.Raw)
+	src.add(tx)
+	wallet.Scan(src)
+	record := wallet.History[len(wallet.History)-1]
+	if balance := wallet.TotalBalance(); balance.Confirmed != p.Change || len(wallet.UTXOs) != 1 || record.Height != 103 || record.Sent != 5100000000 {
+		t.Errorf("Payment not confirmed %+v, %+v", balance, record)
+	}
+
+	// Reorganised away, the wallet follows the new chain
+	src.hashes = src.hashes[:len(src.hashes)-1]
+	src.add()
+	if _, err := wallet.Scan(src); err != nil || wallet.TotalBalance().Confirmed != 5100000000 || wallet.ScanHeight != 103 {
+		t.Errorf("Reorg not followed, balance %+v (%v)", wallet.TotalBalance(), err)
+	}
+}
+
+func TestAbandonPayment(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	segwit, _ := wallet.GenerateNew()
+	_, other := cryptography.RandomKeyPair()
+	to := other.ToSegwitAddress(wallet.Params())
+
+	src := &memorySource{}
+	src.add()
+	src.add(payTo(t, wallet, false, segwit, 1000000), payTo(t, wallet, false, segwit, 2000000))
+	wallet.Scan(src)
+
+	// Never broadcast, the inputs come back once abandoned
+	p, _ := wallet.CreatePayment(to, 2500000, 1000)
+	wallet.CommitPayment(p)
+	if err := wallet.AbandonPayment(p.TxID); err != nil {
+		t.Fatalf("Failed to abandon %v", err)
+	}
+	if balance := wallet.TotalBalance(); balance.Confirmed != 3000000 || balance.Unconfirmed != 0 || len(wallet.History) != 2 {
+		t.Errorf("Payment not abandoned %+v", balance)
+	}
+	if err := wallet.AbandonPayment(p.TxID); err != ErrPaymentNotFound {
+		t.Errorf("Expected abandoned payment to be gone, got %v", err)
+	}
+
+	// A conflicting spend of one input confirms, the other is released
+	p, _ = wallet.CreatePayment(to, 2500000, 1000)
+	wallet.CommitPayment(p)
+	b := chain.NewBuilder(wallet.Params())
+	b.AddInput(p.Inputs[0].TxID, p.Inputs[0].Index, nil, 0)
+	b.AddOutput(to, p.Inputs[0].Amount - 1000)
+	src.add(b.Transaction())
+	wallet.Scan(src)
+	if balance := wallet.TotalBalance(); balance.Confirmed != 3000000 - p.Inputs[0].Amount || balance.Unconfirmed != 0 || len(wallet.spendable()) != 1 {
+		t.Errorf("Conflicted payment still reserves coins %+v", balance)
+	}
+	if err := wallet.AbandonPayment(p.TxID); err != ErrPaymentNotFound {
+		t.Errorf("Expected conflicted payment to be gone, got %v", err)
+	}
+}
+
+func TestScanGapLimit(t *testing.T) {
+	original, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	params := original.Params()
+	receive := func(index uint32) Address {
+		addr, _, _ := original.deriveKey(ReceivePath(params), index)
+		return addr
+	}
+	change, _, _ := original.deriveKey(ChangePath(params), 3)
+
+	// Restored and locked, the wallet has handed out no addresses yet
+	loc := testLocation(t, params)
+	wallet, _ := Restore(loc, original.Mnemonic, "")
+	wallet.Encrypt("correct horse")
+
+	src := &memorySource{}
+	src.add()
+	src.add(payTo(t, wallet, false, receive(5).PublicKey.ToSegwitAddress(params), 1000000), payTo(t, wallet, false, change.PublicKey.ToTaprootAddress(params), 2000000))
+	src.add(payTo(t, wallet, false, receive(24).PublicKey.ToSegwitAddress(params), 3000000))
+	src.add(payTo(t, wallet, false, receive(45).PublicKey.ToSegwitAddress(params), 4000000)) // Past the gap after index 24
+
+	if _, err := wallet.Scan(src); err != nil {
+		t.Fatalf("Failed to scan %v", err)
+	}
+	reloaded, _ := Load(loc)
+	if balance := reloaded.TotalBalance(); balance.Confirmed != 6000000 || reloaded.NextIndex != 25 || reloaded.NextChangeIndex != 4 || len(reloaded.Addresses) != 29 {
+		t.Errorf("Lookahead keys not found, balance %+v, next %v and %v", balance, reloaded.NextIndex, reloaded.NextChangeIndex)
+	}
+	if found, err := reloaded.Find(change.PublicKey.ToSegwitAddress(params)); err != nil || !found.Change || found.Path != change.Path {
+		t.Errorf("Change key not kept (%v)", err)
+	}
+
+	// Keys found while locked get their secrets on unlock
+	if err := reloaded.Unlock("correct horse", time.Minute); err != nil {
+		t.Fatalf("Failed to unlock %v", err)
+	}
+	if found, _ := reloaded.Find(receive(24).PublicKey.ToSegwitAddress(params)); found.SecretKey == nil || found.SecretKey.Cmp(receive(24).SecretKey) != 0 {
+		t.Errorf("Secret key of a key found while locked not derived")
+	}
+}
+
+func TestScanBirthday(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	segwit, _ := wallet.GenerateNew()
+
+	// Blocks from before the wallet was created are skipped, bar those within MaxFutureBlockTime of it
+	src := &memorySource{start: uint32(wallet.Birthday) - 100 * 600}
+	for i := 0; i < 200; i++ {
+		src.add()
+	}
+	src.add(payTo(t, wallet, false, segwit, 1000000))
+	if n, err := wallet.Scan(src); err != nil || n != 113 || wallet.BirthHeight != 88 || wallet.TotalBalance().Confirmed != 1000000 {
+		t.Errorf("Scanned %v blocks from %v (%v)", n, wallet.BirthHeight, err)
+	}
+
+	// A reorg disconnects the blocks after the fork only
+	src.hashes = src.hashes[:len(src.hashes)-1]
+	src.add()
+	if n, err := wallet.Scan(src); err != nil || n != 1 || wallet.TotalBalance().Confirmed != 0 || len(wallet.History) != 0 {
+		t.Errorf("Rescanned %v blocks (%v)", n, err)
+	}
+
+	// One deeper than the blocks remembered rescans from the birth height, not genesis
+	src.hashes = src.hashes[:len(src.hashes)-reorgDepth-1]
+	for i := 0; i <= reorgDepth; i++ {
+		src.add()
+	}
+	if n, err := wallet.Scan(src); err != nil || n != 113 || len(wallet.Recent) != reorgDepth {
+		t.Errorf("Rescanned %v blocks (%v)", n, err)
+	}
+
+	// Restored wallets scan from genesis unless told otherwise
+	restored, _ := Restore(testLocation(t, chainparams.RegTest()), wallet.Mnemonic, "")
+	if err := restored.SetBirthHeight(-1); err != ErrNegativeHeight {
+		t.Errorf("Expected negative height to be rejected, got %v", err)
+	}
+	restored.SetBirthHeight(150)
+	if n, err := restored.Scan(src); err != nil || n != 51 {
+		t.Errorf("Scanned %v blocks from the given height (%v)", n, err)
+	}
+}
+
+func TestScanMempool(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	segwit, _ := wallet.GenerateNew()
+	_, other := cryptography.RandomKeyPair()
+	to := other.ToSegwitAddress(wallet.Params())
+
+	src := &memorySource{}
+	src.add()
+	src.add(payTo(t, wallet, false, segwit, 1000000))
+	incoming := payTo(t, wallet, false, segwit, 500000)
+	src.mempool = []chain.Transaction{incoming}
+	wallet.Scan(src)
+	if balance := wallet.TotalBalance(); balance.Confirmed != 1000000 || balance.Unconfirmed != 500000 || len(wallet.History) != 2 {
+		t.Errorf("Incoming payment not seen %+v", balance)
+	}
+	if spendable := wallet.spendable(); len(spendable) != 1 || spendable[0].Height != 1 {
+		t.Errorf("Unconfirmed incoming payment spendable %+v", spendable)
+	}
+
+	// Evicted, then mined
+	src.mempool = nil
+	wallet.Scan(src)
+	if balance := wallet.TotalBalance(); balance.Unconfirmed != 0 || len(wallet.History) != 1 {
+		t.Errorf("Evicted payment kept %+v", balance)
+	}
+	src.add(incoming)
+	wallet.Scan(src)
+	if balance := wallet.TotalBalance(); balance.Confirmed != 1500000 || balance.Unconfirmed != 0 || wallet.History[1].Height != 2 {
+		t.Errorf("Mined payment not confirmed %+v", balance)
+	}
+
+	// A spend by another copy of the wallet, and its child paying back, in either order
+	b := chain.NewBuilder(wallet.Params())
+	b.AddInput(incoming.ID(), 0, nil, 0)
+	b.AddOutput(segwit, 300000)
+	b.AddOutput(to, 199000)
+	spend := b.Transaction()
+	b = chain.NewBuilder(wallet.Params())
+	b.AddInput(spend.ID(), 0, nil, 0)
+	b.AddOutput(to, 299000)
+	src.mempool = []chain.Transaction{b.Transaction(), spend}
+	wallet.Scan(src)
+	if balance := wallet.TotalBalance(); balance.Confirmed != 1000000 || balance.Unconfirmed != 0 || len(wallet.History) != 4 {
+		t.Errorf("Unconfirmed spends not seen %+v", balance)
+	}
+}
+
+func TestScanImportWIF(t *testing.T) {
+	wallet, _ := Create(testLocation(t, chainparams.RegTest()), 12)
+	secretKey, imported := cryptography.RandomKeyPair()
+	address := imported.ToSegwitAddress(wallet.Params())
+
+	// Paid before the wallet's birthday and below its scanned height
+	src := &memorySource{start: uint32(wallet.Birthday) - 100 * 600}
+	src.add()
+	src.add(payTo(t, wallet, false, address, 1000000))
+	for i := 0; i < 149; i++ {
+		src.add()
+	}
+	wallet.Scan(src)
+	if wallet.ScanHeight != 150 || wallet.BirthHeight == 0 {
+		t.Fatalf("Scanned to %v from %v", wallet.ScanHeight, wallet.BirthHeight)
+	}
+
+	if _, err := wallet.ImportWIF(cryptography.EncodeWIF(secretKey, true, wallet.Params())); err != nil {
+		t.Fatalf("Failed import %v", err)
+	}
+	if n, err := wallet.Scan(src); err != nil || n != 151 || wallet.Balances()[address].Confirmed != 1000000 {
+		t.Errorf("Imported key's coins not found after %v blocks (%v)", n, err)
+	}
+}
+
+// memorySource is a chain of blocks held in memory, ten minutes apart from start, and a mempool
+type memorySource struct {
+	hashes [][]byte
+	blocks map[string]chain.Block
+	start uint32
+	mempool []chain.Transaction
+}
+
+func (src *memorySource) add(txs ...chain.Transaction) {
+	if src.blocks == nil {
+		src.blocks = make(map[string]chain.Block)
+	}
+	if src.start == 0 {
+		src.start = uint32(time.Now().Unix())
+	}
+	hash := cryptography.Hash256([]byte(fmt.Sprintf("%v %v", len(src.hashes), len(src.blocks))))
+	header := &chain.BlockHeader{Time: src.start + uint32(len(src.hashes)) * 600}
+	src.hashes = append(src.hashes, hash)
+	src.blocks[string(hash)] = chain.NewBlock(header, txs)
+}
+
+func (src *memorySource) BestHeight() (int32, error) {
+	return int32(len(src.hashes)) - 1, nil
+}
+
+func (src *memorySource) BlockHash(height int32) ([]byte, error) {
+	if int(height) >= len(src.hashes) {
+		return nil, errors.New("Height beyond the best block")
+	}
+	return src.hashes[height], nil
+}
+
+func (src *memorySource) BlockHeader(hash []byte) (*chain.BlockHeader, error) {
+	return src.blocks[string(hash)].Header, nil
+}
+
+func (src *memorySource) Block(hash []byte) (chain.Block, error) {
+	return src.blocks[string(hash)], nil
+}
+
+func (src *memorySource) Mempool() ([][]byte, error) {
+	ids := make([][]byte, 0, len(src.mempool))
+	for _, tx := range src.mempool {
+		ids = append(ids, tx.ID())
+	}
+	return ids, nil
+}
+
+func (src *memorySource) Transaction(id []byte) (chain.Transaction, error) {
+	for _, tx := range src.mempool {
+		if bytes.Equal(tx.ID(), id) {
+			return tx, nil
+		}
+	}
+	return chain.Transaction{}, errors.New("Transaction not in the mempool")
+}
+
+// payTo makes an unsigned transaction, or coinbase, paying address
+func payTo(t *testing.T, wallet *Wallet, coinbase bool, address string, amount uint64) chain.Transaction {
+	b := chain.NewBuilder(wallet.Params())
+	if coinbase {
+		b.AddInput(make([]byte, 32), 0xFFFFFFFF, nil, 0)
+	} else {
+		b.AddInput(cryptography.Hash256([]byte(address)), 0, nil, 0)
+	}
+	if err := b.AddOutput(address, amount); err != nil {
+		t.Fatalf("Failed to pay to %s (%v)", address, err)
+	}
+	return b.Transaction()
+}
+
+func TestParseAmount(t *testing.T) {
+	cases := map[string]uint64{"1": 100000000, "0.015": 1500000, ".00000001": 1, "21000000": 2100000000000000, "0.1": 10000000}
+	for s, expected := range cases {
+		if sats, err := ParseAmount(s); err != nil || sats != expected {
+			t.Errorf("Parsed %s as %v (%v)", s, sats, err)
+		}
+	}
+	for _, s := range []string{"", ".", "-1", "1.123456789", "abc", "21000001", "21000000.5", "21000000.00000001", "1e5"} {
+		if _, err := ParseAmount(s); err != ErrInvalidAmount {
+			t.Errorf("Expected %q to be invalid, got %v", s, err)
+		}
+	}
+	if FormatAmount(1500000) != "0.01500000" {
+		t.Errorf("Formatted as %s", FormatAmount(1500000))
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	loc := testLocation(t, chainparams.RegTest())
+	wallet, _ := Create(loc, 12)
+	addr, _ := wallet.GenerateNew()
+	mnemonic := wallet.Mnemonic
+
+	if err := wallet.Encrypt("correct horse"); err != nil {
+		t.Fatalf("Failed to encrypt %v", err)
+	}
+	if _, err := wallet.GenerateNew(); err != ErrLocked {
+		t.Errorf("Expected locked wallet to refuse new keys, got %v", err)
+	}
+
+	// Nothing secret is written in the clear, and only the owner can read it
+	data, _ := ioutil.ReadFile(loc.File())
+	if strings.Contains(string(data), strings.Fields(mnemonic)[0] + " ") || strings.Contains(string(data), "SecretKey") {
+		t.Errorf("Wallet file holds plaintext secrets")
+	}
+	if info, _ := os.Stat(loc.File()); info.Mode().Perm() != 0600 {
+		t.Errorf("Wallet file mode is %v", info.Mode().Perm())
+	}
+
+	reloaded, _ := Load(loc)
+	if !reloaded.IsLocked() || reloaded.ListAddresses()[0] != addr {
+		t.Errorf("Encrypted wallet should load locked with its addresses")
+	}
+	if err := reloaded.Unlock("wrong horse", time.Minute); err != ErrWrongPassphrase {
+		t.Errorf("Expected wrong passphrase, got %v", err)
+	}
+	if err := reloaded.Unlock("correct horse", time.Minute); err != nil || reloaded.Mnemonic != mnemonic {
+		t.Fatalf("Failed to unlock (%v)", err)
+	}
+	if _, err := reloaded.ExportWIF(addr); err != nil {
+		t.Errorf("Unlocked wallet should export keys (%v)", err)
+	}
+
+	// New keys are encrypted with the rest
+	if _, err := reloaded.GenerateNew(); err != nil {
+		t.Errorf("Failed to generate while unlocked (%v)", err)
+	}
+	reloaded.Lock()
+	if _, err := reloaded.ExportWIF(addr); err != ErrLocked {
+		t.Errorf("Expected locked wallet, got %v", err)
+	}
+
+	// Unlocking expires
+	reloaded.Unlock("correct horse", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if !reloaded.IsLocked() {
+		t.Error("Wallet should lock after its timeout")
+	}
+
+	if err := reloaded.ChangePassphrase("correct horse", "battery staple"); err != nil {
+		t.Fatalf("Failed to change passphrase %v", err)
+	}
+	reloaded, _ = Load(loc)
+	if err := reloaded.Unlock("battery staple", time.Minute); err != nil || len(reloaded.Addresses) != 2 || reloaded.Addresses[1].SecretKey == nil {
+		t.Errorf("Failed to unlock with the new passphrase (%v)", err)
+	}
+
+	// Costs from a tampered file are refused before scrypt runs
+	for _, cost := range [][3]int{{1 << 30, 8, 1}, {1 << 15, 1 << 20, 1}, {1 << 15, 8, 1 << 20}} {
+		tampered, _ := Load(loc)
+		tampered.Encryption.N, tampered.Encryption.R, tampered.Encryption.P = cost[0], cost[1], cost[2]
+		if err := tampered.Unlock("battery staple", time.Minute); err != ErrUnsupportedEncryption {
+			t.Errorf("Expected scrypt costs %v to be refused, got %v", cost, err)
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	loc := testLocation(t, chainparams.MainNet())
+
+	// Unversioned file from before networks, HD keys and encryption
+	v0 := `{"Addresses":[{"PublicKey":{"x":55066263022277343669578718895168534326250603453777594175500187360389116729240,"y":32670510020758816978083085130507043184471273380659243275938904335757337482424},"SecretKey":1}]}`
+	os.MkdirAll(loc.Folder(), 0700)
+	ioutil.WriteFile(loc.File(), []byte(v0), 0600)
+
+	wallet, err := Load(loc)
+	if err != nil {
+		t.Fatalf("Failed to load old wallet %v", err)
+	}
+	if wallet.Network != "mainnet" || wallet.Version != walletVersion || wallet.ListAddresses()[0] != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("Wallet not migrated: %+v", wallet)
+	}
+
+	// The original is backed up and the file rewritten at the current version
+	backups, _ := filepath.Glob(filepath.Join(loc.Folder(), "wallet.v0.*.bak"))
+	if len(backups) != 1 {
+		t.Fatalf("Expected one backup, found %v", backups)
+	}
+	if data, _ := ioutil.ReadFile(backups[0]); string(data) != v0 {
+		t.Errorf("Backup does not match the original file")
+	}
+	if _, version, err := decodeWallet(mustRead(loc.File())); err != nil || version != walletVersion {
+		t.Errorf("Migrated file stored as version %v (%v)", version, err)
+	}
+}
+
+func TestCorruptWallet(t *testing.T) {
+	loc := testLocation(t, chainparams.RegTest())
+	os.MkdirAll(loc.Folder(), 0700)
+
+	cases := map[string]error{
+		`{"Version":1,"Network":"regtest","Addresses":[{"PublicKey":`: ErrCorruptWallet,
+		``: ErrCorruptWallet,
+		`{"Version":"one"}`: ErrCorruptWallet,
+		`{"Version":1,"Network":"regtest","Addresses":[{"PublicKey":{"x":1,"y":2}}]}`: ErrCorruptWallet,
+		`{"Version":99,"Network":"regtest"}`: ErrUnsupportedVersion,
+		`{"Version":1,"Network":"testnet"}`: ErrWrongNetwork,
+	}
+	for data, expected := range cases {
+		ioutil.WriteFile(loc.File(), []byte(data), 0600)
+		if _, err := Load(loc); !errors.Is(err, expected) {
+			t.Errorf("Loading %q gave %v, expected %v", data, err, expected)
+		}
+	}
+}
+
+func TestNamedWallets(t *testing.T) {
+	dataDir := t.TempDir()
+	params := chainparams.RegTest()
+
+	if _, err := Load(Location{DataDir: dataDir, Name: DefaultName, Params: params}); !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("Expected a missing wallet not to be created, got %v", err)
+	}
+	for _, name := range []string{"savings", DefaultName} {
+		loc, _ := NewLocation(dataDir, name, params)
+		if _, err := Create(loc, 12); err != nil {
+			t.Fatalf("Failed to create %s (%v)", name, err)
+		}
+	}
+	if _, err := NewLocation(dataDir, "../escape", params); err != ErrInvalidWalletName {
+		t.Errorf("Expected invalid name, got %v", err)
+	}
+
+	// Wallets are separate per name and network
+	names, err := List(dataDir, params)
+	if err != nil || len(names) != 2 || names[0] != DefaultName || names[1] != "savings" {
+		t.Errorf("Listed %v (%v)", names, err)
+	}
+	if names, _ := List(dataDir, chainparams.MainNet()); len(names) != 0 {
+		t.Errorf("Mainnet should have no wallets, listed %v", names)
+	}
+	savings, _ := Load(Location{DataDir: dataDir, Name: "savings", Params: params})
+	other, _ := Load(Location{DataDir: dataDir, Name: DefaultName, Params: params})
+	if savings.Name() != "savings" || savings.Mnemonic == other.Mnemonic {
+		t.Errorf("Named wallets should be independent")
+	}
+
+	os.Setenv(DataDirEnv, dataDir)
+	defer os.Unsetenv(DataDirEnv)
+	if loc, _ := NewLocation("", "", params); loc.DataDir != dataDir || loc.Name != DefaultName {
+		t.Errorf("Default location %+v", loc)
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	hash := make([]byte, 20)
+	cases := map[uint64][]byte{
+		294: script.WitnessProgram(0, hash).Encode(),
+		330: script.WitnessProgram(1, make([]byte, 32)).Encode(),
+		546: script.P2PKH(hash).Encode(),
+	}
+	for expected, lock := range cases {
+		if dust := DustThreshold(lock); dust != expected {
+			t.Errorf("Dust threshold of %x is %v, expected %v", lock, dust, expected)
+		}
+	}
+}
+
+func TestSelectBnB(t *testing.T) {
+	change := script.WitnessProgram(0, make([]byte, 20)).Encode()
+	p := SelectionParams{Target: 300000 - 42, BaseWeight: BaseWeight(change), FeeRate: 1000, LongTermFeeRate: 1000, ChangeScript: change}
+
+	// Effective values of 100000 and 200000 match exactly, 350000 is beyond the cost of change
+	s, err := SelectBnB(selectionPool(p.FeeRate, 100000, 200000, 350000), p)
+	if err != nil || len(s.Inputs) != 2 || s.Change != 0 || s.Fee != 2 * 68 + 42 {
+		t.Fatalf("Expected changeless exact match, got %+v (%v)", s, err)
+	}
+
+	// Above the long term feerate fewer inputs waste less
+	p.FeeRate = 2000
+	p.Target = 300000 - 84
+	s, err = SelectBnB(selectionPool(p.FeeRate, 100000, 200000, 300000), p)
+	if err != nil || len(s.Inputs) != 1 || s.Inputs[0].Amount != 300000 + 136 {
+		t.Errorf("Expected single input, got %+v (%v)", s, err)
+	}
+
+	if _, err := SelectBnB(selectionPool(p.FeeRate, 100000, 250000), p); err != ErrNoSolution {
+		t.Errorf("Expected no changeless solution, got %v", err)
+	}
+}
+
+func TestSelectLargestFirst(t *testing.T) {
+	change := script.WitnessProgram(0, make([]byte, 20)).Encode()
+	p := SelectionParams{Target: 600000, ChangeScript: change}
+
+	s, err := SelectLargestFirst(selectionPool(0, 100000, 500000, 200000, 400000, 300000), p)
+	if err != nil || len(s.Inputs) != 2 || s.Inputs[0].Amount != 500000 || s.Inputs[1].Amount != 400000 || s.Change != 300000 {
+		t.Errorf("Expected the two largest with change, got %+v (%v)", s, err)
+	}
+}
+
+func TestSelectRandomized(t *testing.T) {
+	change := script.WitnessProgram(1, make([]byte, 32)).Encode()
+	p := SelectionParams{Target: 1234567, BaseWeight: BaseWeight(change, change), FeeRate: 5000, LongTermFeeRate: 1000, ChangeScript: change}
+	pool := selectionPool(p.FeeRate, 50000, 120000, 330000, 410000, 600000, 780000, 1000000, 90000, 25000)
+
+	for seed := int64(0); seed < 20; seed++ {
+		for name, selected := range map[string]func() (*Selection, error){
+			"knapsack": func() (*Selection, error) { return SelectKnapsack(pool, p, rand.New(rand.NewSource(seed))) },
+			"srd": func() (*Selection, error) { return SelectSRD(pool, p, rand.New(rand.NewSource(seed))) },
+			"any": func() (*Selection, error) { return SelectCoins(pool, p, rand.New(rand.NewSource(seed))) },
+		} {
+			s, err := selected()
+			if err != nil {
+				t.Fatalf("%s failed with seed %v (%v)", name, seed, err)
+			}
+			checkSelection(t, s, p)
+		}
+	}
+}
+
+func TestSelectKnapsackExact(t *testing.T) {
+	change := script.WitnessProgram(0, make([]byte, 20)).Encode()
+	p := SelectionParams{Target: 600000, BaseWeight: BaseWeight(change), FeeRate: 5000, ChangeScript: change}
+	exact := p.Target + p.FeeRate.Fee(p.BaseWeight)
+
+	// A UTXO covering the payment and fee is taken without change, whatever the draw
+	for seed := int64(0); seed < 20; seed++ {
+		s, err := SelectKnapsack(selectionPool(p.FeeRate, 100000, exact, 2000000), p, rand.New(rand.NewSource(seed)))
+		if err != nil || len(s.Inputs) != 1 || s.Inputs[0].Index != 1 || s.Change != 0 {
+			t.Fatalf("Expected the exact match without change, got %+v (%v)", s, err)
+		}
+		checkSelection(t, s, p)
+	}
+}
+
+func TestSelectCoins(t *testing.T) {
+	change := script.WitnessProgram(0, make([]byte, 20)).Encode()
+	p := SelectionParams{Target: 600000, ChangeScript: change, LongTermFeeRate: 1000}
+
+	if s, _ := SelectCoins(selectionPool(0, 200000, 400000), p, rand.New(rand.NewSource(1))); s == nil || s.Algorithm != "bnb" {
+		t.Errorf("Expected exact match from branch and bound, got %+v", s)
+	}
+
+	// Change below the dust threshold goes to the fee
+	s, err := SelectCoins(selectionPool(0, 600100), p, rand.New(rand.NewSource(1)))
+	if err != nil || s.Change != 0 || s.Fee != 100 {
+		t.Errorf("Expected dust change dropped, got %+v (%v)", s, err)
+	}
+
+	// UTXOs worth less than their fee are left out
+	p.FeeRate = 10000
+	pool := selectionPool(p.FeeRate, 700000)
+	pool = append(pool, UTXO{TxID: make([]byte, 32), Amount: 100, Script: change})
+	s, err = SelectCoins(pool, p, rand.New(rand.NewSource(1)))
+	if err != nil || len(s.Inputs) != 1 {
+		t.Errorf("Expected uneconomical UTXO skipped, got %+v (%v)", s, err)
+	}
+
+	if _, err := SelectCoins(selectionPool(0, 100000, 200000), p, nil); err != ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds, got %v", err)
+	}
+	if _, err := SelectCoins([]UTXO{{Amount: 1, Script: []byte{0x6a}}}, p, nil); err != ErrUnknownScript {
+		t.Errorf("Expected unknown script, got %v", err)
+	}
+}
+
+// selectionPool makes P2WPKH UTXOs with the given effective values at the feerate
+func selectionPool(rate FeeRate, values ...uint64) []UTXO {
+	lock := script.WitnessProgram(0, make([]byte, 20)).Encode()
+	weight, _ := InputWeight(lock)
+	pool := make([]UTXO, len(values))
+	for i, value := range values {
+		pool[i] = UTXO{TxID: cryptography.Hash256([]byte{byte(i)}), Index: uint32(i), Amount: value + rate.Fee(weight), Script: lock}
+	}
+	return pool
+}
+
+// checkSelection checks the inputs pay the target, change and a fee covering the transaction's weight
+func checkSelection(t *testing.T, s *Selection, p SelectionParams) {
+	var amount uint64
+	weight := p.BaseWeight
+	for _, in := range s.Inputs {
+		amount += in.Amount
+		w, _ := InputWeight(in.Script)
+		weight += w
+	}
+	if s.Change > 0 {
+		weight += outputWeight(p.ChangeScript)
+		if s.Change < DustThreshold(p.ChangeScript) {
+			t.Errorf("%s made dust change %v", s.Algorithm, s.Change)
+		}
+	}
+	if amount != p.Target + s.Change + s.Fee || s.Fee < p.FeeRate.Fee(weight) {
+		t.Errorf("%s selected %v for target %v, change %v and fee %v (weight %v)", s.Algorithm, amount, p.Target, s.Change, s.Fee, weight)
+	}
+}
+
+func testLocation(t *testing.T, params *chainparams.Params) Location {
+	return Location{DataDir: t.TempDir(), Name: DefaultName, Params: params}
+}
+
+func mustRead(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}